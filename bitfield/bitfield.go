@@ -45,22 +45,48 @@ func (bf *Bitfield) SumTrue() int {
 }
 
 func (bf *Bitfield) SetTrue(index int) (err error) {
-	if (bf.length > 0 && index >= bf.length) || (bf.length == 0 && index >= len(bf.field)*8) {
+	if index < 0 || (bf.length > 0 && index >= bf.length) || (bf.length == 0 && index >= len(bf.field)*8) {
 		err = errors.New("Bitfield error: Index out of range")
+		return
+	}
+	if bf.Get(index) {
+		return
 	}
 	bf.field[index>>3] |= 1 << (7 - uint(index)&7)
 	bf.sum++
 	return
 }
 
+func (bf *Bitfield) SetFalse(index int) (err error) {
+	if index < 0 || (bf.length > 0 && index >= bf.length) || (bf.length == 0 && index >= len(bf.field)*8) {
+		err = errors.New("Bitfield error: Index out of range")
+		return
+	}
+	if !bf.Get(index) {
+		return
+	}
+	bf.field[index>>3] &^= 1 << (7 - uint(index)&7)
+	bf.sum--
+	return
+}
+
 func (bf *Bitfield) Get(index int) bool {
-	if (bf.length > 0 && index >= bf.length) || (bf.length == 0 && index >= len(bf.field)*8) {
+	if index < 0 || (bf.length > 0 && index >= bf.length) || (bf.length == 0 && index >= len(bf.field)*8) {
 		return false
 	}
 
 	return bf.field[index>>3]&(1<<(7-uint(index)&7)) != 0
 }
 
+// Copy returns an independent copy of the bitfield.
+func (bf *Bitfield) Copy() *Bitfield {
+	return &Bitfield{
+		length: bf.length,
+		sum:    bf.sum,
+		field:  append([]byte(nil), bf.field...),
+	}
+}
+
 func (bf *Bitfield) Bytes() []byte {
 	return bf.field
 }
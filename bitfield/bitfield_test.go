@@ -33,3 +33,32 @@ func TestBitfieldGet(t *testing.T) {
 		t.Error("Bitfield Get failed")
 	}
 }
+
+func TestBitfieldSetTrueTwice(t *testing.T) {
+	bf := NewBitfield(14)
+	bf.SetTrue(3)
+	bf.SetTrue(3)
+	if bf.SumTrue() != 1 {
+		t.Errorf("Setting a bit twice changed SumTrue, got: %d", bf.SumTrue())
+	}
+	if err := bf.SetTrue(14); err == nil {
+		t.Error("Expected error setting out of range bit")
+	}
+}
+
+func TestBitfieldSetFalse(t *testing.T) {
+	bf := NewBitfield(14)
+	bf.SetTrue(0)
+	bf.SetTrue(9)
+	bf.SetFalse(9)
+	bf.SetFalse(5)
+	if !bytes.Equal(bf.field, []byte{0x80, 0x00}) {
+		t.Errorf("Bitfield SetFalse failed, got: %x", bf.field)
+	}
+	if bf.SumTrue() != 1 {
+		t.Errorf("Bitfield SumTrue incorrect, got: %d", bf.SumTrue())
+	}
+	if err := bf.SetFalse(14); err == nil {
+		t.Error("Expected error clearing out of range bit")
+	}
+}
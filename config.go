@@ -1,6 +1,47 @@
 package libtorrent
 
+import (
+	"github.com/torrance/libtorrent/filestore"
+	"github.com/torrance/libtorrent/ipfilter"
+	"github.com/torrance/libtorrent/ratelimit"
+)
+
 type Config struct {
 	RootDirectory string
 	Port          uint16
+	// PeerId identifies us to other peers. If nil, the package level PeerId is used.
+	PeerId []byte
+	// Global limiters shared by every torrent using this config. Nil means unlimited.
+	UploadLimiter   *ratelimit.Limiter
+	DownloadLimiter *ratelimit.Limiter
+	// Connection limits shared by every torrent using this config. If nil, a
+	// process wide default is used.
+	ConnectionManager *ConnectionManager
+	// IPFilter blocks connections to and from the addresses it contains,
+	// including those accepted by a Listener. Reloading it takes effect for
+	// every torrent using this config. Nil means no filtering.
+	IPFilter *ipfilter.Filter
+	// Storage holds the data of each torrent's files. If nil, files are
+	// stored on disk under RootDirectory.
+	Storage filestore.Storage
+	// FilePool limits the file handles held open by every torrent using this
+	// config, when files are stored under RootDirectory. If nil,
+	// filestore.DefaultFilePool is used.
+	FilePool *filestore.FilePool
+	// Allocation decides how the space of files stored under RootDirectory
+	// is set aside when they are created. The default is sparse files.
+	Allocation filestore.AllocationMode
+	// DiskQueue runs the disk reads, writes and hash checks of every torrent
+	// using this config. If nil, filestore.DefaultDiskQueue is used.
+	DiskQueue *filestore.DiskQueue
+	// ReadOnly seeds existing data without ever creating, truncating or
+	// writing a file. Unless Storage is set, files are opened read only
+	// under RootDirectory. Files that are missing or the wrong size are
+	// reported by Torrent.FileError rather than failing the torrent, and
+	// nothing is ever downloaded.
+	ReadOnly bool
+	// SeedMode trusts that the data is complete instead of hashing every
+	// piece when a torrent is created. Each piece is verified the first
+	// time a peer asks for it, and dropped if it fails.
+	SeedMode bool
 }
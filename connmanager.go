@@ -0,0 +1,275 @@
+package libtorrent
+
+import (
+	"sync"
+	"time"
+)
+
+// Peer sources, recording where we first learned of a candidate address.
+// Private torrents only accept peers from their trackers and incoming
+// connections, so any DHT, peer exchange or local discovery implementation
+// must add its candidates with its own source.
+const (
+	SourceTracker = iota
+	SourceIncoming
+	SourceDHT
+	SourcePEX
+	SourceLSD
+)
+
+const (
+	defaultMaxConnections        = 200
+	defaultMaxHalfOpen           = 20
+	defaultMaxTorrentConnections = 50
+	maxCandidates                = 1000
+	maxCandidateFailures         = 8
+	candidateBackoff             = time.Second * 30
+	maxCandidateBackoff          = time.Hour
+	dialTimeout                  = time.Second * 20
+	// Newly connected peers are given this long to prove their worth before
+	// they may be evicted to make room for others.
+	evictionGracePeriod = time.Minute
+)
+
+// defaultConnectionManager is shared by all torrents whose Config does not supply their own.
+var defaultConnectionManager = NewConnectionManager(defaultMaxConnections, defaultMaxHalfOpen)
+
+// ConnectionManager enforces the connection limits shared by all torrents that
+// use it. Half-open connections are outgoing dials that have not yet completed.
+type ConnectionManager struct {
+	mutex          sync.Mutex
+	maxConnections int
+	maxHalfOpen    int
+	connections    int
+	halfOpen       int
+}
+
+func NewConnectionManager(maxConnections, maxHalfOpen int) (cm *ConnectionManager) {
+	cm = &ConnectionManager{
+		maxConnections: maxConnections,
+		maxHalfOpen:    maxHalfOpen,
+	}
+	return
+}
+
+func (cm *ConnectionManager) SetMaxConnections(n int) {
+	cm.mutex.Lock()
+	cm.maxConnections = n
+	cm.mutex.Unlock()
+}
+
+func (cm *ConnectionManager) SetMaxHalfOpen(n int) {
+	cm.mutex.Lock()
+	cm.maxHalfOpen = n
+	cm.mutex.Unlock()
+}
+
+func (cm *ConnectionManager) Connections() (n int) {
+	cm.mutex.Lock()
+	n = cm.connections
+	cm.mutex.Unlock()
+	return
+}
+
+func (cm *ConnectionManager) acquireConnection() (ok bool) {
+	cm.mutex.Lock()
+	if cm.connections < cm.maxConnections {
+		cm.connections++
+		ok = true
+	}
+	cm.mutex.Unlock()
+	return
+}
+
+func (cm *ConnectionManager) releaseConnection() {
+	cm.mutex.Lock()
+	cm.connections--
+	cm.mutex.Unlock()
+}
+
+// freeSlots returns how many more outgoing dials may be started, accounting for
+// both open and half-open connections.
+func (cm *ConnectionManager) freeSlots() (n int) {
+	cm.mutex.Lock()
+	n = cm.maxConnections - cm.connections - cm.halfOpen
+	if m := cm.maxHalfOpen - cm.halfOpen; m < n {
+		n = m
+	}
+	cm.mutex.Unlock()
+	return
+}
+
+func (cm *ConnectionManager) acquireHalfOpen() (ok bool) {
+	cm.mutex.Lock()
+	if cm.halfOpen < cm.maxHalfOpen {
+		cm.halfOpen++
+		ok = true
+	}
+	cm.mutex.Unlock()
+	return
+}
+
+func (cm *ConnectionManager) releaseHalfOpen() {
+	cm.mutex.Lock()
+	cm.halfOpen--
+	cm.mutex.Unlock()
+}
+
+type peerCandidate struct {
+	addr        string
+	source      int
+	failCount   int
+	lastAttempt time.Time
+	dialing     bool
+	connected   bool
+	banned      bool
+	expired     bool
+}
+
+// nextAttempt returns the earliest time we should try to dial this candidate again,
+// backing off exponentially with each failure.
+func (pc *peerCandidate) nextAttempt() time.Time {
+	if pc.failCount == 0 {
+		return pc.lastAttempt
+	}
+	backoff := candidateBackoff * time.Duration(1<<uint(pc.failCount-1))
+	if backoff > maxCandidateBackoff {
+		backoff = maxCandidateBackoff
+	}
+	return pc.lastAttempt.Add(backoff)
+}
+
+// candidateList holds every address a torrent might connect to.
+type candidateList struct {
+	mutex      sync.Mutex
+	candidates map[string]*peerCandidate
+}
+
+func newCandidateList() *candidateList {
+	return &candidateList{candidates: make(map[string]*peerCandidate)}
+}
+
+// add records a new candidate address. Addresses we already know about are ignored.
+// If the list is full, the candidate with the most failures is dropped to make room.
+func (cl *candidateList) add(addr string, source int) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if _, ok := cl.candidates[addr]; ok {
+		return
+	}
+
+	if len(cl.candidates) >= maxCandidates {
+		var worst *peerCandidate
+		for _, pc := range cl.candidates {
+			if !pc.connected && !pc.banned && (worst == nil || pc.failCount > worst.failCount) {
+				worst = pc
+			}
+		}
+		if worst == nil {
+			return
+		}
+		delete(cl.candidates, worst.addr)
+	}
+
+	cl.candidates[addr] = &peerCandidate{addr: addr, source: source}
+}
+
+// next returns up to n candidates that are ready to be dialed and marks them as attempted.
+func (cl *candidateList) next(now time.Time, n int) (addrs []string) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	for _, pc := range cl.candidates {
+		if len(addrs) >= n {
+			break
+		}
+		if pc.connected || pc.dialing || pc.banned || pc.expired || now.Before(pc.nextAttempt()) {
+			continue
+		}
+		pc.lastAttempt = now
+		pc.dialing = true
+		addrs = append(addrs, pc.addr)
+	}
+	return
+}
+
+// failed records a failed attempt to connect to addr. After too many failures
+// the candidate expires. Like a ban, the entry is kept so that future announces
+// of the same address are ignored, but it may be dropped when the list is full.
+func (cl *candidateList) failed(addr string) {
+	cl.mutex.Lock()
+	if pc, ok := cl.candidates[addr]; ok && !pc.banned {
+		pc.dialing = false
+		pc.failCount++
+		if pc.failCount >= maxCandidateFailures {
+			pc.expired = true
+		}
+	}
+	cl.mutex.Unlock()
+}
+
+// cancel returns addr to the list after next handed it out but it was never
+// dialed. Unlike failed, it does not count against the candidate.
+func (cl *candidateList) cancel(addr string) {
+	cl.mutex.Lock()
+	if pc, ok := cl.candidates[addr]; ok {
+		pc.dialing = false
+	}
+	cl.mutex.Unlock()
+}
+
+func (cl *candidateList) setConnected(addr string, connected bool) {
+	cl.mutex.Lock()
+	if pc, ok := cl.candidates[addr]; ok {
+		pc.dialing = false
+		pc.connected = connected
+		if connected {
+			pc.failCount = 0
+		}
+	}
+	cl.mutex.Unlock()
+}
+
+// ban permanently excludes addr from being dialed. The entry is kept so that
+// future announces of the same address are ignored.
+func (cl *candidateList) ban(addr string) {
+	cl.mutex.Lock()
+	pc, ok := cl.candidates[addr]
+	if !ok {
+		pc = &peerCandidate{addr: addr}
+		cl.candidates[addr] = pc
+	}
+	pc.banned = true
+	pc.dialing = false
+	pc.connected = false
+	cl.mutex.Unlock()
+}
+
+func (cl *candidateList) isBanned(addr string) (banned bool) {
+	cl.mutex.Lock()
+	if pc, ok := cl.candidates[addr]; ok {
+		banned = pc.banned
+	}
+	cl.mutex.Unlock()
+	return
+}
+
+// snapshot returns a copy of every candidate that has not been banned or expired.
+func (cl *candidateList) snapshot() (candidates []peerCandidate) {
+	cl.mutex.Lock()
+	for _, pc := range cl.candidates {
+		if !pc.banned && !pc.expired {
+			candidates = append(candidates, *pc)
+		}
+	}
+	cl.mutex.Unlock()
+	return
+}
+
+func (cl *candidateList) Len() (n int) {
+	cl.mutex.Lock()
+	n = len(cl.candidates)
+	cl.mutex.Unlock()
+	return
+}
@@ -0,0 +1,119 @@
+package libtorrent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectionManagerLimits(t *testing.T) {
+	cm := NewConnectionManager(2, 1)
+
+	if !cm.acquireHalfOpen() {
+		t.Fatal("Failed to acquire first half-open slot")
+	}
+	if cm.acquireHalfOpen() {
+		t.Error("Acquired half-open slot beyond limit")
+	}
+	if n := cm.freeSlots(); n != 0 {
+		t.Errorf("Expected no free dial slots, got: %d", n)
+	}
+	cm.releaseHalfOpen()
+
+	if !cm.acquireConnection() || !cm.acquireConnection() {
+		t.Fatal("Failed to acquire connections within limit")
+	}
+	if cm.acquireConnection() {
+		t.Error("Acquired connection beyond limit")
+	}
+	if n := cm.freeSlots(); n != 0 {
+		t.Errorf("Expected no free dial slots when connections are full, got: %d", n)
+	}
+	cm.releaseConnection()
+	if cm.Connections() != 1 {
+		t.Errorf("Incorrect connection count, got: %d", cm.Connections())
+	}
+}
+
+func TestCandidateListDeduplicates(t *testing.T) {
+	cl := newCandidateList()
+	cl.add("127.0.0.1:6881", SourceTracker)
+	cl.add("127.0.0.1:6881", SourceTracker)
+	cl.add("127.0.0.1:6882", SourceTracker)
+	if cl.Len() != 2 {
+		t.Errorf("Expected 2 candidates, got: %d", cl.Len())
+	}
+}
+
+func TestCandidateListSkipsConnectedAndDialing(t *testing.T) {
+	cl := newCandidateList()
+	cl.add("127.0.0.1:6881", SourceTracker)
+	cl.add("127.0.0.1:6882", SourceTracker)
+
+	now := time.Now()
+	cl.setConnected("127.0.0.1:6881", true)
+	addrs := cl.next(now, 10)
+	if len(addrs) != 1 || addrs[0] != "127.0.0.1:6882" {
+		t.Fatalf("Expected only unconnected candidate, got: %v", addrs)
+	}
+
+	// The remaining candidate is now mid-dial and must not be returned again
+	if addrs := cl.next(now, 10); len(addrs) != 0 {
+		t.Errorf("Candidate returned whilst still dialing: %v", addrs)
+	}
+}
+
+func TestCandidateListBackoff(t *testing.T) {
+	cl := newCandidateList()
+	cl.add("127.0.0.1:6881", SourceTracker)
+
+	now := time.Now()
+	cl.next(now, 1)
+	cl.failed("127.0.0.1:6881")
+	if addrs := cl.next(now.Add(candidateBackoff/2), 1); len(addrs) != 0 {
+		t.Error("Candidate returned before backoff expired")
+	}
+
+	now = now.Add(candidateBackoff)
+	if addrs := cl.next(now, 1); len(addrs) != 1 {
+		t.Fatal("Candidate not returned after backoff expired")
+	}
+	cl.failed("127.0.0.1:6881")
+	if addrs := cl.next(now.Add(candidateBackoff), 1); len(addrs) != 0 {
+		t.Error("Backoff did not double after second failure")
+	}
+	if addrs := cl.next(now.Add(candidateBackoff*2), 1); len(addrs) != 1 {
+		t.Error("Candidate not returned after second backoff expired")
+	}
+}
+
+func TestCandidateListExpiresRepeatedFailures(t *testing.T) {
+	cl := newCandidateList()
+	cl.add("127.0.0.1:6881", SourceTracker)
+	for i := 0; i < maxCandidateFailures; i++ {
+		cl.failed("127.0.0.1:6881")
+	}
+	if addrs := cl.next(time.Now().Add(maxCandidateBackoff), 1); len(addrs) != 0 {
+		t.Error("Candidate returned after repeated failures")
+	}
+
+	// Announcing the address again must not reset its failures
+	cl.add("127.0.0.1:6881", SourceTracker)
+	if addrs := cl.next(time.Now().Add(maxCandidateBackoff), 1); len(addrs) != 0 {
+		t.Error("Expired candidate revived by being added again")
+	}
+	if len(cl.snapshot()) != 0 {
+		t.Error("Expired candidate included in snapshot")
+	}
+}
+
+func TestCandidateListCancel(t *testing.T) {
+	cl := newCandidateList()
+	cl.add("127.0.0.1:6881", SourceTracker)
+
+	now := time.Now()
+	cl.next(now, 1)
+	cl.cancel("127.0.0.1:6881")
+	if addrs := cl.next(now, 1); len(addrs) != 1 {
+		t.Error("Cancelled candidate not returned again without backoff")
+	}
+}
@@ -0,0 +1,128 @@
+package libtorrent
+
+// blockWritten is delivered on the read channel, without a peer, when the disk
+// queue has written a downloaded block.
+type blockWritten struct {
+	pd     *pieceDownload
+	offset int64
+	err    error
+}
+
+// pieceHashed is delivered on the read channel, without a peer, when the disk
+// queue has checked the hash of a downloaded piece.
+type pieceHashed struct {
+	pd  *pieceDownload
+	ok  bool
+	err error
+}
+
+// pieceRead is delivered on the read channel, without a peer, when the disk
+// queue has read back a hashed piece for smart banning.
+type pieceRead struct {
+	pd     *pieceDownload
+	passed bool
+	data   []byte
+	err    error
+}
+
+// uploadBlock reads a block requested by peer on the disk queue, and sends it
+// once read. Slow peers must not hold up the disk workers, so blocks are sent
+// from their own goroutine.
+func (t *Torrent) uploadBlock(peer *peer, msg *requestMessage) {
+	t.diskQueue.Read(t.fileStore, int(msg.pieceIndex), int64(msg.blockOffset), int64(msg.blockLength), func(block []byte, err error) {
+		if err != nil {
+			logger.Error("Failed to read block (%d, %d): %s", msg.pieceIndex, msg.blockOffset, err)
+			return
+		}
+		logger.Debug("Peer %s has asked for a block (%d, %d, %d), sending it to them", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
+		go peer.Send(&pieceMessage{
+			pieceIndex:  msg.pieceIndex,
+			blockOffset: msg.blockOffset,
+			data:        block,
+		})
+	})
+}
+
+// writeBlock writes a received block of pd on the disk queue. The result is
+// delivered back to the receive loop, which must not wait for the disk.
+func (t *Torrent) writeBlock(pd *pieceDownload, msg *pieceMessage) {
+	pd.writing++
+	offset := int64(msg.blockOffset)
+	t.diskQueue.Write(t.fileStore, pd.index, offset, msg.data, func(err error) {
+		go func() { t.readChan <- peerDouble{msg: &blockWritten{pd: pd, offset: offset, err: err}} }()
+	})
+}
+
+// handleBlockWritten is called from the receive loop when a block has been written.
+// Once every block of a piece is written, its hash is checked on the disk
+// queue. Pieces abandoned meanwhile, by a failed write or a recheck, are
+// ignored.
+func (t *Torrent) handleBlockWritten(msg *blockWritten) {
+	pd := msg.pd
+	pd.writing--
+	if t.picker.downloads[pd.index] != pd {
+		return
+	}
+	if msg.err != nil {
+		logger.Error("Failed to write block (%d, %d): %s", pd.index, msg.offset, msg.err)
+		// Start the piece again from scratch
+		t.picker.finished(pd.index)
+		t.requestWebSeeds()
+		for _, p := range t.peers() {
+			t.requestBlocks(p)
+		}
+		return
+	}
+	if pd.remaining == 0 && pd.writing == 0 {
+		t.diskQueue.Hash(t.fileStore, pd.index, func(ok bool, err error) {
+			go func() { t.readChan <- peerDouble{msg: &pieceHashed{pd: pd, ok: ok, err: err}} }()
+		})
+	}
+}
+
+// handlePieceHashed is called from the receive loop when a piece's hash has been
+// checked.
+func (t *Torrent) handlePieceHashed(msg *pieceHashed) {
+	if t.picker.downloads[msg.pd.index] != msg.pd {
+		return
+	}
+	t.pieceComplete(msg.pd, msg.ok, msg.err)
+}
+
+// readPiece reads back the whole of pd on the disk queue, once it has passed or
+// failed its hash check, for smart banning. The data is delivered back to the
+// receive loop.
+func (t *Torrent) readPiece(pd *pieceDownload, passed bool) {
+	t.diskQueue.Read(t.fileStore, pd.index, 0, t.fileStore.PieceLength(pd.index), func(data []byte, err error) {
+		go func() { t.readChan <- peerDouble{msg: &pieceRead{pd: pd, passed: passed, data: data, err: err}} }()
+	})
+}
+
+// handlePieceRead is called from the receive loop when a piece has been read
+// back for smart banning. The blocks of a failed piece are recorded, and it is
+// then downloaded again. A piece that passed identifies who sent the corrupt
+// blocks of its earlier failures.
+func (t *Torrent) handlePieceRead(msg *pieceRead) {
+	pd := msg.pd
+	getBlock := func(offset, length int64) ([]byte, error) {
+		if msg.err != nil {
+			return nil, msg.err
+		}
+		return msg.data[offset : offset+length], nil
+	}
+
+	if msg.passed {
+		for _, ip := range t.smartBan.piecePassed(pd, getBlock) {
+			logger.Info("Banning %s for sending corrupt data in piece %d", ip, pd.index)
+			t.banIP(ip)
+		}
+		return
+	}
+	// Abandoned meanwhile by a recheck
+	if t.picker.downloads[pd.index] != pd {
+		return
+	}
+	t.smartBan.pieceFailed(pd, getBlock)
+	t.picker.finished(pd.index)
+	t.requestWebSeeds()
+}
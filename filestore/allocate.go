@@ -0,0 +1,53 @@
+package filestore
+
+import (
+	"errors"
+	"os"
+)
+
+// AllocationMode decides how a file's space is set aside when it is created.
+type AllocationMode int
+
+const (
+	// AllocateSparse extends files without writing them, so that space is
+	// only used as data arrives. Files downloaded out of order fragment.
+	AllocateSparse AllocationMode = iota
+	// AllocateFull reserves every file's space up front, using fallocate
+	// where the platform and filesystem support it and writing zeros
+	// otherwise.
+	AllocateFull
+	// AllocateZero writes zeros over every file's space up front.
+	AllocateZero
+)
+
+var errAllocateUnsupported = errors.New("Preallocation is not supported on this platform")
+
+// allocate sets aside space for fd, whose current size is size, to grow to
+// length. Data already in the file is kept.
+func allocate(fd *os.File, mode AllocationMode, size int64, length int64) (err error) {
+	switch mode {
+	case AllocateFull:
+		if err = fallocate(fd, length); err == nil {
+			return
+		}
+		return zeroFill(fd, size, length)
+	case AllocateZero:
+		return zeroFill(fd, size, length)
+	}
+	return fd.Truncate(length)
+}
+
+// zeroFill writes zeros to fd from offset to length.
+func zeroFill(fd *os.File, offset int64, length int64) (err error) {
+	buf := make([]byte, 1<<20)
+	for ; offset < length; offset += int64(len(buf)) {
+		chunk := buf
+		if int64(len(chunk)) > length-offset {
+			chunk = chunk[:length-offset]
+		}
+		if _, err = fd.WriteAt(chunk, offset); err != nil {
+			return
+		}
+	}
+	return
+}
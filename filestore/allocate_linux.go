@@ -0,0 +1,15 @@
+package filestore
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves the space for fd to grow to length, extending it if
+// necessary.
+func fallocate(fd *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	return syscall.Fallocate(int(fd.Fd()), 0, 0, length)
+}
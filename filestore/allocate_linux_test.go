@@ -0,0 +1,36 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFullAllocationIsNotSparse(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	blocks := func(mode AllocationMode, name string) int64 {
+		tfile, err := newTorrentFile(NewFilePool(1), mode, tmpDir, name, 1<<20)
+		if err != nil {
+			t.Fatal("Failed to create file: ", err)
+		}
+		tfile.Close()
+		var st syscall.Stat_t
+		if err = syscall.Stat(filepath.Join(tmpDir, name), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st.Blocks * 512
+	}
+	if sparse := blocks(AllocateSparse, "sparse"); sparse >= 1<<20 {
+		t.Skip("Filesystem does not support sparse files")
+	}
+	if full := blocks(AllocateFull, "full"); full < 1<<20 {
+		t.Errorf("Fully allocated file only uses %d bytes", full)
+	}
+}
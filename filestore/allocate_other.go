@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package filestore
+
+import (
+	"os"
+)
+
+// fallocate is not supported on this platform, so full allocation falls back
+// to writing zeros.
+func fallocate(fd *os.File, length int64) error {
+	return errAllocateUnsupported
+}
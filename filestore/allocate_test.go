@@ -0,0 +1,48 @@
+package filestore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllocationModes(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, mode := range []AllocationMode{AllocateSparse, AllocateFull, AllocateZero} {
+		// Data already in the file survives allocation
+		path := filepath.Join(tmpDir, string('a'+rune(mode)))
+		if err = ioutil.WriteFile(path, []byte("existing"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tfile, err := newTorrentFile(NewFilePool(1), mode, tmpDir, filepath.Base(path), 3<<20)
+		if err != nil {
+			t.Fatalf("Failed to create file with mode %d: %s", mode, err)
+		}
+		tfile.Close()
+
+		data, _ := ioutil.ReadFile(path)
+		if len(data) != 3<<20 || !bytes.HasPrefix(data, []byte("existing")) {
+			t.Errorf("Mode %d allocated %d bytes, expected %d following the existing data", mode, len(data), 3<<20)
+		}
+		if !bytes.Equal(data[8:], make([]byte, len(data)-8)) {
+			t.Errorf("Mode %d allocated space that is not zeroed", mode)
+		}
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	free, err := FreeSpace(os.TempDir())
+	if err != nil {
+		t.Skip("Free space unsupported: ", err)
+	}
+	if free <= 0 {
+		t.Errorf("Implausible free space of %d bytes", free)
+	}
+}
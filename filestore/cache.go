@@ -0,0 +1,401 @@
+package filestore
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+const (
+	// Blocks are cached in units of the standard 16 KiB request
+	cacheBlockSize   = 16384
+	defaultCacheSize = 32 * 1024 * 1024
+)
+
+// BlockCache keeps whole pieces in memory, up to a fixed number of bytes
+// shared by every filestore using it. Downloaded blocks are held until their
+// piece is complete, then hashed from memory and written with a single write.
+// A request for the first block of a piece reads the whole piece, so that the
+// requests for the rest of it do not go to disk. When the cache is full the
+// least recently used pieces are dropped, writing out any blocks not yet on
+// disk. Blocks are written without holding the cache's lock, so one slow disk
+// does not hold up every other user of the cache.
+//
+// A nil BlockCache caches nothing, and passes everything through to the
+// filestore.
+type BlockCache struct {
+	mutex    sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List // Of *cachedPiece, most recent first
+	pieces   map[cacheKey]*list.Element
+	hits     int64
+	misses   int64
+	writing  map[cacheKey]int // Pieces taken out of the cache and being written
+	written  *sync.Cond       // Signalled when a piece has been written
+}
+
+type cacheKey struct {
+	fs    *FileStore
+	index int
+}
+
+type cachedPiece struct {
+	key   cacheKey
+	data  []byte
+	valid []bool // Whether each block of data has been read or written
+	dirty []bool // Whether each block of data has yet to be written to disk
+}
+
+func NewBlockCache(maxBytes int64) (bc *BlockCache) {
+	bc = &BlockCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		pieces:   make(map[cacheKey]*list.Element),
+		writing:  make(map[cacheKey]int),
+	}
+	bc.written = sync.NewCond(&bc.mutex)
+	return
+}
+
+// SetMaxBytes resizes the cache, writing out any pieces that no longer fit.
+func (bc *BlockCache) SetMaxBytes(n int64) (err error) {
+	bc.mutex.Lock()
+	bc.maxBytes = n
+	evicted := bc.evict()
+	bc.mutex.Unlock()
+	return bc.writeOut(evicted)
+}
+
+// Size returns the number of bytes of pieces held in the cache.
+func (bc *BlockCache) Size() (n int64) {
+	bc.mutex.Lock()
+	n = bc.size
+	bc.mutex.Unlock()
+	return
+}
+
+// Stats returns the number of block reads served from memory, and the number
+// that went to disk.
+func (bc *BlockCache) Stats() (hits, misses int64) {
+	bc.mutex.Lock()
+	hits, misses = bc.hits, bc.misses
+	bc.mutex.Unlock()
+	return
+}
+
+// newCachedPiece holds data, which must be the length of the piece. It is
+// zeroed if nil.
+func newCachedPiece(key cacheKey, data []byte) *cachedPiece {
+	if data == nil {
+		data = make([]byte, key.fs.PieceLength(key.index))
+	}
+	blocks := (len(data) + cacheBlockSize - 1) / cacheBlockSize
+	return &cachedPiece{
+		key:   key,
+		data:  data,
+		valid: make([]bool, blocks),
+		dirty: make([]bool, blocks),
+	}
+}
+
+// covers reports whether the length bytes at offset are all in memory.
+func (cp *cachedPiece) covers(offset, length int64) bool {
+	if length <= 0 {
+		return false
+	}
+	for i := offset / cacheBlockSize; i <= (offset+length-1)/cacheBlockSize; i++ {
+		if !cp.valid[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (cp *cachedPiece) complete() bool {
+	return cp.covers(0, int64(len(cp.data)))
+}
+
+// flush writes the piece's dirty blocks to disk, coalescing neighbouring
+// blocks into a single write.
+func (cp *cachedPiece) flush() (err error) {
+	for i := 0; i < len(cp.dirty); {
+		if !cp.dirty[i] {
+			i++
+			continue
+		}
+		j := i
+		for j < len(cp.dirty) && cp.dirty[j] {
+			j++
+		}
+		start, end := int64(i)*cacheBlockSize, int64(j)*cacheBlockSize
+		if end > int64(len(cp.data)) {
+			end = int64(len(cp.data))
+		}
+		if err = cp.key.fs.WriteBlock(cp.key.index, start, cp.data[start:end]); err != nil {
+			return
+		}
+		for ; i < j; i++ {
+			cp.dirty[i] = false
+		}
+	}
+	return
+}
+
+// insert adds a piece to the cache, returning the pieces evicted to make room,
+// which the caller must write out with writeOut once it has released mutex.
+// The caller must hold mutex.
+func (bc *BlockCache) insert(cp *cachedPiece) []*cachedPiece {
+	bc.pieces[cp.key] = bc.lru.PushFront(cp)
+	bc.size += int64(len(cp.data))
+	return bc.evict()
+}
+
+// remove takes a piece out of the cache, without writing it. The caller must
+// hold mutex.
+func (bc *BlockCache) remove(e *list.Element) *cachedPiece {
+	cp := e.Value.(*cachedPiece)
+	bc.lru.Remove(e)
+	delete(bc.pieces, cp.key)
+	bc.size -= int64(len(cp.data))
+	return cp
+}
+
+// take removes a piece from the cache to be written out with writeOut. Until
+// then, wait holds up anyone about to read the piece from disk. The caller must
+// hold mutex.
+func (bc *BlockCache) take(e *list.Element) *cachedPiece {
+	cp := bc.remove(e)
+	bc.writing[cp.key]++
+	return cp
+}
+
+// evict takes the least recently used pieces until the cache is within its
+// size, returning them to be written out. The caller must hold mutex.
+func (bc *BlockCache) evict() (evicted []*cachedPiece) {
+	for bc.size > bc.maxBytes && bc.lru.Len() > 0 {
+		evicted = append(evicted, bc.take(bc.lru.Back()))
+	}
+	return
+}
+
+// writeOut writes the blocks not yet on disk of pieces taken from the cache.
+// Blocks that cannot be written are lost, and the first error is returned. The
+// caller must not hold mutex.
+func (bc *BlockCache) writeOut(pieces []*cachedPiece) (err error) {
+	if len(pieces) == 0 {
+		return
+	}
+	for _, cp := range pieces {
+		if flushErr := cp.flush(); err == nil {
+			err = flushErr
+		}
+	}
+	bc.mutex.Lock()
+	for _, cp := range pieces {
+		if bc.writing[cp.key]--; bc.writing[cp.key] == 0 {
+			delete(bc.writing, cp.key)
+		}
+	}
+	bc.mutex.Unlock()
+	bc.written.Broadcast()
+	return
+}
+
+// wait blocks until no piece with key is being written out, so that what is
+// on disk is up to date. The caller must hold mutex.
+func (bc *BlockCache) wait(key cacheKey) {
+	for bc.writing[key] > 0 {
+		bc.written.Wait()
+	}
+}
+
+// ReadBlock reads a block of fs, from memory if it can. Reading the first
+// block of a piece reads the whole piece into the cache.
+func (bc *BlockCache) ReadBlock(fs *FileStore, pieceIndex int, offset int64, length int64) (block []byte, err error) {
+	if bc == nil {
+		return fs.GetBlock(pieceIndex, offset, length)
+	}
+	if length+offset > fs.PieceLength(pieceIndex) {
+		err = errors.New("Requested block overran piece length")
+		return
+	}
+
+	key := cacheKey{fs, pieceIndex}
+	bc.mutex.Lock()
+	e := bc.pieces[key]
+	if e != nil && e.Value.(*cachedPiece).covers(offset, length) {
+		bc.lru.MoveToFront(e)
+		block = append([]byte(nil), e.Value.(*cachedPiece).data[offset:offset+length]...)
+		bc.hits++
+		bc.mutex.Unlock()
+		return
+	}
+	bc.misses++
+	// What is on disk must be up to date before it is read
+	if e != nil {
+		taken := bc.take(e)
+		bc.mutex.Unlock()
+		if err = bc.writeOut([]*cachedPiece{taken}); err != nil {
+			return
+		}
+		bc.mutex.Lock()
+	}
+	bc.wait(key)
+	bc.mutex.Unlock()
+	if offset != 0 || fs.PieceLength(pieceIndex) > bc.maxBytes {
+		return fs.GetBlock(pieceIndex, offset, length)
+	}
+
+	// Read ahead the whole piece
+	data, err := fs.GetBlock(pieceIndex, 0, fs.PieceLength(pieceIndex))
+	if err != nil {
+		return
+	}
+	block = append([]byte(nil), data[:length]...)
+	bc.mutex.Lock()
+	if e = bc.pieces[key]; e != nil {
+		// Blocks written meanwhile are newer than what we read
+		cp := e.Value.(*cachedPiece)
+		for i := range cp.valid {
+			if !cp.valid[i] {
+				start := int64(i) * cacheBlockSize
+				copy(cp.data[start:], data[start:])
+				cp.valid[i] = true
+			}
+		}
+		bc.lru.MoveToFront(e)
+		bc.mutex.Unlock()
+		return
+	}
+	cp := newCachedPiece(key, data)
+	for i := range cp.valid {
+		cp.valid[i] = true
+	}
+	evicted := bc.insert(cp)
+	bc.mutex.Unlock()
+	err = bc.writeOut(evicted)
+	return
+}
+
+// WriteBlock stores a block of fs in the cache, to be written to disk once its
+// piece is hashed, or when it is evicted. Blocks that do not line up with the
+// cache's blocks are written straight through.
+func (bc *BlockCache) WriteBlock(fs *FileStore, pieceIndex int, offset int64, block []byte) (err error) {
+	if bc == nil {
+		return fs.WriteBlock(pieceIndex, offset, block)
+	}
+	pieceLength := fs.PieceLength(pieceIndex)
+	if int64(len(block))+offset > pieceLength {
+		return errors.New("Block overran piece length")
+	}
+
+	key := cacheKey{fs, pieceIndex}
+	bc.mutex.Lock()
+	e := bc.pieces[key]
+	aligned := offset%cacheBlockSize == 0 && (len(block) == cacheBlockSize || offset+int64(len(block)) == pieceLength)
+	if !aligned || pieceLength > bc.maxBytes {
+		if e != nil {
+			taken := bc.take(e)
+			bc.mutex.Unlock()
+			if err = bc.writeOut([]*cachedPiece{taken}); err != nil {
+				return
+			}
+			bc.mutex.Lock()
+		}
+		bc.wait(key)
+		bc.mutex.Unlock()
+		return fs.WriteBlock(pieceIndex, offset, block)
+	}
+
+	var cp *cachedPiece
+	var evicted []*cachedPiece
+	if e != nil {
+		cp = e.Value.(*cachedPiece)
+		bc.lru.MoveToFront(e)
+	} else {
+		cp = newCachedPiece(key, nil)
+		evicted = bc.insert(cp)
+	}
+	copy(cp.data[offset:], block)
+	cp.valid[offset/cacheBlockSize] = true
+	cp.dirty[offset/cacheBlockSize] = true
+	bc.mutex.Unlock()
+	return bc.writeOut(evicted)
+}
+
+// ValidatePiece checks a piece of fs against its hash, from memory if every
+// block of it is cached, and writes any of its blocks not yet on disk. Pieces
+// that fail are dropped from the cache.
+func (bc *BlockCache) ValidatePiece(fs *FileStore, pieceIndex int) (ok bool, err error) {
+	if bc == nil {
+		return fs.ValidatePiece(pieceIndex)
+	}
+
+	key := cacheKey{fs, pieceIndex}
+	bc.mutex.Lock()
+	e := bc.pieces[key]
+	if e == nil || !e.Value.(*cachedPiece).complete() {
+		if e != nil {
+			taken := bc.take(e)
+			bc.mutex.Unlock()
+			if err = bc.writeOut([]*cachedPiece{taken}); err != nil {
+				return
+			}
+			bc.mutex.Lock()
+		}
+		// Blocks evicted earlier may still be on their way to disk
+		bc.wait(key)
+		bc.mutex.Unlock()
+		return fs.ValidatePiece(pieceIndex)
+	}
+	// Nobody reads a piece we are still verifying, so it can be taken out of
+	// the cache while it is hashed and written
+	cp := bc.take(e)
+	bc.mutex.Unlock()
+
+	ok = fs.checkPiece(pieceIndex, cp.data[:fs.hashedLength(pieceIndex)])
+	// Failed pieces are written too, as the blocks that made them up are
+	// compared with their replacements to find who sent bad data
+	if err = bc.writeOut([]*cachedPiece{cp}); err != nil || !ok {
+		return
+	}
+
+	// Kept for uploading if there is room
+	bc.mutex.Lock()
+	if bc.pieces[key] == nil && bc.size+int64(len(cp.data)) <= bc.maxBytes {
+		bc.insert(cp)
+	}
+	bc.mutex.Unlock()
+	return
+}
+
+// Flush writes every block of fs not yet on disk, and forgets the pieces of fs
+// held in the cache, so that the files can be examined or changed behind its
+// back.
+func (bc *BlockCache) Flush(fs *FileStore) (err error) {
+	if bc == nil {
+		return
+	}
+	var taken []*cachedPiece
+	bc.mutex.Lock()
+	for e := bc.lru.Front(); e != nil; {
+		next := e.Next()
+		if cp := e.Value.(*cachedPiece); cp.key.fs == fs {
+			taken = append(taken, bc.take(e))
+		}
+		e = next
+	}
+	bc.mutex.Unlock()
+	err = bc.writeOut(taken)
+
+	// Including pieces evicted by others
+	bc.mutex.Lock()
+	for key := range bc.writing {
+		if key.fs == fs {
+			bc.wait(key)
+		}
+	}
+	bc.mutex.Unlock()
+	return
+}
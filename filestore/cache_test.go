@@ -0,0 +1,175 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+	"time"
+)
+
+// newCacheTestStore returns a filestore in memory of two pieces, each of two
+// cache blocks, and the data of the pieces.
+func newCacheTestStore() (fs *FileStore, mf *MemoryFile, data []byte) {
+	data = make([]byte, 4*cacheBlockSize)
+	for i := range data {
+		data[i] = byte(i / 7)
+	}
+	first, second := sha1.Sum(data[:2*cacheBlockSize]), sha1.Sum(data[2*cacheBlockSize:])
+	tfile, _ := NewMemoryStorage().OpenFile("a", int64(len(data)))
+	fs, _ = NewFileStore([]TorrentStorer{tfile}, [][]byte{first[:], second[:]}, 2*cacheBlockSize)
+	return fs, tfile.(*MemoryFile), data
+}
+
+func TestBlockCacheWrite(t *testing.T) {
+	fs, mf, data := newCacheTestStore()
+	bc := NewBlockCache(1 << 20)
+
+	for _, offset := range []int64{cacheBlockSize, 0} {
+		if err := bc.WriteBlock(fs, 1, offset, data[2*cacheBlockSize+offset:][:cacheBlockSize]); err != nil {
+			t.Fatal("Failed to write block: ", err)
+		}
+	}
+	if !bytes.Equal(mf.Bytes(), make([]byte, len(data))) {
+		t.Error("Blocks written to disk before their piece was hashed")
+	}
+
+	ok, err := bc.ValidatePiece(fs, 1)
+	if !ok || err != nil {
+		t.Fatal("Piece failed hash check: ", err)
+	}
+	if !bytes.Equal(mf.Bytes()[2*cacheBlockSize:], data[2*cacheBlockSize:]) {
+		t.Error("Hashed piece not written to disk")
+	}
+
+	// The verified piece stays cached for uploading
+	block, err := bc.ReadBlock(fs, 1, cacheBlockSize, 100)
+	if err != nil || !bytes.Equal(block, data[3*cacheBlockSize:][:100]) {
+		t.Error("Incorrect block read: ", err)
+	}
+	if hits, misses := bc.Stats(); hits != 1 || misses != 0 {
+		t.Errorf("%d hits and %d misses, expected 1 and 0", hits, misses)
+	}
+}
+
+func TestBlockCacheReadAhead(t *testing.T) {
+	fs, mf, data := newCacheTestStore()
+	mf.WriteAt(data, 0)
+	bc := NewBlockCache(1 << 20)
+
+	for _, offset := range []int64{0, cacheBlockSize, 100} {
+		block, err := bc.ReadBlock(fs, 0, offset, cacheBlockSize)
+		if err != nil || !bytes.Equal(block, data[offset:offset+cacheBlockSize]) {
+			t.Errorf("Incorrect block read at %d: %v", offset, err)
+		}
+	}
+	if hits, misses := bc.Stats(); hits != 2 || misses != 1 {
+		t.Errorf("%d hits and %d misses, expected 2 and 1", hits, misses)
+	}
+
+	// Blocks after the first are not read ahead
+	bc.ReadBlock(fs, 1, cacheBlockSize, cacheBlockSize)
+	bc.ReadBlock(fs, 1, cacheBlockSize, cacheBlockSize)
+	if _, misses := bc.Stats(); misses != 3 {
+		t.Errorf("%d misses, expected 3", misses)
+	}
+	if bc.Size() != 2*cacheBlockSize {
+		t.Errorf("Cache holds %d bytes, expected one piece", bc.Size())
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	fs, mf, data := newCacheTestStore()
+	bc := NewBlockCache(2 * cacheBlockSize)
+
+	bc.WriteBlock(fs, 0, 0, data[:cacheBlockSize])
+	bc.WriteBlock(fs, 1, 0, data[2*cacheBlockSize:][:cacheBlockSize])
+	if bc.Size() != 2*cacheBlockSize {
+		t.Errorf("Cache holds %d bytes, expected one piece", bc.Size())
+	}
+	// The evicted piece's block was written out
+	if !bytes.Equal(mf.Bytes()[:cacheBlockSize], data[:cacheBlockSize]) {
+		t.Error("Evicted block not written to disk")
+	}
+
+	if err := bc.Flush(fs); err != nil {
+		t.Fatal("Flush failed: ", err)
+	}
+	if bc.Size() != 0 || !bytes.Equal(mf.Bytes()[2*cacheBlockSize:][:cacheBlockSize], data[2*cacheBlockSize:][:cacheBlockSize]) {
+		t.Error("Flush left blocks in the cache")
+	}
+
+	// A corrupt piece is written, but not kept
+	bc.WriteBlock(fs, 0, 0, make([]byte, cacheBlockSize))
+	bc.WriteBlock(fs, 0, cacheBlockSize, data[cacheBlockSize:2*cacheBlockSize])
+	if ok, err := bc.ValidatePiece(fs, 0); ok || err != nil {
+		t.Error("Corrupt piece passed hash check: ", err)
+	}
+	if bc.Size() != 0 || !bytes.Equal(mf.Bytes()[:cacheBlockSize], make([]byte, cacheBlockSize)) {
+		t.Error("Corrupt piece not written out of the cache")
+	}
+}
+
+// blockingFile holds up every write until release is closed.
+type blockingFile struct {
+	*MemoryFile
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bf *blockingFile) WriteAt(p []byte, off int64) (int, error) {
+	select {
+	case bf.started <- struct{}{}:
+	default:
+	}
+	<-bf.release
+	return bf.MemoryFile.WriteAt(p, off)
+}
+
+func TestBlockCacheWritesOutsideLock(t *testing.T) {
+	slowFile := &blockingFile{
+		MemoryFile: &MemoryFile{data: make([]byte, 4*cacheBlockSize)},
+		started:    make(chan struct{}, 1),
+		release:    make(chan struct{}),
+	}
+	slow, _ := NewFileStore([]TorrentStorer{slowFile}, [][]byte{make([]byte, 20), make([]byte, 20)}, 2*cacheBlockSize)
+	fast, _, data := newCacheTestStore()
+	bc := NewBlockCache(2 * cacheBlockSize)
+
+	// Evicting the slow piece writes it out, which blocks
+	bc.WriteBlock(slow, 0, 0, data[:cacheBlockSize])
+	done := make(chan error)
+	go func() { done <- bc.WriteBlock(fast, 0, 0, data[:cacheBlockSize]) }()
+	<-slowFile.started
+
+	// Meanwhile the cache is not locked
+	finished := make(chan struct{})
+	go func() {
+		bc.WriteBlock(fast, 0, cacheBlockSize, data[cacheBlockSize:2*cacheBlockSize])
+		bc.ReadBlock(fast, 0, 0, 100)
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Error("Cache locked while writing an evicted piece")
+	}
+
+	// Reading the slow piece from disk waits for it to be written
+	read := make(chan []byte)
+	go func() {
+		block, _ := bc.ReadBlock(slow, 0, 0, 100)
+		read <- block
+	}()
+	select {
+	case <-read:
+		t.Error("Evicted piece read from disk before it was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(slowFile.release)
+	if err := <-done; err != nil {
+		t.Error("Failed to write evicted piece: ", err)
+	}
+	if block := <-read; !bytes.Equal(block, data[:100]) {
+		t.Error("Incorrect data read after eviction")
+	}
+}
@@ -0,0 +1,110 @@
+package filestore
+
+import (
+	"context"
+	"github.com/torrance/libtorrent/bitfield"
+	"runtime"
+	"sync"
+)
+
+// checkReadAhead is the number of pieces read ahead of the hashing workers.
+const checkReadAhead = 4
+
+// checkJob is a piece read from storage and waiting to be hashed.
+type checkJob struct {
+	index int
+	data  []byte
+	buf   []byte // The pooled buffer holding data
+	ok    bool   // Whether the read succeeded
+}
+
+// Check verifies every piece, returning a bitfield of those that match their
+// hashes. Pieces are read sequentially by a single goroutine, so that disks
+// see one stream of reads, and hashed by a worker per CPU. Pieces that cannot
+// be read, including those of missing or short files, are treated as missing
+// rather than failing the check.
+//
+// If progress is not nil it is called after each piece is hashed, from a
+// single goroutine, with the number of pieces checked so far. The check stops
+// early if ctx is cancelled, returning ctx's error.
+func (fs *FileStore) Check(ctx context.Context, progress func(checked, total int)) (bitf *bitfield.Bitfield, err error) {
+	total := len(fs.hashes)
+	workers := runtime.NumCPU()
+
+	// Buffers are reused rather than allocated for every piece
+	pool := make(chan []byte, workers+checkReadAhead)
+	for i := 0; i < cap(pool); i++ {
+		pool <- make([]byte, fs.pieceLength)
+	}
+
+	jobs := make(chan *checkJob, checkReadAhead)
+	results := make(chan *checkJob, workers)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+		for i := 0; i < total && ctx.Err() == nil; i++ {
+			var buf []byte
+			select {
+			case buf = <-pool:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+			job := &checkJob{index: i, buf: buf, data: buf[:fs.hashedLength(i)]}
+			job.ok = fs.readBlock(job.data, i, 0) == nil
+			select {
+			case jobs <- job:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job.ok = job.ok && fs.checkPiece(job.index, job.data)
+				select {
+				case results <- job:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	bitf = bitfield.NewBitfield(total)
+	for checked := 0; checked < total; checked++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var job *checkJob
+		select {
+		case job = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if job == nil {
+			// Workers only finish early when the context is cancelled
+			return nil, ctx.Err()
+		}
+		if job.ok {
+			bitf.SetTrue(job.index)
+		}
+		pool <- job.buf
+		if progress != nil {
+			progress(checked+1, total)
+		}
+	}
+	return
+}
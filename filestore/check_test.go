@@ -0,0 +1,81 @@
+package filestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"testing"
+)
+
+// brokenTorrentStorer fails every read, as a file on a failing disk would.
+type brokenTorrentStorer struct {
+	length int64
+}
+
+func (stor brokenTorrentStorer) ReadAt(b []byte, off int64) (n int, err error) {
+	return 0, errors.New("read error")
+}
+
+func (stor brokenTorrentStorer) WriteAt(b []byte, off int64) (n int, err error) {
+	return 0, errors.New("write error")
+}
+
+func (stor brokenTorrentStorer) Length() int64 {
+	return stor.length
+}
+
+func TestCheck(t *testing.T) {
+	data := make([]byte, 70)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// The final 6 bytes are unreadable and piece 5 is corrupt
+	stored := append([]byte(nil), data[:64]...)
+	stored[21] = 0xff
+	tfiles := []TorrentStorer{
+		testTorrentStorer{reader: bytes.NewReader(stored)},
+		brokenTorrentStorer{length: 6},
+	}
+
+	var hashes [][]byte
+	for i := 0; i < len(data); i += 4 {
+		end := i + 4
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[i:end])
+		hashes = append(hashes, h[:])
+	}
+	fs, err := NewFileStore(tfiles, hashes, 4)
+	if err != nil {
+		t.Fatalf("Failed to create filestore: %s", err)
+	}
+
+	calls, last := 0, 0
+	bitf, err := fs.Check(context.Background(), func(checked, total int) {
+		calls++
+		last = checked
+		if total != len(hashes) {
+			t.Errorf("Incorrect total: %d", total)
+		}
+	})
+	if err != nil {
+		t.Fatal("Check failed: ", err)
+	}
+	for i := range hashes {
+		want := i != 5 && i < 16
+		if bitf.Get(i) != want {
+			t.Errorf("Piece %d: expected %v", i, want)
+		}
+	}
+	if calls != len(hashes) || last != len(hashes) {
+		t.Errorf("Incorrect progress reports: %d calls, last %d", calls, last)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if bitf, err := fs.Check(ctx, nil); err != context.Canceled || bitf != nil {
+		t.Error("Cancelled check did not stop: ", err)
+	}
+}
@@ -0,0 +1,177 @@
+package filestore
+
+import (
+	"sync"
+)
+
+const (
+	defaultDiskWorkers = 4
+	defaultMaxDiskJobs = 256
+)
+
+// DefaultDiskQueue is shared by all torrents that are not given their own
+// queue. It has a block cache of 32 MiB.
+var DefaultDiskQueue = NewDiskQueue(defaultDiskWorkers, defaultMaxDiskJobs)
+
+func init() {
+	DefaultDiskQueue.SetCache(NewBlockCache(defaultCacheSize))
+}
+
+// DiskQueue runs disk jobs on a fixed number of workers, so that slow disks
+// hold up neither the caller nor each other's torrents. Each owner, usually a
+// FileStore, has its own queue of jobs, which run in the order they were
+// submitted; the workers take jobs from each owner in turn. Submitting blocks
+// while the queue is full.
+//
+// Jobs and their completion callbacks run on a worker, so callbacks must not
+// block on anything waiting for the queue.
+type DiskQueue struct {
+	mutex     sync.Mutex
+	ready     *sync.Cond // Signalled when a job is queued
+	space     *sync.Cond // Signalled when a job is taken, or an owner's jobs are done
+	maxQueued int
+	queued    int
+	owners    []*diskOwner // Owners with queued jobs, served in turn
+	next      int
+	pending   map[interface{}]int // Queued and running jobs of each owner
+	cache     *BlockCache
+}
+
+type diskOwner struct {
+	owner interface{}
+	jobs  []func()
+}
+
+func NewDiskQueue(workers, maxQueued int) (dq *DiskQueue) {
+	dq = &DiskQueue{
+		maxQueued: maxQueued,
+		pending:   make(map[interface{}]int),
+	}
+	dq.ready = sync.NewCond(&dq.mutex)
+	dq.space = sync.NewCond(&dq.mutex)
+	for i := 0; i < workers; i++ {
+		go dq.work()
+	}
+	return
+}
+
+// SetCache makes Read, Write and Hash go through bc. It must be called before
+// the queue is used.
+func (dq *DiskQueue) SetCache(bc *BlockCache) {
+	dq.cache = bc
+}
+
+// Cache returns the queue's block cache, or nil if it has none.
+func (dq *DiskQueue) Cache() *BlockCache {
+	return dq.cache
+}
+
+// Queued returns the number of jobs waiting for a worker.
+func (dq *DiskQueue) Queued() (n int) {
+	dq.mutex.Lock()
+	n = dq.queued
+	dq.mutex.Unlock()
+	return
+}
+
+// Submit queues job to run on behalf of owner, waiting for room if the queue
+// is full.
+func (dq *DiskQueue) Submit(owner interface{}, job func()) {
+	dq.mutex.Lock()
+	for dq.queued >= dq.maxQueued {
+		dq.space.Wait()
+	}
+	var do *diskOwner
+	for _, o := range dq.owners {
+		if o.owner == owner {
+			do = o
+			break
+		}
+	}
+	if do == nil {
+		do = &diskOwner{owner: owner}
+		dq.owners = append(dq.owners, do)
+	}
+	do.jobs = append(do.jobs, job)
+	dq.queued++
+	dq.pending[owner]++
+	dq.mutex.Unlock()
+	dq.ready.Signal()
+}
+
+// Wait blocks until every job submitted by owner has finished.
+func (dq *DiskQueue) Wait(owner interface{}) {
+	dq.mutex.Lock()
+	for dq.pending[owner] > 0 {
+		dq.space.Wait()
+	}
+	dq.mutex.Unlock()
+}
+
+// take removes the next job, from the next owner in turn. The caller must hold
+// mutex.
+func (dq *DiskQueue) take() (owner interface{}, job func()) {
+	if dq.next >= len(dq.owners) {
+		dq.next = 0
+	}
+	do := dq.owners[dq.next]
+	owner, job = do.owner, do.jobs[0]
+	do.jobs[0] = nil
+	do.jobs = do.jobs[1:]
+	if len(do.jobs) == 0 {
+		dq.owners = append(dq.owners[:dq.next], dq.owners[dq.next+1:]...)
+	} else {
+		dq.next++
+	}
+	dq.queued--
+	return
+}
+
+func (dq *DiskQueue) work() {
+	for {
+		dq.mutex.Lock()
+		for dq.queued == 0 {
+			dq.ready.Wait()
+		}
+		owner, job := dq.take()
+		dq.mutex.Unlock()
+		dq.space.Broadcast()
+
+		job()
+
+		dq.mutex.Lock()
+		if dq.pending[owner]--; dq.pending[owner] == 0 {
+			delete(dq.pending, owner)
+		}
+		dq.mutex.Unlock()
+		dq.space.Broadcast()
+	}
+}
+
+// Flush waits for every job of fs to finish, then writes out and forgets its
+// pieces in the block cache. See BlockCache.Flush.
+func (dq *DiskQueue) Flush(fs *FileStore) error {
+	dq.Wait(fs)
+	return dq.cache.Flush(fs)
+}
+
+// Read reads a block of fs on a worker, and passes it to done.
+func (dq *DiskQueue) Read(fs *FileStore, pieceIndex int, offset int64, length int64, done func(block []byte, err error)) {
+	dq.Submit(fs, func() {
+		done(dq.cache.ReadBlock(fs, pieceIndex, offset, length))
+	})
+}
+
+// Write writes a block of fs on a worker, and passes the result to done.
+func (dq *DiskQueue) Write(fs *FileStore, pieceIndex int, offset int64, block []byte, done func(err error)) {
+	dq.Submit(fs, func() {
+		done(dq.cache.WriteBlock(fs, pieceIndex, offset, block))
+	})
+}
+
+// Hash verifies a piece of fs on a worker, and passes the result to done.
+func (dq *DiskQueue) Hash(fs *FileStore, pieceIndex int, done func(ok bool, err error)) {
+	dq.Submit(fs, func() {
+		done(dq.cache.ValidatePiece(fs, pieceIndex))
+	})
+}
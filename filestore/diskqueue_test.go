@@ -0,0 +1,98 @@
+package filestore
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueFairness(t *testing.T) {
+	dq := NewDiskQueue(1, 10)
+	block, started := make(chan struct{}), make(chan struct{})
+	dq.Submit("busy", func() {
+		close(started)
+		<-block
+	})
+	<-started
+
+	var mutex sync.Mutex
+	var order []string
+	record := func(name string) func() {
+		return func() {
+			mutex.Lock()
+			order = append(order, name)
+			mutex.Unlock()
+		}
+	}
+	for i := 0; i < 3; i++ {
+		dq.Submit("busy", record("busy"))
+	}
+	dq.Submit("quiet", record("quiet"))
+	close(block)
+	dq.Wait("busy")
+	dq.Wait("quiet")
+
+	// The quiet owner's job is not stuck behind the busy owner's
+	if len(order) != 4 || order[1] != "quiet" {
+		t.Errorf("Jobs ran in order %v, expected the quiet owner's second", order)
+	}
+}
+
+func TestDiskQueueBackPressure(t *testing.T) {
+	dq := NewDiskQueue(1, 1)
+	block := make(chan struct{})
+	dq.Submit(nil, func() { <-block })
+	dq.Submit(nil, func() {})
+
+	submitted := make(chan struct{})
+	go func() {
+		dq.Submit(nil, func() {})
+		close(submitted)
+	}()
+	select {
+	case <-submitted:
+		t.Error("Submit did not wait for room in a full queue")
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(block)
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Error("Submit still waiting once the queue drained")
+	}
+	dq.Wait(nil)
+	if dq.Queued() != 0 {
+		t.Errorf("%d jobs still queued", dq.Queued())
+	}
+}
+
+func TestDiskQueueReadWrite(t *testing.T) {
+	ms := NewMemoryStorage()
+	tfile, _ := ms.OpenFile("a", 8)
+	fs, _ := NewFileStore([]TorrentStorer{tfile}, [][]byte{make([]byte, 20), make([]byte, 20)}, 4)
+	dq := NewDiskQueue(2, 10)
+
+	dq.Write(fs, 1, 0, []byte{1, 2, 3, 4}, func(err error) {
+		if err != nil {
+			t.Error("Write failed: ", err)
+		}
+	})
+	dq.Wait(fs)
+	done := make(chan []byte, 1)
+	dq.Read(fs, 1, 1, 2, func(block []byte, err error) {
+		if err != nil {
+			t.Error("Read failed: ", err)
+		}
+		done <- block
+	})
+	if block := <-done; !bytes.Equal(block, []byte{2, 3}) {
+		t.Errorf("Read %v, expected [2 3]", block)
+	}
+	dq.Hash(fs, 0, func(ok bool, err error) {
+		if ok || err != nil {
+			t.Error("Piece with a bogus hash passed: ", err)
+		}
+	})
+	dq.Wait(fs)
+}
@@ -0,0 +1,201 @@
+package filestore
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+const defaultMaxOpenFiles = 512
+
+// DefaultFilePool is shared by all storage that is not given its own pool.
+var DefaultFilePool = NewFilePool(defaultMaxOpenFiles)
+
+// FilePool limits the number of file handles held open by the files that use
+// it, so that torrents with many files do not exhaust the process's limit.
+// When the limit is reached, the least recently used handle is closed and its
+// file reopened the next time it is read or written. Handles in use are never
+// closed, so the limit may briefly be exceeded under heavy concurrency.
+type FilePool struct {
+	mutex   sync.Mutex
+	maxOpen int
+	lru     *list.List // Of *pooledFile with open handles, most recent first
+	opened  int64
+	evicted int64
+}
+
+func NewFilePool(maxOpen int) (pool *FilePool) {
+	pool = &FilePool{
+		maxOpen: maxOpen,
+		lru:     list.New(),
+	}
+	return
+}
+
+func (pool *FilePool) SetMaxOpen(n int) {
+	pool.mutex.Lock()
+	pool.maxOpen = n
+	pool.evict()
+	pool.mutex.Unlock()
+}
+
+// Open returns the number of file handles currently open.
+func (pool *FilePool) Open() (n int) {
+	pool.mutex.Lock()
+	n = pool.lru.Len()
+	pool.mutex.Unlock()
+	return
+}
+
+// Stats returns how many times files have been opened, and how many handles
+// have been closed to stay within the limit.
+func (pool *FilePool) Stats() (opened, evicted int64) {
+	pool.mutex.Lock()
+	opened, evicted = pool.opened, pool.evicted
+	pool.mutex.Unlock()
+	return
+}
+
+// evict closes idle handles, least recently used first, until the pool is
+// within its limit. The caller must hold mutex.
+func (pool *FilePool) evict() {
+	for e := pool.lru.Back(); e != nil && pool.lru.Len() > pool.maxOpen; {
+		prev := e.Prev()
+		if pf := e.Value.(*pooledFile); pf.users == 0 {
+			pf.closeLocked()
+			pool.evicted++
+		}
+		e = prev
+	}
+}
+
+// pooledFile is a file whose handle is held by a FilePool. It is opened with
+// flag whenever it is needed, and is never created: files must be created
+// before they are handed to the pool.
+type pooledFile struct {
+	pool *FilePool
+	path string
+	flag int
+	// The rest are guarded by pool.mutex
+	fd      *os.File
+	elem    *list.Element
+	users   int
+	closing bool // Close the handle once the last user releases it
+}
+
+// newPooledFile hands fd, opened with flag, to pool.
+func newPooledFile(pool *FilePool, path string, flag int, fd *os.File) (pf *pooledFile) {
+	pf = &pooledFile{pool: pool, path: path, flag: flag}
+	pool.mutex.Lock()
+	pf.fd = fd
+	pf.elem = pool.lru.PushFront(pf)
+	pool.opened++
+	pool.evict()
+	pool.mutex.Unlock()
+	return
+}
+
+// acquire returns the file's handle, opening it if necessary. It must not be
+// closed, and must be given back with release.
+func (pf *pooledFile) acquire() (fd *os.File, err error) {
+	pool := pf.pool
+	pool.mutex.Lock()
+	if pf.fd != nil {
+		pool.lru.MoveToFront(pf.elem)
+		pf.users++
+		pf.closing = false
+		fd = pf.fd
+		pool.mutex.Unlock()
+		return
+	}
+	pool.mutex.Unlock()
+
+	// Opening may be slow, so other files are not held up meanwhile
+	opened, err := os.OpenFile(pf.path, pf.flag, 0)
+	if err != nil {
+		return
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pf.fd != nil {
+		// Somebody else opened it first
+		opened.Close()
+		pool.lru.MoveToFront(pf.elem)
+	} else {
+		pf.fd = opened
+		pf.elem = pool.lru.PushFront(pf)
+		pool.opened++
+	}
+	pf.users++
+	pf.closing = false
+	fd = pf.fd
+	pool.evict()
+	return
+}
+
+func (pf *pooledFile) release() {
+	pf.pool.mutex.Lock()
+	pf.users--
+	if pf.closing && pf.users == 0 {
+		pf.closeLocked()
+	}
+	pf.pool.evict()
+	pf.pool.mutex.Unlock()
+}
+
+func (pf *pooledFile) ReadAt(p []byte, off int64) (n int, err error) {
+	fd, err := pf.acquire()
+	if err != nil {
+		return
+	}
+	defer pf.release()
+	return fd.ReadAt(p, off)
+}
+
+func (pf *pooledFile) WriteAt(p []byte, off int64) (n int, err error) {
+	fd, err := pf.acquire()
+	if err != nil {
+		return
+	}
+	defer pf.release()
+	return fd.WriteAt(p, off)
+}
+
+func (pf *pooledFile) Stat() (stat os.FileInfo, err error) {
+	fd, err := pf.acquire()
+	if err != nil {
+		return
+	}
+	defer pf.release()
+	return fd.Stat()
+}
+
+func (pf *pooledFile) Chmod(mode os.FileMode) error {
+	return os.Chmod(pf.path, mode)
+}
+
+// Close closes the file's handle, or once nobody is using it if it is in
+// use. The file is reopened if it is used again.
+func (pf *pooledFile) Close() (err error) {
+	pf.pool.mutex.Lock()
+	defer pf.pool.mutex.Unlock()
+	if pf.users > 0 {
+		pf.closing = true
+		return
+	}
+	return pf.closeLocked()
+}
+
+// closeLocked closes the file's handle. The caller must hold pool.mutex.
+func (pf *pooledFile) closeLocked() (err error) {
+	pf.closing = false
+	if pf.fd == nil {
+		return
+	}
+	err = pf.fd.Close()
+	pf.fd = nil
+	pf.pool.lru.Remove(pf.elem)
+	pf.elem = nil
+	return
+}
@@ -0,0 +1,84 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilePool(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pool := NewFilePool(2)
+	ds := &DiskStorage{RootDirectory: tmpDir, Pool: pool}
+	var tfiles []TorrentStorer
+	for i := 0; i < 5; i++ {
+		tfile, _ := ds.OpenFile(string('a'+rune(i)), 4)
+		if _, err = tfile.WriteAt([]byte{byte(i), 1, 2, 3}, 0); err != nil {
+			t.Fatal("Failed to write file: ", err)
+		}
+		tfiles = append(tfiles, tfile)
+	}
+	if pool.Open() != 2 {
+		t.Errorf("%d files open, expected 2", pool.Open())
+	}
+
+	// Evicted files are reopened when read
+	buf := make([]byte, 1)
+	for i, tfile := range tfiles {
+		if _, err = tfile.ReadAt(buf, 0); err != nil || buf[0] != byte(i) {
+			t.Errorf("Read %d (%v) from file %d after eviction", buf[0], err, i)
+		}
+	}
+	if opened, evicted := pool.Stats(); opened != 10 || evicted != 8 {
+		t.Errorf("Opened %d and evicted %d, expected 10 and 8", opened, evicted)
+	}
+
+	// The most recently used files stay open
+	tfiles[4].ReadAt(buf, 0)
+	if opened, _ := pool.Stats(); opened != 10 {
+		t.Error("Recently used file was reopened")
+	}
+
+	fs, _ := NewFileStore(tfiles, nil, 4)
+	if err = fs.Close(); err != nil {
+		t.Error("Failed to close filestore: ", err)
+	}
+	if pool.Open() != 0 {
+		t.Errorf("%d files open after close", pool.Open())
+	}
+}
+
+func TestFilePoolInUse(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pool := NewFilePool(1)
+	a, _ := newTorrentFile(pool, AllocateSparse, tmpDir, "a", 4)
+	fd, err := a.file.acquire()
+	if err != nil {
+		t.Fatal("Failed to acquire file: ", err)
+	}
+
+	// A file in use is neither evicted nor closed until it is released
+	b, _ := newTorrentFile(pool, AllocateSparse, tmpDir, filepath.Join("dir", "b"), 4)
+	a.Close()
+	if _, err = fd.Stat(); err != nil {
+		t.Error("File in use was closed: ", err)
+	}
+	if pool.Open() != 1 || b.file.fd != nil {
+		t.Errorf("%d files open, expected only the one in use", pool.Open())
+	}
+	a.file.release()
+	if pool.Open() != 0 {
+		t.Error("Closed file left open after release")
+	}
+}
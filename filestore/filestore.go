@@ -2,13 +2,17 @@ package filestore
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"errors"
 	"fmt"
 	"github.com/torrance/libtorrent/bitfield"
+	"github.com/torrance/libtorrent/merkle"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 )
 
 type FileStore struct {
@@ -32,43 +36,159 @@ func NewFileStore(tfiles []TorrentStorer, hashes [][]byte, pieceLength int64) (f
 	return
 }
 
+// Close closes every file that holds a handle or mapping. Files of every
+// storage backend are reopened if the filestore is used again.
+func (fs *FileStore) Close() (err error) {
+	for _, tfile := range fs.tfiles {
+		if closer, ok := tfile.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return
+}
+
+// Validate checks every piece, returning a bitfield of those that match their
+// hashes. See Check.
 func (fs *FileStore) Validate() (bitf *bitfield.Bitfield, err error) {
-	bitf = bitfield.NewBitfield(len(fs.hashes))
+	return fs.Check(context.Background(), nil)
+}
 
-	for i, _ := range fs.hashes {
-		var ok bool
-		ok, err = fs.validatePiece(i)
-		if err != nil {
+// ValidatePiece reports whether the data stored for piece index matches its hash.
+// Pieces of v2 torrents have 32 byte merkle hashes rather than 20 byte SHA1 hashes.
+func (fs *FileStore) ValidatePiece(index int) (ok bool, err error) {
+	if len(fs.hashes[index]) == merkle.HashSize {
+		return fs.validatePieceV2(index)
+	}
+
+	block, err := fs.GetBlock(index, 0, fs.getPieceLength(index))
+	if err != nil {
+		return
+	}
+	ok = fs.checkPiece(index, block)
+	return
+}
+
+func (fs *FileStore) validatePieceV2(index int) (ok bool, err error) {
+	block, err := fs.GetBlock(index, 0, fs.hashedLength(index))
+	if err != nil {
+		return
+	}
+	ok = fs.checkPiece(index, block)
+	return
+}
+
+// checkPiece reports whether data, the first hashedLength bytes of piece
+// index, matches the piece's hash.
+func (fs *FileStore) checkPiece(index int, data []byte) bool {
+	if len(fs.hashes[index]) == merkle.HashSize {
+		leaves := merkle.Leaves(data)
+		return bytes.Equal(merkle.Root(leaves, 0, fs.leafWidth(index, len(leaves))), fs.hashes[index])
+	}
+	h := sha1.Sum(data)
+	return bytes.Equal(h[:], fs.hashes[index])
+}
+
+// hashedLength returns the number of bytes at the start of piece index that
+// are covered by its hash. A v2 piece lies within a single file, followed by
+// padding which is not hashed, while a v1 piece's hash covers all of it.
+func (fs *FileStore) hashedLength(index int) int64 {
+	dataLength, _ := fs.pieceFile(index)
+	return dataLength
+}
+
+// pieceFile returns the length of a v2 piece's data and of the file it lies in.
+func (fs *FileStore) pieceFile(index int) (dataLength, fileLength int64) {
+	start := int64(index) * fs.pieceLength
+	end := start + fs.getPieceLength(index)
+	if len(fs.hashes[index]) != merkle.HashSize {
+		return end - start, 0
+	}
+
+	var offset int64
+	for _, tfile := range fs.tfiles {
+		if _, pad := tfile.(*PadFile); !pad && tfile.Length() > 0 && offset+tfile.Length() > start {
+			if offset+tfile.Length() < end {
+				end = offset + tfile.Length()
+			}
+			dataLength = end - start
+			fileLength = tfile.Length()
 			return
-		} else if ok {
-			bitf.SetTrue(i)
 		}
+		offset += tfile.Length()
 	}
 	return
 }
 
-func (fs *FileStore) validatePiece(index int) (ok bool, err error) {
-	block, err := fs.GetBlock(index, 0, fs.getPieceLength(index))
+// leafWidth returns the number of leaves a v2 piece's hash covers, given the
+// number of leaves of data. The hash of a piece from a file larger than a
+// piece covers a whole piece of leaves, while a smaller file's hash is its
+// pieces root.
+func (fs *FileStore) leafWidth(index int, leaves int) int {
+	if _, fileLength := fs.pieceFile(index); fileLength <= fs.pieceLength {
+		return merkle.NextPowerOfTwo(leaves)
+	}
+	return int(fs.pieceLength / merkle.BlockSize)
+}
+
+// pieceLeaves returns the merkle leaf hashes of the data stored for a v2
+// piece, along with the number of leaves the piece's hash covers.
+func (fs *FileStore) pieceLeaves(index int) (leaves [][]byte, width int, err error) {
+	data, err := fs.GetBlock(index, 0, fs.hashedLength(index))
 	if err != nil {
 		return
 	}
+	leaves = merkle.Leaves(data)
+	width = fs.leafWidth(index, len(leaves))
+	return
+}
 
-	h := sha1.New()
-	h.Write(block)
-	if bytes.Equal(h.Sum(nil), fs.hashes[index]) {
-		ok = true
+// ValidateBlocks checks the stored blocks of a v2 piece against known good
+// leaf hashes, such as those received in a hashes message. The leaf hashes are
+// first checked against the piece's hash. It returns the indices of the
+// blocks that do not match.
+func (fs *FileStore) ValidateBlocks(index int, goodLeaves [][]byte) (bad []int, err error) {
+	if len(fs.hashes[index]) != merkle.HashSize {
+		err = errors.New("Block validation requires a v2 piece")
+		return
+	}
+	leaves, width, err := fs.pieceLeaves(index)
+	if err != nil {
+		return
+	}
+	if len(goodLeaves) != len(leaves) || !bytes.Equal(merkle.Root(goodLeaves, 0, width), fs.hashes[index]) {
+		err = errors.New(fmt.Sprintf("Leaf hashes do not match the hash of piece %d", index))
+		return
+	}
+	for i := range leaves {
+		if !bytes.Equal(leaves[i], goodLeaves[i]) {
+			bad = append(bad, i)
+		}
 	}
 	return
 }
 
 func (fs *FileStore) getPieceLength(index int) int64 {
-	if index == len(fs.hashes)-1 {
+	if index == len(fs.hashes)-1 && fs.totalLength%fs.pieceLength != 0 {
 		return fs.totalLength % fs.pieceLength
 	} else {
 		return fs.pieceLength
 	}
 }
 
+func (fs *FileStore) PieceLength(index int) int64 {
+	return fs.getPieceLength(index)
+}
+
+func (fs *FileStore) PieceCount() int {
+	return len(fs.hashes)
+}
+
+func (fs *FileStore) TotalLength() int64 {
+	return fs.totalLength
+}
+
 func (fs *FileStore) GetBlock(pieceIndex int, offset int64, length int64) (block []byte, err error) {
 	if length+offset > fs.getPieceLength(pieceIndex) {
 		err = errors.New("Requested block overran piece length")
@@ -76,8 +196,14 @@ func (fs *FileStore) GetBlock(pieceIndex int, offset int64, length int64) (block
 	}
 
 	block = make([]byte, length)
-	segment := block
+	err = fs.readBlock(block, pieceIndex, offset)
+	return
+}
 
+// readBlock fills block with the data at offset within piece pieceIndex,
+// spanning files as required.
+func (fs *FileStore) readBlock(block []byte, pieceIndex int, offset int64) (err error) {
+	segment := block
 	offset = int64(pieceIndex)*fs.pieceLength + offset
 
 	for _, tfile := range fs.tfiles {
@@ -104,74 +230,119 @@ func (fs *FileStore) GetBlock(pieceIndex int, offset int64, length int64) (block
 	return
 }
 
+// WriteBlock writes block at offset within piece pieceIndex, spanning files as required.
+func (fs *FileStore) WriteBlock(pieceIndex int, offset int64, block []byte) (err error) {
+	if int64(len(block))+offset > fs.getPieceLength(pieceIndex) {
+		err = errors.New("Block overran piece length")
+		return
+	}
+
+	offset = int64(pieceIndex)*fs.pieceLength + offset
+
+	for _, tfile := range fs.tfiles {
+		if len(block) == 0 {
+			break
+		}
+		if offset >= tfile.Length() {
+			offset -= tfile.Length()
+			continue
+		}
+
+		segment := block
+		if int64(len(segment)) > tfile.Length()-offset {
+			segment = segment[:tfile.Length()-offset]
+		}
+		if _, err = tfile.WriteAt(segment, offset); err != nil {
+			return
+		}
+		block = block[len(segment):]
+		offset = 0
+	}
+
+	return
+}
+
 type TorrentStorer interface {
 	io.ReaderAt
+	io.WriterAt
 	Length() int64
 }
 
+// TorrentFile is a file on disk. Its handle is held by a FilePool, and
+// reopened as needed.
 type TorrentFile struct {
 	lth  int64
 	path string
-	fd   *os.File
+	file *pooledFile
 }
 
+// NewTorrentFile creates or opens the file at path within rootDirectory,
+// extending it to length, with its handle in DefaultFilePool.
 func NewTorrentFile(rootDirectory string, path string, length int64) (tfile *TorrentFile, err error) {
-	if len(path) == 0 {
-		err = errors.New("Path must have at least 1 component.")
-		return
-	}
+	return newTorrentFile(DefaultFilePool, AllocateSparse, rootDirectory, path, length)
+}
 
-	// Root directory must already exist
-	rootDirectoryFileInfo, err := os.Stat(rootDirectory)
+func newTorrentFile(pool *FilePool, mode AllocationMode, rootDirectory string, path string, length int64) (tfile *TorrentFile, err error) {
+	absPath, err := prepareRootPath(rootDirectory, path)
 	if err != nil {
 		return
 	}
-	if !rootDirectoryFileInfo.IsDir() {
-		err = errors.New(rootDirectory + " is not a directory")
-		return
-	}
-
-	absPath := filepath.Join(rootDirectory, path)
-
-	// Create any required parent directories
-	dirs := filepath.Dir(absPath)
-	if err = os.MkdirAll(dirs, 0755); err != nil {
-		return
-	}
 
 	// Create or open file
 	fd, err := os.OpenFile(absPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
 
 	// Stat for size of file
 	stat, err := fd.Stat()
 	if err != nil {
+		fd.Close()
 		return
 	}
 	if length-stat.Size() < 0 {
+		fd.Close()
 		err = errors.New("File already exists and is larger than expected size. Aborting.")
 		return
 	}
 
 	// Now pad the file from the end until it matches required size
-	err = fd.Truncate(length)
+	err = allocate(fd, mode, stat.Size(), length)
 	if err != nil {
+		fd.Close()
 		return
 	}
 
 	tfile = &TorrentFile{
 		path: path,
 		lth:  length,
-		fd:   fd,
+		file: newPooledFile(pool, absPath, os.O_RDWR, fd),
 	}
 
 	return
 }
 
+// SetExecutable sets the file's executable bits, for files with the BEP 47 x
+// attribute.
+func (tf *TorrentFile) SetExecutable() error {
+	return tf.file.Chmod(0755)
+}
+
 func (tf *TorrentFile) ReadAt(p []byte, off int64) (n int, err error) {
-	n, err = tf.fd.ReadAt(p, off)
+	n, err = tf.file.ReadAt(p, off)
 	return
 }
 
+func (tf *TorrentFile) WriteAt(p []byte, off int64) (n int, err error) {
+	n, err = tf.file.WriteAt(p, off)
+	return
+}
+
+// Close closes the file's handle. The file is reopened if it is used again.
+func (tf *TorrentFile) Close() error {
+	return tf.file.Close()
+}
+
 func (tf *TorrentFile) Length() int64 {
 	return tf.lth
 }
@@ -179,3 +350,285 @@ func (tf *TorrentFile) Length() int64 {
 func (tf *TorrentFile) String() string {
 	return fmt.Sprintf("[File: %s Length: %dbytes]", tf.path, tf.lth)
 }
+
+// prepareRootPath returns the absolute path of path within rootDirectory,
+// creating any required parent directories.
+func prepareRootPath(rootDirectory string, path string) (absPath string, err error) {
+	if len(path) == 0 {
+		err = errors.New("Path must have at least 1 component.")
+		return
+	}
+
+	// Paths come from torrent files and should already have been validated, but
+	// we refuse to create anything outside of the root directory regardless.
+	cleanPath := filepath.Clean(path)
+	if filepath.IsAbs(cleanPath) || cleanPath == ".." || strings.HasPrefix(cleanPath, ".."+string(filepath.Separator)) {
+		err = errors.New(fmt.Sprintf("Path %s is outside of the root directory", path))
+		return
+	}
+
+	// Root directory must already exist
+	rootDirectoryFileInfo, err := os.Stat(rootDirectory)
+	if err != nil {
+		return
+	}
+	if !rootDirectoryFileInfo.IsDir() {
+		err = errors.New(rootDirectory + " is not a directory")
+		return
+	}
+
+	absPath = filepath.Join(rootDirectory, path)
+
+	// Create any required parent directories
+	dirs := filepath.Dir(absPath)
+	err = os.MkdirAll(dirs, 0755)
+	return
+}
+
+// NewSymlink creates a symlink at path pointing to target, both relative to
+// the root directory. Symlinks hold no data so they are not TorrentStorers. An
+// existing symlink is replaced, but any other existing file is an error.
+func NewSymlink(rootDirectory string, path string, target string) (err error) {
+	absPath, err := prepareRootPath(rootDirectory, path)
+	if err != nil {
+		return
+	}
+	absTarget, err := prepareRootPath(rootDirectory, target)
+	if err != nil {
+		return
+	}
+
+	// Links are relative so that the download directory can be moved
+	relTarget, err := filepath.Rel(filepath.Dir(absPath), absTarget)
+	if err != nil {
+		return
+	}
+
+	if stat, statErr := os.Lstat(absPath); statErr == nil {
+		if stat.Mode()&os.ModeSymlink == 0 {
+			return errors.New(fmt.Sprintf("%s already exists and is not a symlink", path))
+		}
+		if err = os.Remove(absPath); err != nil {
+			return
+		}
+	}
+	return os.Symlink(relTarget, absPath)
+}
+
+// LazyFile is a TorrentFile that is not created on disk until it is written
+// to or Create is called, so that files nobody wants are never created. A file
+// that already exists is opened when first read. Until then it reads as zeros,
+// or it may be kept in a part file instead.
+type LazyFile struct {
+	rootDirectory string
+	path          string
+	lth           int64
+	pool          *FilePool
+	allocation    AllocationMode
+	executable    bool
+	mutex         sync.Mutex
+	tfile         *TorrentFile
+	part          *PartFile
+	partOffset    int64 // Offset of the file within the torrent
+}
+
+func NewLazyFile(rootDirectory string, path string, length int64) *LazyFile {
+	return &LazyFile{rootDirectory: rootDirectory, path: path, lth: length, pool: DefaultFilePool}
+}
+
+// Create creates the file if it does not yet exist.
+func (lf *LazyFile) Create() error {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	return lf.create()
+}
+
+// create creates the file, moving any data out of the part file. The caller
+// must hold mutex.
+func (lf *LazyFile) create() (err error) {
+	if lf.tfile != nil {
+		return
+	}
+	tfile, err := newTorrentFile(lf.pool, lf.allocation, lf.rootDirectory, lf.path, lf.lth)
+	if err != nil {
+		return
+	}
+	if lf.executable {
+		if err = tfile.SetExecutable(); err != nil {
+			return
+		}
+	}
+	if lf.part != nil {
+		buf := make([]byte, 32768)
+		for off := int64(0); off < lf.lth; off += int64(len(buf)) {
+			chunk := buf
+			if int64(len(chunk)) > lf.lth-off {
+				chunk = chunk[:lf.lth-off]
+			}
+			if _, err = lf.part.ReadAt(chunk, lf.partOffset+off); err != nil {
+				return
+			}
+			if _, err = tfile.WriteAt(chunk, off); err != nil {
+				return
+			}
+		}
+		lf.part = nil
+	}
+	lf.tfile = tfile
+	return
+}
+
+// exists reports whether the file is already on disk. The caller must hold
+// mutex.
+func (lf *LazyFile) exists() bool {
+	if lf.tfile != nil {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(lf.rootDirectory, lf.path))
+	return err == nil
+}
+
+// SetPartFile keeps the file's data in pf, at offset within the torrent,
+// until it is created. Files already on disk stay where they are.
+func (lf *LazyFile) SetPartFile(pf *PartFile, offset int64) {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	if !lf.exists() {
+		lf.part = pf
+		lf.partOffset = offset
+	}
+}
+
+// InPartFile reports whether the file's data is being kept in a part file.
+func (lf *LazyFile) InPartFile() bool {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	return lf.part != nil
+}
+
+// Created reports whether the file has been created or opened.
+func (lf *LazyFile) Created() bool {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	return lf.tfile != nil
+}
+
+// SetExecutable sets the file's executable bits now if it exists, or once it
+// is created.
+func (lf *LazyFile) SetExecutable() error {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	lf.executable = true
+	if lf.tfile != nil {
+		return lf.tfile.SetExecutable()
+	}
+	return nil
+}
+
+func (lf *LazyFile) ReadAt(p []byte, off int64) (n int, err error) {
+	lf.mutex.Lock()
+	if lf.tfile == nil && lf.exists() {
+		err = lf.create()
+	}
+	tfile := lf.tfile
+	if err != nil || tfile != nil {
+		lf.mutex.Unlock()
+		if err != nil {
+			return
+		}
+		return tfile.ReadAt(p, off)
+	}
+	// Hold the lock so that the file is not moved out of the part file
+	// underneath us
+	defer lf.mutex.Unlock()
+
+	if off >= lf.lth {
+		return 0, io.EOF
+	}
+	n = len(p)
+	if int64(n) > lf.lth-off {
+		n = int(lf.lth - off)
+		err = io.EOF
+	}
+	if lf.part != nil {
+		if _, partErr := lf.part.ReadAt(p[:n], lf.partOffset+off); partErr != nil {
+			return 0, partErr
+		}
+		return
+	}
+	for i := 0; i < n; i++ {
+		p[i] = 0
+	}
+	return
+}
+
+func (lf *LazyFile) WriteAt(p []byte, off int64) (n int, err error) {
+	lf.mutex.Lock()
+	if lf.part != nil {
+		defer lf.mutex.Unlock()
+		if off+int64(len(p)) > lf.lth {
+			return 0, errors.New(fmt.Sprintf("Write beyond the end of %s", lf.path))
+		}
+		return lf.part.WriteAt(p, lf.partOffset+off)
+	}
+	err = lf.create()
+	tfile := lf.tfile
+	lf.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	return tfile.WriteAt(p, off)
+}
+
+func (lf *LazyFile) Length() int64 {
+	return lf.lth
+}
+
+// Close closes the file's handle, if it has been opened.
+func (lf *LazyFile) Close() error {
+	lf.mutex.Lock()
+	tfile := lf.tfile
+	lf.mutex.Unlock()
+	if tfile == nil {
+		return nil
+	}
+	return tfile.Close()
+}
+
+// Stat describes the file on disk, if it exists.
+func (lf *LazyFile) Stat() (os.FileInfo, error) {
+	return os.Stat(filepath.Join(lf.rootDirectory, lf.path))
+}
+
+// PadFile stands in for padding that aligns files to piece boundaries. It is
+// never stored: it reads as zeros and discards anything written to it.
+type PadFile struct {
+	lth int64
+}
+
+func NewPadFile(length int64) *PadFile {
+	return &PadFile{lth: length}
+}
+
+func (pf *PadFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= pf.lth {
+		return 0, io.EOF
+	}
+	n = len(p)
+	if int64(n) > pf.lth-off {
+		n = int(pf.lth - off)
+		err = io.EOF
+	}
+	for i := 0; i < n; i++ {
+		p[i] = 0
+	}
+	return
+}
+
+func (pf *PadFile) WriteAt(p []byte, off int64) (n int, err error) {
+	return len(p), nil
+}
+
+func (pf *PadFile) Length() int64 {
+	return pf.lth
+}
@@ -2,94 +2,103 @@ package filestore
 
 import (
 	"bytes"
+	"errors"
+	"github.com/torrance/libtorrent/merkle"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
 )
 
 func TestGetBlockWithSingleFile(t *testing.T) {
+	forEachStorage(t, [][]byte{{1, 2, 3, 4}}, func(t *testing.T, tfiles []TorrentStorer) {
+		hashes := [][]byte{[]byte{1}, []byte{2}}
+		fs, err := NewFileStore(tfiles, hashes, 3)
+		if err != nil {
+			t.Fatalf("Failed to create filestore: %s", err)
+		}
 
-	file1 := testTorrentStorer{
-		reader: bytes.NewReader([]byte{1, 2, 3, 4}),
-	}
-	hashes := [][]byte{[]byte{1}, []byte{2}}
-	fs, err := NewFileStore([]TorrentStorer{file1}, hashes, 3)
-	if err != nil {
-		t.Fatalf("Failed to create filestore: %s", err)
-	}
-
-	block, err := fs.GetBlock(0, 1, 2)
-	if err != nil {
-		t.Fatalf("Failed to get block [1]: %s", err)
-	}
+		block, err := fs.GetBlock(0, 1, 2)
+		if err != nil {
+			t.Fatalf("Failed to get block [1]: %s", err)
+		}
 
-	if !bytes.Equal(block, []byte{2, 3}) {
-		t.Errorf("Block contained incorrect values, got [1]: %x", block)
-	}
+		if !bytes.Equal(block, []byte{2, 3}) {
+			t.Errorf("Block contained incorrect values, got [1]: %x", block)
+		}
 
-	pieceLength := fs.getPieceLength(1)
-	t.Logf("Piece length: %d", pieceLength)
-	if block, err = fs.GetBlock(1, 0, pieceLength); err != nil {
-		t.Fatalf("Failed to get block [2]: %s", err)
-	}
+		pieceLength := fs.getPieceLength(1)
+		t.Logf("Piece length: %d", pieceLength)
+		if block, err = fs.GetBlock(1, 0, pieceLength); err != nil {
+			t.Fatalf("Failed to get block [2]: %s", err)
+		}
 
-	if !bytes.Equal(block, []byte{4}) {
-		t.Errorf("Block contained incorrect values, got [1]: %x", block)
-	}
+		if !bytes.Equal(block, []byte{4}) {
+			t.Errorf("Block contained incorrect values, got [1]: %x", block)
+		}
+	})
 }
 
 func TestGetBlockWithMultipleFiles(t *testing.T) {
-	file1 := testTorrentStorer{
-		reader: bytes.NewReader([]byte{1, 2, 3, 4}),
-	}
-	file2 := testTorrentStorer{
-		reader: bytes.NewReader([]byte{5, 6, 7}),
-	}
-	file3 := testTorrentStorer{
-		reader: bytes.NewReader([]byte{8, 9, 10, 11, 12, 13}),
-	}
+	contents := [][]byte{{1, 2, 3, 4}, {5, 6, 7}, {8, 9, 10, 11, 12, 13}}
+	forEachStorage(t, contents, func(t *testing.T, tfiles []TorrentStorer) {
+		b := []byte{1}
+		hashes := [][]byte{b, b, b, b, b}
+		fs, err := NewFileStore(tfiles, hashes, 3)
+		if err != nil {
+			t.Fatalf("Failed to create filestore: %s", err)
+		}
 
-	b := []byte{1}
-	hashes := [][]byte{b, b, b, b, b}
-	fs, err := NewFileStore([]TorrentStorer{file1, file2, file3}, hashes, 3)
-	if err != nil {
-		t.Fatalf("Failed to create filestore: %s", err)
-	}
+		// Test 1: only select from first file
+		block, err := fs.GetBlock(0, 1, 2)
+		if err != nil {
+			t.Fatalf("Failed to get block [1]: %s", err)
+		}
+		if !bytes.Equal(block, []byte{2, 3}) {
+			t.Errorf("Block contained incorrect values, got [1]: %x", block)
+		}
 
-	// Test 1: only select from first file
-	block, err := fs.GetBlock(0, 1, 2)
-	if err != nil {
-		t.Fatalf("Failed to get block [1]: %s", err)
-	}
-	if !bytes.Equal(block, []byte{2, 3}) {
-		t.Errorf("Block contained incorrect values, got [1]: %x", block)
-	}
+		// Test 2: select from second file only
+		if block, err = fs.GetBlock(1, 1, 2); err != nil {
+			t.Fatalf("Failed to get block [2]: %s", err)
+		}
+		if !bytes.Equal(block, []byte{5, 6}) {
+			t.Errorf("Block contained incorrect values, got [2]: %x", block)
+		}
 
-	// Test 2: select from second file only
-	if block, err = fs.GetBlock(1, 1, 2); err != nil {
-		t.Fatalf("Failed to get block [2]: %s", err)
-	}
-	if !bytes.Equal(block, []byte{5, 6}) {
-		t.Errorf("Block contained incorrect values, got [2]: %x", block)
-	}
+		// Test 3: select from piece bridging two files
+		if block, err = fs.GetBlock(2, 0, 3); err != nil {
+			t.Fatalf("Failed to get block [3]: %s", err)
+		}
+		if !bytes.Equal(block, []byte{7, 8, 9}) {
+			t.Errorf("Block contained incorrect values, got [3]: %x", block)
+		}
 
-	// Test 3: select from piece bridging two files
-	if block, err = fs.GetBlock(2, 0, 3); err != nil {
-		t.Fatalf("Failed to get block [3]: %s", err)
-	}
-	if !bytes.Equal(block, []byte{7, 8, 9}) {
-		t.Errorf("Block contained incorrect values, got [3]: %x", block)
-	}
+		// Test 4: select last piece
+		if block, err = fs.GetBlock(4, 0, fs.getPieceLength(4)); err != nil {
+			t.Fatalf("Failed to get block [4]: %s", err)
+		}
+		if !bytes.Equal(block, []byte{13}) {
+			t.Errorf("Block contained incorrect values, got [4]: %x", block)
+		}
 
-	// Test 4: select last piece
-	if block, err = fs.GetBlock(4, 0, fs.getPieceLength(4)); err != nil {
-		t.Fatalf("Failed to get block [4]: %s", err)
-	}
-	if !bytes.Equal(block, []byte{13}) {
-		t.Errorf("Block contained incorrect values, got [4]: %x", block)
-	}
+		// Test 5: a block written across files reads back
+		if err = fs.WriteBlock(2, 0, []byte{20, 21, 22}); err != nil {
+			t.Fatalf("Failed to write block: %s", err)
+		}
+		if block, err = fs.GetBlock(2, 0, 3); err != nil || !bytes.Equal(block, []byte{20, 21, 22}) {
+			t.Errorf("Block contained incorrect values after write, got: %x %v", block, err)
+		}
+		// Neighbouring pieces are untouched
+		if block, err = fs.GetBlock(1, 0, 3); err != nil || !bytes.Equal(block, []byte{4, 5, 6}) {
+			t.Errorf("Previous piece changed by write, got: %x %v", block, err)
+		}
+		if block, err = fs.GetBlock(3, 0, 3); err != nil || !bytes.Equal(block, []byte{10, 11, 12}) {
+			t.Errorf("Next piece changed by write, got: %x %v", block, err)
+		}
+	})
 }
 
 type testTorrentStorer struct {
@@ -100,6 +109,11 @@ func (stor testTorrentStorer) ReadAt(b []byte, off int64) (n int, err error) {
 	return stor.reader.ReadAt(b, off)
 }
 
+func (stor testTorrentStorer) WriteAt(b []byte, off int64) (n int, err error) {
+	err = errors.New("testTorrentStorer is read only")
+	return
+}
+
 func (stor testTorrentStorer) Length() int64 {
 	return int64(stor.reader.Len())
 }
@@ -131,6 +145,125 @@ func TestNewTFile(t *testing.T) {
 	}
 }
 
+func TestNewTFileOutsideRoot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	root := filepath.Join(tmpDir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{
+		filepath.Join("..", "escaped.txt"),
+		filepath.Join("dir", "..", "..", "escaped.txt"),
+		filepath.Join(tmpDir, "escaped.txt"),
+	} {
+		if _, err := NewTorrentFile(root, path, 10); err == nil {
+			t.Error("Expected error creating file outside root: ", path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Error("File was created outside of root directory")
+	}
+}
+
+func TestNewSymlink(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if _, err := NewTorrentFile(tmpDir, filepath.Join("dir", "target.txt"), 10); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join("dir", "links", "link.txt")
+	for i := 0; i < 2; i++ {
+		// Creating the link twice replaces it
+		if err := NewSymlink(tmpDir, link, filepath.Join("dir", "target.txt")); err != nil {
+			t.Fatal("Failed to create symlink: ", err)
+		}
+	}
+	target, err := os.Readlink(filepath.Join(tmpDir, link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != filepath.Join("..", "target.txt") {
+		t.Error("Incorrect symlink target: ", target)
+	}
+
+	if err := NewSymlink(tmpDir, filepath.Join("dir", "target.txt"), link); err == nil {
+		t.Error("Expected error replacing a regular file with a symlink")
+	}
+	if err := NewSymlink(tmpDir, "escape", filepath.Join("..", "outside")); err == nil {
+		t.Error("Expected error for a symlink target outside the root directory")
+	}
+}
+
+func TestSetExecutable(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tfile, err := NewTorrentFile(tmpDir, "run.sh", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tfile.SetExecutable(); err != nil {
+		t.Fatal("Failed to set executable: ", err)
+	}
+	stat, err := os.Stat(filepath.Join(tmpDir, "run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode()&0111 == 0 {
+		t.Error("File is not executable: ", stat.Mode())
+	}
+}
+
+func TestLazyFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "dir", "lazy.txt")
+	lf := NewLazyFile(tmpDir, filepath.Join("dir", "lazy.txt"), 10)
+	lf.SetExecutable()
+
+	// Reading a file that does not exist gives zeros without creating it
+	b := []byte{1, 2, 3}
+	if n, err := lf.ReadAt(b, 8); n != 2 || err != io.EOF || b[0] != 0 || b[1] != 0 {
+		t.Error("Incorrect read before creation: ", n, err, b)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) || lf.Created() {
+		t.Fatal("Lazy file was created by reading")
+	}
+
+	if _, err := lf.WriteAt([]byte("abc"), 2); err != nil {
+		t.Fatal("Failed to write: ", err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil || stat.Size() != 10 || stat.Mode()&0111 == 0 {
+		t.Fatal("Lazy file not created on write: ", err)
+	}
+	if n, err := lf.ReadAt(b, 2); n != 3 || err != nil || string(b) != "abc" {
+		t.Error("Incorrect read after creation: ", n, err, b)
+	}
+
+	// An existing file is opened by reading it
+	lf = NewLazyFile(tmpDir, filepath.Join("dir", "lazy.txt"), 10)
+	if n, err := lf.ReadAt(b, 2); n != 3 || err != nil || string(b) != "abc" || !lf.Created() {
+		t.Error("Existing file not opened: ", n, err, b)
+	}
+}
+
 func TestGetBlockWithRealFile(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
 	if err != nil {
@@ -206,7 +339,7 @@ func TestFileStoreWithMultipleFiles(t *testing.T) {
 	if err != nil {
 		t.Fatal("Failed to created file1: ", err)
 	} else {
-		if fi, err := file1.fd.Stat(); err != nil {
+		if fi, err := file1.file.Stat(); err != nil {
 			t.Fatal("Failed to stat file 1: ", err)
 		} else if fi.Size() != 24893 {
 			t.Fatal("File 1 size incorrect, got: ", fi.Size())
@@ -217,7 +350,7 @@ func TestFileStoreWithMultipleFiles(t *testing.T) {
 	if err != nil {
 		t.Fatal("Failed to created file2: ", err)
 	} else {
-		if fi, err := file2.fd.Stat(); err != nil {
+		if fi, err := file2.file.Stat(); err != nil {
 			t.Fatal("Failed to stat file 2: ", err)
 		} else if fi.Size() != 34113 {
 			t.Fatal("File 2 size incorrect, got: ", fi.Size())
@@ -246,7 +379,7 @@ func TestFileStoreWithMultipleFiles(t *testing.T) {
 	if err != nil {
 		t.Fatal("Failed to created file3: ", err)
 	} else {
-		if fi, err := file3.fd.Stat(); err != nil {
+		if fi, err := file3.file.Stat(); err != nil {
 			t.Fatal("Failed to stat file 3: ", err)
 		} else if fi.Size() != 36880 {
 			t.Fatal("File 3 size incorrect, got: ", fi.Size())
@@ -277,3 +410,95 @@ func TestFileStoreWithMultipleFiles(t *testing.T) {
 		t.Errorf("Incorrect bitfield, got: %x", bitf.Bytes())
 	}
 }
+
+func TestWriteBlockAcrossFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file1, err := NewTorrentFile(tmpDir, "file1", 4)
+	if err != nil {
+		t.Fatal("Failed to create file1: ", err)
+	}
+	file2, err := NewTorrentFile(tmpDir, "file2", 3)
+	if err != nil {
+		t.Fatal("Failed to create file2: ", err)
+	}
+
+	b := []byte{1}
+	fs, err := NewFileStore([]TorrentStorer{file1, file2}, [][]byte{b, b, b}, 3)
+	if err != nil {
+		t.Fatal("Failed to create filestore: ", err)
+	}
+
+	// Piece 1 spans the end of file1 and the start of file2
+	if err = fs.WriteBlock(1, 0, []byte{4, 5, 6}); err != nil {
+		t.Fatal("Failed to write block: ", err)
+	}
+	if err = fs.WriteBlock(2, 0, []byte{7}); err != nil {
+		t.Fatal("Failed to write final block: ", err)
+	}
+	if err = fs.WriteBlock(2, 0, []byte{7, 8}); err == nil {
+		t.Error("Expected error writing beyond final piece")
+	}
+
+	data1, _ := ioutil.ReadFile(filepath.Join(tmpDir, "file1"))
+	data2, _ := ioutil.ReadFile(filepath.Join(tmpDir, "file2"))
+	if !bytes.Equal(data1, []byte{0, 0, 0, 4}) || !bytes.Equal(data2, []byte{5, 6, 7}) {
+		t.Errorf("Incorrect file contents, got: %x %x", data1, data2)
+	}
+}
+
+func TestValidatePieceV2(t *testing.T) {
+	const pieceLength = 2 * merkle.BlockSize
+	small := make([]byte, 1000)
+	large := make([]byte, 2*pieceLength+100)
+	rand.New(rand.NewSource(1)).Read(small)
+	rand.New(rand.NewSource(2)).Read(large)
+
+	// The small file is one piece whose hash is its pieces root. The large file
+	// starts on the next piece boundary and has a piece layer.
+	largeLeaves := merkle.Leaves(large)
+	hashes := append([][]byte{merkle.FileRoot(merkle.Leaves(small))}, merkle.PieceLayer(largeLeaves, 2)...)
+	tfiles := []TorrentStorer{
+		testTorrentStorer{reader: bytes.NewReader(small)},
+		NewPadFile(pieceLength - 1000),
+		testTorrentStorer{reader: bytes.NewReader(large)},
+	}
+	fs, err := NewFileStore(tfiles, hashes, pieceLength)
+	if err != nil {
+		t.Fatal("Failed to create filestore: ", err)
+	}
+
+	bitf, err := fs.Validate()
+	if err != nil {
+		t.Fatal("Failed to validate: ", err)
+	}
+	if bitf.SumTrue() != 4 {
+		t.Error("Expected all 4 pieces to be valid, got ", bitf.SumTrue())
+	}
+
+	// Padding reads as zeros
+	block, err := fs.GetBlock(0, 1000, 10)
+	if err != nil || !bytes.Equal(block, make([]byte, 10)) {
+		t.Error("Padding did not read as zeros: ", block, err)
+	}
+
+	// Corrupt one block of a piece and find it with known good leaf hashes
+	large[pieceLength+merkle.BlockSize+5] ^= 0xff
+	if ok, _ := fs.ValidatePiece(2); ok {
+		t.Error("Corrupt piece passed validation")
+	}
+	bad, err := fs.ValidateBlocks(2, largeLeaves[2:4])
+	if err != nil {
+		t.Fatal("Failed to validate blocks: ", err)
+	}
+	if len(bad) != 1 || bad[0] != 1 {
+		t.Error("Expected block 1 to be bad, got ", bad)
+	}
+	if _, err := fs.ValidateBlocks(2, largeLeaves[0:2]); err == nil {
+		t.Error("Expected error for leaf hashes that do not match the piece")
+	}
+}
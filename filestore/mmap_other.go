@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package filestore
+
+import (
+	"errors"
+)
+
+// MmapStorage is not supported on this platform, and fails to open any file.
+type MmapStorage struct {
+	RootDirectory string
+	Pool          *FilePool
+}
+
+func (ms *MmapStorage) OpenFile(path string, length int64) (TorrentStorer, error) {
+	return nil, errors.New("Memory mapped storage is not supported on this platform")
+}
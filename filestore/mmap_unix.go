@@ -0,0 +1,154 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package filestore
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// MmapStorage stores each file at its path within RootDirectory, like
+// DiskStorage, but reads and writes through a shared memory mapping of the
+// whole file rather than system calls. Files are created when opened.
+type MmapStorage struct {
+	RootDirectory string
+	Pool          *FilePool // Holds the files' handles. If nil, DefaultFilePool is used.
+}
+
+func (ms *MmapStorage) OpenFile(path string, length int64) (TorrentStorer, error) {
+	pool := ms.Pool
+	if pool == nil {
+		pool = DefaultFilePool
+	}
+	return newMmapFile(pool, ms.RootDirectory, path, length)
+}
+
+// MmapFile is a file accessed through a memory mapping. Modification times
+// are not kept up to date by writes to a mapping, so it has no Stat method and
+// torrents using it are always rechecked.
+//
+// The file's handle is only needed while the file is being mapped, so it is
+// held by a FilePool and may be closed at any time. The mapping is made when
+// the file is first read or written, and again after Close.
+type MmapFile struct {
+	path  string
+	lth   int64
+	file  *pooledFile
+	mutex sync.RWMutex
+	data  []byte // Guarded by mutex. nil until mapped.
+}
+
+func NewMmapFile(rootDirectory string, path string, length int64) (mf *MmapFile, err error) {
+	return newMmapFile(DefaultFilePool, rootDirectory, path, length)
+}
+
+func newMmapFile(pool *FilePool, rootDirectory string, path string, length int64) (mf *MmapFile, err error) {
+	absPath, err := prepareRootPath(rootDirectory, path)
+	if err != nil {
+		return
+	}
+	fd, err := os.OpenFile(absPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return
+	}
+	if stat.Size() > length {
+		fd.Close()
+		err = errors.New("File already exists and is larger than expected size. Aborting.")
+		return
+	}
+	if err = fd.Truncate(length); err != nil {
+		fd.Close()
+		return
+	}
+
+	mf = &MmapFile{path: path, lth: length, file: newPooledFile(pool, absPath, os.O_RDWR, fd)}
+	return
+}
+
+// mapped returns the file's mapping, mapping it if necessary, with mutex read
+// locked. The caller must unlock it.
+func (mf *MmapFile) mapped() (data []byte, err error) {
+	mf.mutex.RLock()
+	if mf.data != nil || mf.lth == 0 {
+		return mf.data, nil
+	}
+	mf.mutex.RUnlock()
+
+	mf.mutex.Lock()
+	if mf.data == nil {
+		fd, err := mf.file.acquire()
+		if err != nil {
+			mf.mutex.Unlock()
+			return nil, err
+		}
+		mf.data, err = syscall.Mmap(int(fd.Fd()), 0, int(mf.lth), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		mf.file.release()
+		if err != nil {
+			mf.data = nil
+			mf.mutex.Unlock()
+			return nil, err
+		}
+	}
+	mf.mutex.Unlock()
+	// Close may have unmapped it again meanwhile
+	return mf.mapped()
+}
+
+func (mf *MmapFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= mf.lth {
+		return 0, io.EOF
+	}
+	data, err := mf.mapped()
+	if err != nil {
+		return
+	}
+	defer mf.mutex.RUnlock()
+	n = copy(p, data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (mf *MmapFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off+int64(len(p)) > mf.lth {
+		return 0, errors.New("Write beyond the end of " + mf.path)
+	}
+	if len(p) == 0 {
+		return
+	}
+	data, err := mf.mapped()
+	if err != nil {
+		return
+	}
+	defer mf.mutex.RUnlock()
+	return copy(data[off:], p), nil
+}
+
+func (mf *MmapFile) Length() int64 {
+	return mf.lth
+}
+
+// Close unmaps the file and closes its handle. The file is mapped again if it
+// is used again.
+func (mf *MmapFile) Close() (err error) {
+	mf.mutex.Lock()
+	if mf.data != nil {
+		err = syscall.Munmap(mf.data)
+		mf.data = nil
+	}
+	mf.mutex.Unlock()
+	if closeErr := mf.file.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
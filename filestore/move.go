@@ -0,0 +1,137 @@
+package filestore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// moveFile moves the file at src to dst, replacing any file already there.
+// Files are renamed where possible, and otherwise, such as between
+// filesystems, copied and then removed. progress is called with the number of
+// bytes moved as the move goes on.
+func moveFile(src string, dst string, progress func(n int64)) (err error) {
+	if err = os.Rename(src, dst); err == nil {
+		if stat, statErr := os.Stat(dst); statErr == nil {
+			progress(stat.Size())
+		}
+		return
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return
+	}
+	buf := make([]byte, 1<<20)
+	for {
+		n, readErr := in.Read(buf)
+		if n > 0 {
+			if _, err = out.Write(buf[:n]); err != nil {
+				break
+			}
+			progress(int64(n))
+		}
+		if readErr == io.EOF {
+			break
+		} else if readErr != nil {
+			err = readErr
+			break
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return
+	}
+	// Mode may have been narrowed by the umask
+	if err = os.Chmod(dst, stat.Mode().Perm()); err != nil {
+		return
+	}
+	return os.Remove(src)
+}
+
+// Move moves the file, if it is on disk, to the same path within
+// rootDirectory, where it is found from then on. Any file already there is
+// replaced. The file is reopened when next used.
+func (lf *LazyFile) Move(rootDirectory string, progress func(n int64)) (err error) {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+
+	if lf.tfile != nil {
+		if err = lf.tfile.Close(); err != nil {
+			return
+		}
+	}
+	src := filepath.Join(lf.rootDirectory, lf.path)
+	dst, err := prepareRootPath(rootDirectory, lf.path)
+	if err != nil {
+		return
+	}
+	if _, statErr := os.Stat(src); statErr == nil {
+		if err = moveFile(src, dst, progress); err != nil {
+			return
+		}
+	}
+	lf.rootDirectory = rootDirectory
+	lf.tfile = nil
+	return
+}
+
+// Relocate makes the file be found at the same path within rootDirectory from
+// then on, without moving it, such as to use a copy already there. The file is
+// reopened when next used.
+func (lf *LazyFile) Relocate(rootDirectory string) (err error) {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+
+	if lf.tfile != nil {
+		if err = lf.tfile.Close(); err != nil {
+			return
+		}
+	}
+	lf.rootDirectory = rootDirectory
+	lf.tfile = nil
+	return
+}
+
+// Path returns where the file is, or will be, on disk.
+func (lf *LazyFile) Path() string {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	return filepath.Join(lf.rootDirectory, lf.path)
+}
+
+// Move moves the part file, if it exists, to path.
+func (pf *PartFile) Move(path string, progress func(n int64)) (err error) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	if pf.fd == nil {
+		pf.path = path
+		return
+	}
+	if err = pf.fd.Close(); err != nil {
+		return
+	}
+	pf.fd = nil
+	moveErr := moveFile(pf.path, path, progress)
+	if moveErr == nil {
+		pf.path = path
+	}
+	// Reopen wherever it now is
+	if pf.fd, err = os.OpenFile(pf.path, os.O_RDWR, 0644); moveErr != nil {
+		err = moveErr
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLazyFileMove(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	from, to := filepath.Join(tmpDir, "from"), filepath.Join(tmpDir, "to")
+	os.Mkdir(from, 0755)
+	os.Mkdir(to, 0755)
+
+	lf := NewLazyFile(from, filepath.Join("dir", "a"), 4)
+	if _, err = lf.WriteAt([]byte("abcd"), 0); err != nil {
+		t.Fatal("Failed to write file: ", err)
+	}
+	var moved int64
+	if err = lf.Move(to, func(n int64) { moved += n }); err != nil {
+		t.Fatal("Failed to move file: ", err)
+	}
+	if moved != 4 || lf.Path() != filepath.Join(to, "dir", "a") {
+		t.Errorf("Moved %d bytes to %s", moved, lf.Path())
+	}
+	buf := make([]byte, 4)
+	if _, err = lf.ReadAt(buf, 0); err != nil || string(buf) != "abcd" {
+		t.Errorf("Read %q (%v) after move", buf, err)
+	}
+
+	// Relocating uses the file already there, and leaves ours alone
+	ioutil.WriteFile(filepath.Join(from, "dir", "a"), []byte("wxyz"), 0644)
+	if err = lf.Relocate(from); err != nil {
+		t.Fatal("Failed to relocate file: ", err)
+	}
+	if _, err = os.Stat(filepath.Join(to, "dir", "a")); err != nil {
+		t.Error("Our copy was removed: ", err)
+	}
+	if _, err = lf.ReadAt(buf, 0); err != nil || string(buf) != "wxyz" {
+		t.Errorf("Read %q (%v), expected the existing file", buf, err)
+	}
+}
+
+func TestMoveFileCopy(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	src := filepath.Join(tmpDir, "src")
+	ioutil.WriteFile(src, make([]byte, 3<<20), 0755)
+
+	// Renaming into a missing directory fails, so the copy is attempted
+	// and fails too, leaving the source alone
+	if err = moveFile(src, filepath.Join(tmpDir, "missing", "dst"), func(int64) {}); err == nil {
+		t.Error("Move into a missing directory succeeded")
+	}
+	if _, err = os.Stat(src); err != nil {
+		t.Error("Source removed by a failed move: ", err)
+	}
+}
+
+func TestPartFileMove(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pf, _ := NewPartFile(filepath.Join(tmpDir, "a.parts"), 4, 2)
+	pf.WriteAt([]byte("ab"), 5)
+	if err = pf.Move(filepath.Join(tmpDir, "b.parts"), func(int64) {}); err != nil {
+		t.Fatal("Failed to move part file: ", err)
+	}
+	buf := make([]byte, 2)
+	if _, err = pf.ReadAt(buf, 5); err != nil || string(buf) != "ab" {
+		t.Errorf("Read %q (%v) after move", buf, err)
+	}
+	if _, err = os.Stat(filepath.Join(tmpDir, "b.parts")); err != nil {
+		t.Error("Part file not moved: ", err)
+	}
+}
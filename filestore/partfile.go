@@ -0,0 +1,195 @@
+package filestore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// PartFile stores the bytes of skipped files that share pieces with wanted
+// files, so that those pieces can be hash checked and uploaded without the
+// skipped files appearing on disk.
+//
+// The part file is divided into slots of one piece each, allocated as pieces
+// are first written. It starts with a header of one big endian uint32 per
+// piece, holding the piece's slot plus one, or zero if it has no slot. The
+// file is not created until something is written to it, and is removed once
+// every slot has been freed.
+type PartFile struct {
+	path        string
+	pieceLength int64
+	pieceCount  int
+	mutex       sync.Mutex
+	fd          *os.File
+	slots       map[int]int // Piece index to slot
+	used        map[int]bool
+}
+
+// NewPartFile opens the part file at path if it already exists, otherwise it
+// is created once it is first written to.
+func NewPartFile(path string, pieceLength int64, pieceCount int) (pf *PartFile, err error) {
+	pf = &PartFile{
+		path:        path,
+		pieceLength: pieceLength,
+		pieceCount:  pieceCount,
+		slots:       make(map[int]int),
+		used:        make(map[int]bool),
+	}
+
+	fd, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return pf, nil
+	} else if err != nil {
+		return
+	}
+
+	header := make([]byte, pf.headerLength())
+	if _, err = io.ReadFull(fd, header); err != nil {
+		fd.Close()
+		err = errors.New(fmt.Sprintf("Part file %s has a corrupt header: %s", path, err))
+		return
+	}
+	for i := 0; i < pieceCount; i++ {
+		if slot := int(binary.BigEndian.Uint32(header[i*4:])); slot > 0 {
+			pf.slots[i] = slot - 1
+			pf.used[slot-1] = true
+		}
+	}
+	pf.fd = fd
+	return
+}
+
+func (pf *PartFile) headerLength() int64 {
+	return int64(pf.pieceCount) * 4
+}
+
+func (pf *PartFile) slotOffset(slot int) int64 {
+	return pf.headerLength() + int64(slot)*pf.pieceLength
+}
+
+// Stat describes the part file on disk, if it exists.
+func (pf *PartFile) Stat() (os.FileInfo, error) {
+	return os.Stat(pf.path)
+}
+
+// Pieces returns the pieces that have data stored in the part file.
+func (pf *PartFile) Pieces() (pieces []int) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+	for index := range pf.slots {
+		pieces = append(pieces, index)
+	}
+	return
+}
+
+// ReadAt reads the torrent's bytes at off. Pieces without a slot read as zeros.
+func (pf *PartFile) ReadAt(p []byte, off int64) (n int, err error) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	for n < len(p) {
+		index := int((off + int64(n)) / pf.pieceLength)
+		pieceOffset := (off + int64(n)) % pf.pieceLength
+		chunk := p[n:]
+		if int64(len(chunk)) > pf.pieceLength-pieceOffset {
+			chunk = chunk[:pf.pieceLength-pieceOffset]
+		}
+
+		if slot, ok := pf.slots[index]; ok {
+			if _, err = pf.fd.ReadAt(chunk, pf.slotOffset(slot)+pieceOffset); err != nil && err != io.EOF {
+				return
+			}
+			// The end of the final slot may never have been written
+			err = nil
+		} else {
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		}
+		n += len(chunk)
+	}
+	return
+}
+
+// WriteAt writes the torrent's bytes at off, allocating slots as required.
+func (pf *PartFile) WriteAt(p []byte, off int64) (n int, err error) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	if pf.fd == nil {
+		if pf.fd, err = os.OpenFile(pf.path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+			return
+		}
+		if err = pf.fd.Truncate(pf.headerLength()); err != nil {
+			return
+		}
+	}
+
+	for n < len(p) {
+		index := int((off + int64(n)) / pf.pieceLength)
+		pieceOffset := (off + int64(n)) % pf.pieceLength
+		chunk := p[n:]
+		if int64(len(chunk)) > pf.pieceLength-pieceOffset {
+			chunk = chunk[:pf.pieceLength-pieceOffset]
+		}
+
+		slot, ok := pf.slots[index]
+		if !ok {
+			if slot, err = pf.allocate(index); err != nil {
+				return
+			}
+		}
+		if _, err = pf.fd.WriteAt(chunk, pf.slotOffset(slot)+pieceOffset); err != nil {
+			return
+		}
+		n += len(chunk)
+	}
+	return
+}
+
+// allocate gives piece index the lowest free slot. The caller must hold mutex.
+func (pf *PartFile) allocate(index int) (slot int, err error) {
+	for pf.used[slot] {
+		slot++
+	}
+	if err = pf.writeHeader(index, slot+1); err != nil {
+		return
+	}
+	pf.slots[index] = slot
+	pf.used[slot] = true
+	return
+}
+
+func (pf *PartFile) writeHeader(index int, value int) (err error) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(value))
+	_, err = pf.fd.WriteAt(b, int64(index)*4)
+	return
+}
+
+// Free releases the slot of piece index, once no skipped file needs its data.
+// The part file is removed when its last slot is freed.
+func (pf *PartFile) Free(index int) (err error) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	slot, ok := pf.slots[index]
+	if !ok {
+		return
+	}
+	if err = pf.writeHeader(index, 0); err != nil {
+		return
+	}
+	delete(pf.slots, index)
+	delete(pf.used, slot)
+
+	if len(pf.slots) == 0 {
+		pf.fd.Close()
+		pf.fd = nil
+		return os.Remove(pf.path)
+	}
+	return
+}
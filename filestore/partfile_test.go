@@ -0,0 +1,111 @@
+package filestore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, ".parts")
+	pf, err := NewPartFile(path, 10, 4)
+	if err != nil {
+		t.Fatal("Failed to create part file: ", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Part file created before being written to")
+	}
+
+	// A write straddling pieces 2 and 3
+	if _, err := pf.WriteAt([]byte("abcdef"), 27); err != nil {
+		t.Fatal("Failed to write: ", err)
+	}
+	b := make([]byte, 8)
+	if n, err := pf.ReadAt(b, 26); n != 8 || err != nil || !bytes.Equal(b, []byte("\x00abcdef\x00")) {
+		t.Errorf("Incorrect read: %d %v %q", n, err, b)
+	}
+	// Only pieces 2 and 3 have slots
+	stat, _ := os.Stat(path)
+	if stat.Size() > 16+2*10 {
+		t.Error("Part file larger than two slots: ", stat.Size())
+	}
+
+	// Slots survive reopening
+	pf, err = NewPartFile(path, 10, 4)
+	if err != nil {
+		t.Fatal("Failed to reopen part file: ", err)
+	}
+	if pieces := pf.Pieces(); len(pieces) != 2 {
+		t.Errorf("Incorrect pieces after reopening: %v", pieces)
+	}
+	if n, err := pf.ReadAt(b, 26); n != 8 || err != nil || !bytes.Equal(b, []byte("\x00abcdef\x00")) {
+		t.Errorf("Incorrect read after reopening: %d %v %q", n, err, b)
+	}
+
+	// The file is removed with its last slot
+	pf.Free(2)
+	if n, _ := pf.ReadAt(b, 26); n != 8 || !bytes.Equal(b, []byte("\x00\x00\x00\x00def\x00")) {
+		t.Errorf("Freed piece still readable: %q", b)
+	}
+	pf.Free(3)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Part file not removed once empty")
+	}
+}
+
+func TestLazyFilePartFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pf, err := NewPartFile(filepath.Join(tmpDir, ".parts"), 10, 4)
+	if err != nil {
+		t.Fatal("Failed to create part file: ", err)
+	}
+	path := filepath.Join(tmpDir, "skipped.txt")
+	lf := NewLazyFile(tmpDir, "skipped.txt", 6)
+	lf.SetPartFile(pf, 15)
+
+	// Data goes to the part file rather than the file
+	if _, err := lf.WriteAt([]byte("abc"), 3); err != nil {
+		t.Fatal("Failed to write: ", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Skipped file was created")
+	}
+	b := make([]byte, 3)
+	if n, err := lf.ReadAt(b, 3); n != 3 || err != nil || string(b) != "abc" {
+		t.Errorf("Incorrect read from part file: %d %v %q", n, err, b)
+	}
+	if _, err := lf.WriteAt([]byte("abcd"), 3); err == nil {
+		t.Error("Write beyond the end of the file accepted")
+	}
+
+	// Creating the file moves its data out
+	if err := lf.Create(); err != nil {
+		t.Fatal("Failed to create file: ", err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "\x00\x00\x00abc" {
+		t.Errorf("Data not moved out of part file: %q %v", data, err)
+	}
+	if lf.InPartFile() {
+		t.Error("Created file still in part file")
+	}
+
+	// Files already on disk are not moved into the part file
+	lf = NewLazyFile(tmpDir, "skipped.txt", 6)
+	lf.SetPartFile(pf, 15)
+	if lf.InPartFile() {
+		t.Error("Existing file moved into part file")
+	}
+}
@@ -0,0 +1,106 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var ErrReadOnly = errors.New("Storage is read only")
+
+// ReadOnlyStorage opens existing files under RootDirectory read only, for
+// seeding from read only mounts and shared archives. Nothing is ever created,
+// truncated or written. Files that are missing or of the wrong size fail to
+// open.
+type ReadOnlyStorage struct {
+	RootDirectory string
+	Pool          *FilePool // Holds the files' handles. If nil, DefaultFilePool is used.
+}
+
+func (rs *ReadOnlyStorage) OpenFile(path string, length int64) (TorrentStorer, error) {
+	pool := rs.Pool
+	if pool == nil {
+		pool = DefaultFilePool
+	}
+	return newReadOnlyFile(pool, rs.RootDirectory, path, length)
+}
+
+type ReadOnlyFile struct {
+	path string
+	lth  int64
+	file *pooledFile
+}
+
+func NewReadOnlyFile(rootDirectory string, path string, length int64) (rf *ReadOnlyFile, err error) {
+	return newReadOnlyFile(DefaultFilePool, rootDirectory, path, length)
+}
+
+func newReadOnlyFile(pool *FilePool, rootDirectory string, path string, length int64) (rf *ReadOnlyFile, err error) {
+	absPath := filepath.Join(rootDirectory, path)
+	fd, err := os.Open(absPath)
+	if err != nil {
+		return
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return
+	}
+	if stat.Size() != length {
+		fd.Close()
+		err = errors.New(fmt.Sprintf("%s is %d bytes, expected %d", path, stat.Size(), length))
+		return
+	}
+	rf = &ReadOnlyFile{path: path, lth: length, file: newPooledFile(pool, absPath, os.O_RDONLY, fd)}
+	return
+}
+
+func (rf *ReadOnlyFile) ReadAt(p []byte, off int64) (n int, err error) {
+	return rf.file.ReadAt(p, off)
+}
+
+func (rf *ReadOnlyFile) WriteAt(p []byte, off int64) (n int, err error) {
+	return 0, ErrReadOnly
+}
+
+func (rf *ReadOnlyFile) Length() int64 {
+	return rf.lth
+}
+
+func (rf *ReadOnlyFile) Stat() (os.FileInfo, error) {
+	return rf.file.Stat()
+}
+
+// Close closes the file's handle. The file is reopened if it is used again.
+func (rf *ReadOnlyFile) Close() error {
+	return rf.file.Close()
+}
+
+// UnavailableFile stands in for a file that could not be opened. Reads fail
+// with the error that prevented it from being opened, so its pieces are never
+// verified or uploaded.
+type UnavailableFile struct {
+	lth int64
+	err error
+}
+
+func NewUnavailableFile(length int64, err error) *UnavailableFile {
+	return &UnavailableFile{lth: length, err: err}
+}
+
+func (uf *UnavailableFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= uf.lth {
+		return 0, io.EOF
+	}
+	return 0, uf.err
+}
+
+func (uf *UnavailableFile) WriteAt(p []byte, off int64) (n int, err error) {
+	return 0, uf.err
+}
+
+func (uf *UnavailableFile) Length() int64 {
+	return uf.lth
+}
@@ -0,0 +1,63 @@
+package filestore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnlyStorage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err = ioutil.WriteFile(filepath.Join(tmpDir, "a"), []byte("abcd"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := &ReadOnlyStorage{RootDirectory: tmpDir}
+	if _, err = rs.OpenFile("missing", 4); err == nil {
+		t.Error("Missing file opened")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "missing")); !os.IsNotExist(err) {
+		t.Error("Missing file was created")
+	}
+	if _, err = rs.OpenFile("a", 5); err == nil {
+		t.Error("Short file opened")
+	}
+	if _, err = rs.OpenFile("a", 3); err == nil {
+		t.Error("Long file opened")
+	}
+
+	tfile, err := rs.OpenFile("a", 4)
+	if err != nil {
+		t.Fatal("Failed to open file: ", err)
+	}
+	buf := make([]byte, 2)
+	if _, err = tfile.ReadAt(buf, 1); err != nil || string(buf) != "bc" {
+		t.Errorf("Read %q (%v), expected \"bc\"", buf, err)
+	}
+	if _, err = tfile.WriteAt([]byte("x"), 0); err != ErrReadOnly {
+		t.Error("Write to read only file did not fail: ", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "a")); string(data) != "abcd" {
+		t.Error("Read only file modified")
+	}
+}
+
+func TestUnavailableFile(t *testing.T) {
+	missing := errors.New("missing")
+	uf := NewUnavailableFile(4, missing)
+	if _, err := uf.ReadAt(make([]byte, 2), 0); err != missing {
+		t.Error("Read of unavailable file did not fail: ", err)
+	}
+	if _, err := uf.WriteAt([]byte("x"), 0); err != missing {
+		t.Error("Write to unavailable file did not fail: ", err)
+	}
+	if uf.Length() != 4 {
+		t.Error("Incorrect length: ", uf.Length())
+	}
+}
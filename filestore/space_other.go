@@ -0,0 +1,25 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package filestore
+
+import (
+	"errors"
+	"os"
+)
+
+// FreeSpace is not supported on this platform.
+func FreeSpace(path string) (free int64, err error) {
+	return 0, errors.New("Free space cannot be checked on this platform")
+}
+
+// SameFilesystem is not supported on this platform.
+func SameFilesystem(a, b string) (same bool, err error) {
+	return false, errors.New("Filesystems cannot be compared on this platform")
+}
+
+// AllocatedSize cannot see holes in sparse files on this platform, so it
+// returns the size of the file described by info.
+func AllocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
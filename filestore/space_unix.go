@@ -0,0 +1,43 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package filestore
+
+import (
+	"os"
+	"syscall"
+)
+
+// FreeSpace returns the number of bytes available to us on the filesystem
+// holding path.
+func FreeSpace(path string) (free int64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return
+	}
+	free = int64(st.Bavail) * int64(st.Bsize)
+	return
+}
+
+// SameFilesystem reports whether paths a and b are on the same filesystem, so
+// that files can be renamed from one to the other.
+func SameFilesystem(a, b string) (same bool, err error) {
+	var sta, stb syscall.Stat_t
+	if err = syscall.Stat(a, &sta); err != nil {
+		return
+	}
+	if err = syscall.Stat(b, &stb); err != nil {
+		return
+	}
+	same = sta.Dev == stb.Dev
+	return
+}
+
+// AllocatedSize returns the bytes of disk actually used by the file described
+// by info, which for a sparse file may be far less than its size.
+func AllocatedSize(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return info.Size()
+}
@@ -0,0 +1,194 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Storage holds the data of a torrent's files. OpenFile is called once for
+// each file, in the order the files appear in the torrent, with the file's
+// path relative to the download directory. Padding and symlinks are never
+// stored.
+//
+// TorrentStorers that also have a Stat method, like those of the disk
+// backend, allow resume data to be trusted. Otherwise torrents are rechecked
+// each time they are created.
+type Storage interface {
+	OpenFile(path string, length int64) (TorrentStorer, error)
+}
+
+// DiskStorage stores each file at its path within RootDirectory. Files are
+// LazyFiles, so they are only created once wanted.
+type DiskStorage struct {
+	RootDirectory string
+	Pool          *FilePool // Holds the files' handles. If nil, DefaultFilePool is used.
+	Allocation    AllocationMode
+}
+
+func (ds *DiskStorage) OpenFile(path string, length int64) (TorrentStorer, error) {
+	lf := NewLazyFile(ds.RootDirectory, path, length)
+	lf.allocation = ds.Allocation
+	if ds.Pool != nil {
+		lf.pool = ds.Pool
+	}
+	return lf, nil
+}
+
+// MemoryStorage keeps files in memory, for tests and ephemeral caches. A file
+// opened twice with the same path and length shares its data.
+type MemoryStorage struct {
+	mutex sync.Mutex
+	files map[string]*MemoryFile
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]*MemoryFile)}
+}
+
+func (ms *MemoryStorage) OpenFile(path string, length int64) (TorrentStorer, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if mf, ok := ms.files[path]; ok && mf.Length() == length {
+		return mf, nil
+	}
+	mf := &MemoryFile{data: make([]byte, length)}
+	ms.files[path] = mf
+	return mf, nil
+}
+
+type MemoryFile struct {
+	mutex sync.RWMutex
+	data  []byte
+}
+
+func (mf *MemoryFile) ReadAt(p []byte, off int64) (n int, err error) {
+	mf.mutex.RLock()
+	defer mf.mutex.RUnlock()
+	if off >= int64(len(mf.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, mf.data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (mf *MemoryFile) WriteAt(p []byte, off int64) (n int, err error) {
+	mf.mutex.Lock()
+	defer mf.mutex.Unlock()
+	if off < 0 || off+int64(len(p)) > int64(len(mf.data)) {
+		return 0, errors.New("Write beyond the end of memory file")
+	}
+	return copy(mf.data[off:], p), nil
+}
+
+func (mf *MemoryFile) Length() int64 {
+	return int64(len(mf.data))
+}
+
+// Bytes returns a copy of the file's data.
+func (mf *MemoryFile) Bytes() []byte {
+	mf.mutex.RLock()
+	defer mf.mutex.RUnlock()
+	return append([]byte(nil), mf.data...)
+}
+
+// BlobStorage stores every file end to end in the single file at Path, in the
+// order they are opened, so that a torrent occupies one object in the
+// caller's storage layer. The blob is created when the first file is opened.
+// Its handle is held by Pool, or DefaultFilePool if that is nil.
+type BlobStorage struct {
+	Pool     *FilePool
+	path     string
+	mutex    sync.Mutex
+	file     *pooledFile
+	size     int64
+	sections map[string]*blobFile
+}
+
+func NewBlobStorage(path string) *BlobStorage {
+	return &BlobStorage{path: path, sections: make(map[string]*blobFile)}
+}
+
+func (bs *BlobStorage) OpenFile(path string, length int64) (TorrentStorer, error) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	if bf, ok := bs.sections[path]; ok && bf.length == length {
+		return bf, nil
+	}
+
+	if bs.file == nil {
+		fd, err := os.OpenFile(bs.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		pool := bs.Pool
+		if pool == nil {
+			pool = DefaultFilePool
+		}
+		bs.file = newPooledFile(pool, bs.path, os.O_RDWR, fd)
+	}
+	bf := &blobFile{blob: bs, offset: bs.size, length: length}
+	bs.size += length
+
+	stat, err := bs.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < bs.size {
+		if err = os.Truncate(bs.path, bs.size); err != nil {
+			return nil, err
+		}
+	}
+	bs.sections[path] = bf
+	return bf, nil
+}
+
+// blobFile is one file's section of a blob.
+type blobFile struct {
+	blob   *BlobStorage
+	offset int64
+	length int64
+}
+
+func (bf *blobFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= bf.length {
+		return 0, io.EOF
+	}
+	short := false
+	if int64(len(p)) > bf.length-off {
+		p = p[:bf.length-off]
+		short = true
+	}
+	n, err = bf.blob.file.ReadAt(p, bf.offset+off)
+	if err == nil && short {
+		err = io.EOF
+	}
+	return
+}
+
+func (bf *blobFile) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 || off+int64(len(p)) > bf.length {
+		return 0, errors.New(fmt.Sprintf("Write beyond the end of blob section at %d", bf.offset))
+	}
+	return bf.blob.file.WriteAt(p, bf.offset+off)
+}
+
+func (bf *blobFile) Length() int64 {
+	return bf.length
+}
+
+// Stat describes the whole blob, which changes whenever any file does.
+func (bf *blobFile) Stat() (os.FileInfo, error) {
+	return bf.blob.file.Stat()
+}
+
+// Close closes the blob's handle, which every section shares. It is reopened
+// if any section is used again.
+func (bf *blobFile) Close() error {
+	return bf.blob.file.Close()
+}
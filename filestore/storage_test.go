@@ -0,0 +1,153 @@
+package filestore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// forEachStorage runs test against every storage backend, with files holding
+// contents.
+func forEachStorage(t *testing.T, contents [][]byte, test func(t *testing.T, tfiles []TorrentStorer)) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	storages := map[string]Storage{
+		"disk":   &DiskStorage{RootDirectory: filepath.Join(tmpDir, "disk")},
+		"memory": NewMemoryStorage(),
+		"blob":   NewBlobStorage(filepath.Join(tmpDir, "blob")),
+		"mmap":   &MmapStorage{RootDirectory: filepath.Join(tmpDir, "mmap")},
+	}
+	os.Mkdir(filepath.Join(tmpDir, "disk"), 0755)
+	os.Mkdir(filepath.Join(tmpDir, "mmap"), 0755)
+
+	for name, storage := range storages {
+		name, storage := name, storage
+		t.Run(name, func(t *testing.T) {
+			var tfiles []TorrentStorer
+			for i, data := range contents {
+				tfile, err := storage.OpenFile(filepath.Join("dir", string('a'+rune(i))), int64(len(data)))
+				if err != nil && name == "mmap" {
+					t.Skip("Memory mapped storage unsupported: ", err)
+				} else if err != nil {
+					t.Fatalf("Failed to open file: %s", err)
+				}
+				if _, err = tfile.WriteAt(data, 0); err != nil {
+					t.Fatalf("Failed to write file: %s", err)
+				}
+				tfiles = append(tfiles, tfile)
+			}
+			test(t, tfiles)
+		})
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	ms := NewMemoryStorage()
+	tfile, _ := ms.OpenFile("a", 4)
+	tfile.WriteAt([]byte{1, 2}, 2)
+	if _, err := tfile.WriteAt([]byte{1, 2}, 3); err == nil {
+		t.Error("Write beyond the end of the file accepted")
+	}
+
+	// Opening the same file again gives the same data
+	again, _ := ms.OpenFile("a", 4)
+	if data := again.(*MemoryFile).Bytes(); !bytes.Equal(data, []byte{0, 0, 1, 2}) {
+		t.Errorf("Incorrect data after reopening: %v", data)
+	}
+}
+
+func TestBlobStorage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "blob")
+	bs := NewBlobStorage(path)
+	a, _ := bs.OpenFile("a", 3)
+	b, err := bs.OpenFile("b", 2)
+	if err != nil {
+		t.Fatal("Failed to open file: ", err)
+	}
+	a.WriteAt([]byte("abc"), 0)
+	b.WriteAt([]byte("de"), 0)
+	if _, err := a.WriteAt([]byte("x"), 3); err == nil {
+		t.Error("Write beyond the end of a section accepted")
+	}
+
+	// Files are stored end to end
+	if data, _ := ioutil.ReadFile(path); string(data) != "abcde" {
+		t.Errorf("Incorrect blob: %q", data)
+	}
+	buf := make([]byte, 3)
+	if n, err := b.ReadAt(buf, 0); n != 2 || err == nil || string(buf[:2]) != "de" {
+		t.Errorf("Incorrect short read: %d %v %q", n, err, buf)
+	}
+	if _, ok := b.(interface {
+		Stat() (os.FileInfo, error)
+	}); !ok {
+		t.Error("Blob files cannot be checked for changes")
+	}
+}
+
+func TestStorageReopensAfterClose(t *testing.T) {
+	contents := [][]byte{[]byte("hello"), []byte("world!")}
+	forEachStorage(t, contents, func(t *testing.T, tfiles []TorrentStorer) {
+		for i, tfile := range tfiles {
+			if closer, ok := tfile.(io.Closer); ok {
+				if err := closer.Close(); err != nil {
+					t.Fatal("Failed to close file: ", err)
+				}
+			}
+			if tfile.Length() != int64(len(contents[i])) {
+				t.Errorf("File %d: length %d after close", i, tfile.Length())
+			}
+			buf := make([]byte, len(contents[i]))
+			if _, err := tfile.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, contents[i]) {
+				t.Errorf("File %d: read %q after close: %v", i, buf, err)
+			}
+			if _, err := tfile.WriteAt([]byte("j"), 0); err != nil {
+				t.Errorf("File %d: write after close failed: %s", i, err)
+			}
+		}
+	})
+}
+
+func TestMmapStorageUsesPool(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pool := NewFilePool(1)
+	ms := &MmapStorage{RootDirectory: tmpDir, Pool: pool}
+	var tfiles []TorrentStorer
+	for _, name := range []string{"a", "b", "c"} {
+		tfile, err := ms.OpenFile(name, 4)
+		if err != nil {
+			t.Skip("Memory mapped storage unsupported: ", err)
+		}
+		if _, err = tfile.WriteAt([]byte(name), 0); err != nil {
+			t.Fatal("Failed to write file: ", err)
+		}
+		tfiles = append(tfiles, tfile)
+	}
+	if pool.Open() > 1 {
+		t.Errorf("Mapped files hold %d handles, limit is 1", pool.Open())
+	}
+	for i, tfile := range tfiles {
+		buf := make([]byte, 1)
+		if tfile.ReadAt(buf, 0); buf[0] != "abc"[i] {
+			t.Errorf("File %d: incorrect data %q", i, buf)
+		}
+	}
+}
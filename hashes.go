@@ -0,0 +1,70 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/merkle"
+)
+
+// The most hashes we will send in response to a single hash request
+const maxHashRequestLength = 512
+
+// hashesFor answers a v2 hash request. We hold the piece layer of every file
+// larger than a piece from the metainfo, so we can serve ranges of that layer
+// along with the uncle hashes that prove them. Requests for any other layer are
+// rejected.
+func (t *Torrent) hashesFor(req hashRequest) (hashes [][]byte, ok bool) {
+	if t.meta.MetaVersion != 2 {
+		return
+	}
+	layer, found := t.meta.PieceLayers[string(req.piecesRoot)]
+	if !found {
+		return
+	}
+	blocksPerPiece := int(t.meta.PieceLength / merkle.BlockSize)
+	pieceLayer := merkle.Log2(blocksPerPiece)
+	if int(req.baseLayer) != pieceLayer {
+		return
+	}
+
+	layerHashes := make([][]byte, len(layer)/merkle.HashSize)
+	for i := range layerHashes {
+		layerHashes[i] = layer[i*merkle.HashSize : (i+1)*merkle.HashSize]
+	}
+	width := merkle.NextPowerOfTwo(len(layerHashes))
+
+	// The range must be a whole subtree: a power of two in length, starting at
+	// a multiple of its length.
+	index, length := int(req.index), int(req.length)
+	if length < 2 || length > maxHashRequestLength || length&(length-1) != 0 || index%length != 0 || index+length > width {
+		return
+	}
+
+	for i := index; i < index+length; i++ {
+		if i < len(layerHashes) {
+			hashes = append(hashes, layerHashes[i])
+		} else {
+			hashes = append(hashes, merkle.PadHash(pieceLayer))
+		}
+	}
+
+	// The first uncles in the proof of the first hash lie within the requested
+	// range, so the proof of the range starts above them.
+	proof, err := merkle.Proof(layerHashes, pieceLayer, width, index)
+	if err != nil {
+		return nil, false
+	}
+	proof = proof[merkle.Log2(length):]
+	if len(proof) > int(req.proofLayers) {
+		proof = proof[:req.proofLayers]
+	}
+	return append(hashes, proof...), true
+}
+
+func (t *Torrent) handleHashRequest(p *peer, msg *hashRequestMessage) {
+	if hashes, ok := t.hashesFor(msg.hashRequest); ok {
+		logger.Debug("Peer %s has asked for %d hashes at layer %d, sending them", p.name, msg.length, msg.baseLayer)
+		p.Send(&hashesMessage{hashRequest: msg.hashRequest, hashes: hashes})
+		return
+	}
+	logger.Debug("Peer %s has asked for %d hashes at layer %d, rejecting them", p.name, msg.length, msg.baseLayer)
+	p.Send(&hashRejectMessage{hashRequest: msg.hashRequest})
+}
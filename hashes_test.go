@@ -0,0 +1,219 @@
+package libtorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/torrance/libtorrent/merkle"
+	"github.com/torrance/libtorrent/metainfo"
+	"github.com/zeebo/bencode"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const v2TestPieceLength = 2 * merkle.BlockSize
+
+// newV2Metainfo builds a v2 torrent named "v2" holding files a and b. If hybrid
+// is set the torrent also has v1 metadata, with a pad file after a.
+func newV2Metainfo(t *testing.T, a, b []byte, hybrid bool) *metainfo.Metainfo {
+	tree := make(map[string]interface{})
+	layers := make(map[string]string)
+	for name, data := range map[string][]byte{"a": a, "b": b} {
+		leaves := merkle.Leaves(data)
+		root := merkle.FileRoot(leaves)
+		tree[name] = map[string]interface{}{
+			"": map[string]interface{}{"length": len(data), "pieces root": string(root)},
+		}
+		if len(data) > v2TestPieceLength {
+			var layer []byte
+			for _, h := range merkle.PieceLayer(leaves, v2TestPieceLength/merkle.BlockSize) {
+				layer = append(layer, h...)
+			}
+			layers[string(root)] = string(layer)
+		}
+	}
+	info := map[string]interface{}{
+		"name":         "v2",
+		"piece length": v2TestPieceLength,
+		"meta version": 2,
+		"file tree":    tree,
+	}
+
+	if hybrid {
+		padLength := v2TestPieceLength - len(a)%v2TestPieceLength
+		v1Data := append(append(append([]byte{}, a...), make([]byte, padLength)...), b...)
+		var pieces []byte
+		for offset := 0; offset < len(v1Data); offset += v2TestPieceLength {
+			end := offset + v2TestPieceLength
+			if end > len(v1Data) {
+				end = len(v1Data)
+			}
+			h := sha1.Sum(v1Data[offset:end])
+			pieces = append(pieces, h[:]...)
+		}
+		info["pieces"] = string(pieces)
+		info["files"] = []map[string]interface{}{
+			{"length": len(a), "path": []string{"a"}},
+			{"length": padLength, "path": []string{".pad", "0"}, "attr": "p"},
+			{"length": len(b), "path": []string{"b"}},
+		}
+	}
+
+	data, err := bencode.EncodeBytes(map[string]interface{}{"info": info, "piece layers": layers})
+	if err != nil {
+		t.Fatal("Failed to encode torrent: ", err)
+	}
+	m, err := metainfo.ParseMetainfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Failed to parse torrent: ", err)
+	}
+	return m
+}
+
+func randomTestData(seed int64, length int) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestHashesFor(t *testing.T) {
+	b := randomTestData(2, 5*v2TestPieceLength)
+	m := newV2Metainfo(t, randomTestData(1, 1000), b, false)
+	tor := &Torrent{meta: m}
+
+	root := m.Files[len(m.Files)-1].PiecesRoot
+	layer := merkle.PieceLayer(merkle.Leaves(b), v2TestPieceLength/merkle.BlockSize)
+
+	// Ask for the second pair of piece layer hashes with a proof to the root
+	req := hashRequest{piecesRoot: root, baseLayer: 1, index: 2, length: 2, proofLayers: 10}
+	hashes, ok := tor.hashesFor(req)
+	if !ok {
+		t.Fatal("Hash request rejected")
+	}
+	if len(hashes) != 4 || !bytes.Equal(hashes[0], layer[2]) || !bytes.Equal(hashes[1], layer[3]) {
+		t.Fatal("Incorrect hashes: ", len(hashes))
+	}
+	subtree := merkle.Root(hashes[:2], 1, 2)
+	if !merkle.Verify(root, subtree, 1, hashes[2:]) {
+		t.Error("Proof for requested hashes failed to verify")
+	}
+
+	// Hashes beyond the end of the layer are padding
+	req = hashRequest{piecesRoot: root, baseLayer: 1, index: 4, length: 4}
+	if hashes, ok = tor.hashesFor(req); !ok || len(hashes) != 4 || !bytes.Equal(hashes[3], merkle.PadHash(1)) {
+		t.Error("Incorrect padded hashes")
+	}
+
+	for _, req := range []hashRequest{
+		{piecesRoot: root, baseLayer: 0, index: 0, length: 2},
+		{piecesRoot: root, baseLayer: 1, index: 1, length: 2},
+		{piecesRoot: root, baseLayer: 1, index: 0, length: 3},
+		{piecesRoot: root, baseLayer: 1, index: 8, length: 2},
+		{piecesRoot: make([]byte, 32), baseLayer: 1, index: 0, length: 2},
+	} {
+		if _, ok := tor.hashesFor(req); ok {
+			t.Errorf("Expected request to be rejected: %+v", req)
+		}
+	}
+}
+
+func TestHashMessages(t *testing.T) {
+	req := hashRequest{piecesRoot: bytes.Repeat([]byte{1}, 32), baseLayer: 1, index: 2, length: 2, proofLayers: 3}
+	for _, msg := range []binaryDumper{
+		&hashRequestMessage{req},
+		&hashesMessage{hashRequest: req, hashes: [][]byte{bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 32)}},
+		&hashRejectMessage{req},
+	} {
+		buf := new(bytes.Buffer)
+		if err := msg.BinaryDump(buf); err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := parsePeerMessage(buf)
+		if err != nil {
+			t.Fatalf("Failed to parse %T: %s", msg, err)
+		}
+		switch parsed := parsed.(type) {
+		case *hashRequestMessage:
+			if parsed.proofLayers != 3 || !bytes.Equal(parsed.piecesRoot, req.piecesRoot) {
+				t.Error("Incorrect hash request: ", parsed)
+			}
+		case *hashesMessage:
+			if parsed.index != 2 || len(parsed.hashes) != 2 || parsed.hashes[1][0] != 3 {
+				t.Error("Incorrect hashes: ", parsed)
+			}
+		case *hashRejectMessage:
+			if parsed.length != 2 {
+				t.Error("Incorrect hash reject: ", parsed)
+			}
+		default:
+			t.Errorf("Unexpected message %T", parsed)
+		}
+	}
+}
+
+func TestHybridTorrentAcceptsBothInfoHashes(t *testing.T) {
+	m := newV2Metainfo(t, randomTestData(1, 1000), randomTestData(2, 3*v2TestPieceLength), true)
+	if !m.Hybrid {
+		t.Fatal("Expected hybrid torrent")
+	}
+	_, l, cleanup := newTestTorrentFromMeta(t, m, "-LT0000-hybridhybrid", nil)
+	defer cleanup()
+
+	for _, infoHash := range [][]byte{m.InfoHash, m.InfoHashV2[:20]} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := newHandshake(infoHash, []byte("-LT0000-remoteremote")).BinaryDump(conn); err != nil {
+			t.Fatal(err)
+		}
+		hs, err := parseHandshake(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("No handshake for infohash %x: %s", infoHash, err)
+		}
+		if !bytes.Equal(hs.infoHash, infoHash) {
+			t.Errorf("Handshake answered with infohash %x, expected %x", hs.infoHash, infoHash)
+		}
+		if !hs.supportsV2() {
+			t.Error("Handshake does not advertise v2 support")
+		}
+	}
+}
+
+func TestDownloadV2(t *testing.T) {
+	a := randomTestData(1, 1000)
+	b := randomTestData(2, 3*v2TestPieceLength+5)
+	m := newV2Metainfo(t, a, b, false)
+
+	seeder, l, cleanupSeeder := newTestTorrentFromMeta(t, m, "-LT0000-seederseeder",
+		map[string][]byte{filepath.Join("v2", "a"): a, filepath.Join("v2", "b"): b})
+	defer cleanupSeeder()
+	leecher, _, cleanupLeecher := newTestTorrentFromMeta(t, m, "-LT0000-leecherleech", nil)
+	defer cleanupLeecher()
+
+	if seeder.Left() != 0 {
+		t.Fatalf("Seeder failed to verify v2 data, %d bytes left", seeder.Left())
+	}
+
+	seeder.Start()
+	leecher.Start()
+	leecher.candidates.add(l.Addr().String(), SourceTracker)
+
+	if !waitFor(time.Second*10, func() bool { return leecher.State() == Seeding }) {
+		t.Fatalf("Download did not complete, %d bytes left", leecher.Left())
+	}
+	for name, original := range map[string][]byte{"a": a, "b": b} {
+		downloaded, _ := ioutil.ReadFile(filepath.Join(leecher.config.RootDirectory, "v2", name))
+		if !bytes.Equal(original, downloaded) {
+			t.Errorf("Downloaded file %s does not match original", name)
+		}
+	}
+	if _, err := ioutil.ReadDir(filepath.Join(leecher.config.RootDirectory, ".pad")); err == nil {
+		t.Error("Padding was written to disk")
+	}
+}
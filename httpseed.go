@@ -0,0 +1,74 @@
+package libtorrent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/torrance/libtorrent/ratelimit"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The longest we will wait when an HTTP seed says it is busy
+const maxHTTPSeedWait = time.Hour
+
+// busyError is returned when an HTTP seed asks us to come back later.
+type busyError struct {
+	wait time.Duration
+}
+
+func (e busyError) Error() string {
+	return fmt.Sprintf("server busy, retry in %s", e.wait)
+}
+
+// httpSeedURL builds the request for a range of a piece from a BEP 17 seed
+// script. Ranges are offsets within the piece, and are inclusive.
+func httpSeedURL(base string, infoHash []byte, index int, begin, length int64) string {
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%sinfo_hash=%s&piece=%d&ranges=%d-%d",
+		base, sep, url.QueryEscape(string(infoHash)), index, begin, begin+length-1)
+}
+
+// fetchPiece reads length bytes of piece index starting at begin from a BEP
+// 17 HTTP seed. A busy seed replies 503 with the number of seconds to wait.
+func (ws *webSeed) fetchPiece(index int, begin, length int64) (data []byte, err error) {
+	if !ws.acquireSlot() {
+		return nil, errors.New("web seed closed")
+	}
+	defer ws.releaseSlot()
+
+	resp, err := ws.client.Get(httpSeedURL(ws.url, ws.t.meta.InfoHash, index, begin, length))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body := io.Reader(&countingReader{r: resp.Body, p: ws.peer})
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		b, _ := ioutil.ReadAll(io.LimitReader(body, 32))
+		seconds, convErr := strconv.Atoi(strings.TrimSpace(string(b)))
+		if convErr != nil || seconds < 0 {
+			return nil, errors.New(fmt.Sprintf("%s: %s", ws.url, resp.Status))
+		}
+		wait := time.Duration(seconds) * time.Second
+		if wait > maxHTTPSeedWait {
+			wait = maxHTTPSeedWait
+		}
+		return nil, busyError{wait: wait}
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: %s", ws.url, resp.Status))
+	}
+
+	data = make([]byte, length)
+	_, err = io.ReadFull(ratelimit.NewReader(body, ws.peer.downLimiter, ws.t.downLimiter, ws.t.config.DownloadLimiter), data)
+	return
+}
@@ -0,0 +1,88 @@
+package libtorrent
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPSeedDownload(t *testing.T) {
+	var content []byte
+	for _, name := range []string{"test1.txt", "test2.txt", "test3.txt"} {
+		data, err := ioutil.ReadFile(filepath.Join("testData", "multitest", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = append(content, data...)
+	}
+	m := newWebSeedMetainfo(t)
+
+	// The seed script is busy for a second after the first request, then
+	// serves ranges of pieces from the concatenated files.
+	var mutex sync.Mutex
+	var busyAt time.Time
+	busyRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		if busyAt.IsZero() {
+			busyAt = time.Now()
+		}
+		if time.Since(busyAt) < time.Second {
+			busyRequests++
+			mutex.Unlock()
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "1")
+			return
+		}
+		mutex.Unlock()
+
+		query := r.URL.Query()
+		piece, err := strconv.Atoi(query.Get("piece"))
+		if query.Get("info_hash") != string(m.InfoHash) || err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var start, end int64
+		if _, err := fmt.Sscanf(strings.Replace(query.Get("ranges"), "-", " ", 1), "%d %d", &start, &end); err != nil {
+			http.Error(w, "bad ranges", http.StatusBadRequest)
+			return
+		}
+		offset := int64(piece) * m.PieceLength
+		w.Write(content[offset+start : offset+end+1])
+	}))
+	defer server.Close()
+
+	m.HTTPSeeds = []string{server.URL + "/seed.php"}
+	tor, _, cleanup := newTestTorrentFromMeta(t, m, "-LT0000-httpseedhttp", nil)
+	defer cleanup()
+	tor.Start()
+
+	if !waitFor(time.Second*10, func() bool { return tor.State() == Seeding }) {
+		t.Fatalf("Download did not complete, %d bytes left", tor.Left())
+	}
+	checkMultitest(t, tor)
+
+	// Only the requests already under way may reach the busy seed
+	mutex.Lock()
+	if busyRequests > maxWebSeedConnections {
+		t.Errorf("%d requests were made whilst the seed was busy", busyRequests)
+	}
+	mutex.Unlock()
+}
+
+func TestHTTPSeedURL(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	u := httpSeedURL("http://example.com/seed.php?key=1", infoHash, 3, 16384, 16384)
+	expected := "http://example.com/seed.php?key=1&info_hash=" + strings.Repeat("%AB", 20) + "&piece=3&ranges=16384-32767"
+	if u != expected {
+		t.Errorf("Expected %s, got %s", expected, u)
+	}
+}
@@ -0,0 +1,294 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// eMule DAT entries with an access level at or above this value are permitted
+const datAllowLevel = 128
+
+// Filter is a set of blocked IP address ranges. IPv4 addresses are stored in
+// their IPv4-in-IPv6 form so that both families share a single sorted list.
+// A nil Filter blocks nothing.
+type Filter struct {
+	mutex  sync.RWMutex
+	ranges []ipRange
+}
+
+type ipRange struct {
+	start [16]byte
+	end   [16]byte
+}
+
+type ParseError struct {
+	Line int
+	Text string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("ipfilter: unable to parse line %d: %q", e.Line, e.Text)
+}
+
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+// Load replaces the contents of the filter with the rules read from r. Each line
+// may be in PeerGuardian P2P format ("description:1.2.3.0-1.2.3.255"), eMule DAT
+// format ("001.002.003.000 - 001.002.003.255 , 000 , description") or CIDR
+// notation ("1.2.3.0/24"). Blank lines and lines beginning with # or // are
+// ignored. If any line is malformed the filter is left unchanged.
+func (f *Filter) Load(r io.Reader) (rules int, err error) {
+	var ranges []ipRange
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "//") {
+			continue
+		}
+
+		rng, block, ok := parseLine(text)
+		if !ok {
+			err = &ParseError{Line: line, Text: text}
+			return
+		}
+		if block {
+			ranges = append(ranges, rng)
+		}
+		rules++
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	ranges = mergeRanges(ranges)
+	f.mutex.Lock()
+	f.ranges = ranges
+	f.mutex.Unlock()
+	return
+}
+
+// LoadFile replaces the contents of the filter with the rules in the file at path.
+// It may be called again at any time to reload the list.
+func (f *Filter) LoadFile(path string) (rules int, err error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	return f.Load(fd)
+}
+
+// Add blocks every address from start to end inclusive.
+func (f *Filter) Add(start, end net.IP) error {
+	rng, ok := newRange(start, end)
+	if !ok {
+		return errors.New("ipfilter: invalid range " + start.String() + "-" + end.String())
+	}
+	f.mutex.Lock()
+	f.ranges = mergeRanges(append(f.ranges, rng))
+	f.mutex.Unlock()
+	return nil
+}
+
+// Blocked reports whether ip falls within any blocked range.
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	var key [16]byte
+	copy(key[:], ip16)
+
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	// Find the first range that ends at or after key
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return bytes.Compare(f.ranges[i].end[:], key[:]) >= 0
+	})
+	return i < len(f.ranges) && bytes.Compare(f.ranges[i].start[:], key[:]) <= 0
+}
+
+// BlockedAddr is Blocked for a host:port or bare host string. Hostnames that
+// are not IP addresses are never blocked.
+func (f *Filter) BlockedAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return f.Blocked(ip)
+}
+
+// Len returns the number of distinct blocked ranges after merging.
+func (f *Filter) Len() (n int) {
+	if f == nil {
+		return
+	}
+	f.mutex.RLock()
+	n = len(f.ranges)
+	f.mutex.RUnlock()
+	return
+}
+
+// parseLine returns the range described by a single line of a block list and
+// whether that range should be blocked.
+func parseLine(text string) (rng ipRange, block bool, ok bool) {
+	// CIDR
+	if _, ipnet, err := net.ParseCIDR(text); err == nil {
+		start := ipnet.IP.To16()
+		end := make(net.IP, len(start))
+		mask := ipnet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range start {
+			end[i] = start[i] | ^mask[i]
+		}
+		rng, ok = newRange(start, end)
+		return rng, ok, ok
+	}
+
+	// eMule DAT: start - end , level , description
+	if fields := strings.Split(text, ","); len(fields) >= 2 {
+		if start, end, found := parseIPRange(fields[0]); found {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return
+			}
+			rng, ok = newRange(start, end)
+			return rng, ok && level < datAllowLevel, ok
+		}
+	}
+
+	// A bare range with no description. This is tried before P2P, which would
+	// take the first group of a bare IPv6 range for a description.
+	if start, end, found := parseIPRange(text); found {
+		rng, ok = newRange(start, end)
+		return rng, ok, ok
+	}
+
+	// PeerGuardian P2P: description:start-end. Both the description and IPv6
+	// addresses may contain colons, so the range starts after the first colon
+	// that leaves something parseable.
+	for i := strings.Index(text, ":"); i != -1; {
+		if start, end, found := parseIPRange(text[i+1:]); found {
+			rng, ok = newRange(start, end)
+			return rng, ok, ok
+		}
+		j := strings.Index(text[i+1:], ":")
+		if j == -1 {
+			break
+		}
+		i += j + 1
+	}
+	return
+}
+
+// parseIPRange parses "start - end", tolerating the zero padded octets used by eMule.
+func parseIPRange(s string) (start, end net.IP, ok bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return
+	}
+	start = parseIP(strings.TrimSpace(parts[0]))
+	end = parseIP(strings.TrimSpace(parts[1]))
+	ok = start != nil && end != nil
+	return
+}
+
+func parseIP(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+
+	// Strip leading zeros from each octet, eg. 001.002.003.000
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	for i, o := range octets {
+		n, err := strconv.Atoi(o)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		octets[i] = strconv.Itoa(n)
+	}
+	return net.ParseIP(strings.Join(octets, "."))
+}
+
+func newRange(start, end net.IP) (rng ipRange, ok bool) {
+	s, e := start.To16(), end.To16()
+	if s == nil || e == nil || bytes.Compare(s, e) > 0 {
+		return
+	}
+	// Don't allow a range to straddle the IPv4 and IPv6 address families
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return
+	}
+	copy(rng.start[:], s)
+	copy(rng.end[:], e)
+	return rng, true
+}
+
+// mergeRanges sorts ranges and combines any that overlap or are adjacent.
+func mergeRanges(ranges []ipRange) []ipRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start[:], ranges[j].start[:]) < 0
+	})
+
+	merged := ranges[:1]
+	for _, rng := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		next := increment(last.end)
+		if bytes.Compare(rng.start[:], next[:]) <= 0 && !isMax(last.end) {
+			if bytes.Compare(rng.end[:], last.end[:]) > 0 {
+				last.end = rng.end
+			}
+		} else if !isMax(last.end) {
+			merged = append(merged, rng)
+		}
+	}
+	return merged
+}
+
+func increment(ip [16]byte) [16]byte {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			break
+		}
+	}
+	return ip
+}
+
+func isMax(ip [16]byte) bool {
+	for _, b := range ip {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
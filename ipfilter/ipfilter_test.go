@@ -0,0 +1,110 @@
+package ipfilter
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testList = `# Mixed format block list
+Some Organisation:1.2.3.0-1.2.3.255
+Colons: in: description:10.0.0.5-10.0.0.9
+001.002.004.000 - 001.002.004.255 , 000 , eMule entry
+005.005.005.000 - 005.005.005.255 , 200 , Allowed eMule entry
+192.168.0.0/16
+2001:db8::/32
+
+// Adjacent to the first range, so should be merged with it
+1.2.2.0/24
+`
+
+func TestLoadMixedFormats(t *testing.T) {
+	f := NewFilter()
+	rules, err := f.Load(strings.NewReader(testList))
+	if err != nil {
+		t.Fatal("Failed to load block list: ", err)
+	}
+	if rules != 7 {
+		t.Errorf("Incorrect number of rules, got: %d", rules)
+	}
+	// 1.2.2.0-1.2.4.255 merge into a single range
+	if f.Len() != 4 {
+		t.Errorf("Ranges not merged, got %d ranges", f.Len())
+	}
+
+	blocked := []string{"1.2.3.0", "1.2.3.255", "1.2.2.7", "1.2.4.128", "10.0.0.7", "192.168.44.1", "2001:db8::1"}
+	for _, ip := range blocked {
+		if !f.Blocked(net.ParseIP(ip)) {
+			t.Errorf("Expected %s to be blocked", ip)
+		}
+	}
+
+	allowed := []string{"1.2.1.255", "1.2.5.0", "10.0.0.4", "10.0.0.10", "5.5.5.5", "8.8.8.8", "2001:db9::1", "::1"}
+	for _, ip := range allowed {
+		if f.Blocked(net.ParseIP(ip)) {
+			t.Errorf("Expected %s to be allowed", ip)
+		}
+	}
+}
+
+func TestLoadIPv6P2P(t *testing.T) {
+	f := NewFilter()
+	list := "Some: desc:2001:db8::-2001:db8::ff\n2001:db8:1::-2001:db8:1::ff\n"
+	if _, err := f.Load(strings.NewReader(list)); err != nil {
+		t.Fatal("Failed to load IPv6 P2P block list: ", err)
+	}
+	for _, ip := range []string{"2001:db8::", "2001:db8::ff", "2001:db8:1::7"} {
+		if !f.Blocked(net.ParseIP(ip)) {
+			t.Errorf("Expected %s to be blocked", ip)
+		}
+	}
+	for _, ip := range []string{"2001:db8::100", "db8::1", "2001:db8:1::100"} {
+		if f.Blocked(net.ParseIP(ip)) {
+			t.Errorf("Expected %s to be allowed", ip)
+		}
+	}
+}
+
+func TestBlockedAddr(t *testing.T) {
+	f := NewFilter()
+	f.Add(net.ParseIP("10.0.0.0"), net.ParseIP("10.255.255.255"))
+
+	if !f.BlockedAddr("10.1.2.3:6881") || !f.BlockedAddr("10.1.2.3") {
+		t.Error("Expected address to be blocked")
+	}
+	if f.BlockedAddr("11.1.2.3:6881") || f.BlockedAddr("example.com:80") {
+		t.Error("Expected address to be allowed")
+	}
+}
+
+func TestReloadReplacesRules(t *testing.T) {
+	f := NewFilter()
+	f.Load(strings.NewReader("10.0.0.0/8\n"))
+	if _, err := f.Load(strings.NewReader("172.16.0.0/12\n")); err != nil {
+		t.Fatal("Failed to reload block list: ", err)
+	}
+	if f.Blocked(net.ParseIP("10.0.0.1")) || !f.Blocked(net.ParseIP("172.16.0.1")) {
+		t.Error("Reload did not replace the existing rules")
+	}
+}
+
+func TestMalformedLineLeavesFilterUnchanged(t *testing.T) {
+	f := NewFilter()
+	f.Load(strings.NewReader("10.0.0.0/8\n"))
+
+	_, err := f.Load(strings.NewReader("172.16.0.0/12\nnot an ip range\n"))
+	perr, ok := err.(*ParseError)
+	if !ok || perr.Line != 2 {
+		t.Fatalf("Expected parse error on line 2, got: %v", err)
+	}
+	if !f.Blocked(net.ParseIP("10.0.0.1")) || f.Blocked(net.ParseIP("172.16.0.1")) {
+		t.Error("Filter was modified by failed load")
+	}
+}
+
+func TestNilFilterBlocksNothing(t *testing.T) {
+	var f *Filter
+	if f.Blocked(net.ParseIP("1.2.3.4")) || f.BlockedAddr("1.2.3.4:80") || f.Len() != 0 {
+		t.Error("Nil filter blocked an address")
+	}
+}
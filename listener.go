@@ -3,12 +3,14 @@ package libtorrent
 import (
 	"fmt"
 	"net"
+	"sync"
 )
 
 type Listener struct {
 	port     uint16
 	torrents map[string]*Torrent
 	listener net.Listener
+	mutex    sync.RWMutex
 }
 
 func NewListener(port uint16) (l *Listener) {
@@ -20,8 +22,29 @@ func NewListener(port uint16) (l *Listener) {
 }
 
 func (l *Listener) AddTorrent(tor *Torrent) {
-	infoHash := fmt.Sprintf("%x", tor.InfoHash())
-	l.torrents[infoHash] = tor
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, infoHash := range tor.InfoHashes() {
+		l.torrents[fmt.Sprintf("%x", infoHash)] = tor
+	}
+}
+
+// blocked reports whether addr is blocked by the IPFilter in the Config of
+// every torrent we accept peers for, in which case the connection is dropped
+// before any handshake takes place. Addresses blocked for only some torrents
+// are turned away by the torrent once its infohash is known.
+func (l *Listener) blocked(addr string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if len(l.torrents) == 0 {
+		return false
+	}
+	for _, tor := range l.torrents {
+		if !tor.config.IPFilter.BlockedAddr(addr) {
+			return false
+		}
+	}
+	return true
 }
 
 func (l *Listener) Listen() (err error) {
@@ -39,6 +62,12 @@ func (l *Listener) Listen() (err error) {
 				return
 			}
 
+			if l.blocked(conn.RemoteAddr().String()) {
+				logger.Debug("%s Incoming connection blocked by IP filter", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+
 			go func() {
 				hs, err := parseHandshake(conn)
 				if err != nil {
@@ -48,7 +77,10 @@ func (l *Listener) Listen() (err error) {
 				}
 
 				infoHash := fmt.Sprintf("%x", hs.infoHash)
-				if tor, ok := l.torrents[infoHash]; ok {
+				l.mutex.RLock()
+				tor, ok := l.torrents[infoHash]
+				l.mutex.RUnlock()
+				if ok {
 					logger.Debug("%s Incoming peer connection: %s", conn.RemoteAddr(), hs.peerId)
 					tor.AddPeer(conn, hs)
 				} else {
@@ -63,6 +95,12 @@ func (l *Listener) Listen() (err error) {
 	return
 }
 
+// Addr returns the address the listener is bound to, which is useful when
+// listening on port 0.
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
 func (l *Listener) Close() error {
 	return l.listener.Close()
 }
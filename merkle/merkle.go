@@ -0,0 +1,168 @@
+// Package merkle implements the SHA-256 merkle trees used by BitTorrent v2
+// (BEP 52). Each file is split into 16 KiB blocks whose hashes form the
+// leaves of a binary tree. The tree is padded to a power of two with zero
+// leaves, and the root of the tree is the file's "pieces root".
+//
+// Layers are numbered by their height above the leaves, so the leaves are
+// layer 0 and the piece layer of a torrent with 64 KiB pieces is layer 2.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const (
+	BlockSize = 16384
+	HashSize  = sha256.Size
+)
+
+// HashBlock returns the leaf hash of a block. The final block of a file may
+// be shorter than BlockSize, and is hashed as is.
+func HashBlock(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+// Leaves splits data into blocks and returns their leaf hashes.
+func Leaves(data []byte) (leaves [][]byte) {
+	for offset := 0; offset < len(data); offset += BlockSize {
+		end := offset + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaves = append(leaves, HashBlock(data[offset:end]))
+	}
+	return
+}
+
+func hashPair(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// PadHash returns the hash of a subtree of the given height made entirely of
+// padding. At height 0 this is a leaf of zeros.
+func PadHash(height int) []byte {
+	pad := make([]byte, HashSize)
+	for i := 0; i < height; i++ {
+		pad = hashPair(pad, pad)
+	}
+	return pad
+}
+
+// NextPowerOfTwo returns the smallest power of two that is at least n.
+func NextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// Log2 returns the base 2 logarithm of n, which must be a power of two.
+func Log2(n int) (log int) {
+	for n > 1 {
+		n >>= 1
+		log++
+	}
+	return
+}
+
+// parent computes the layer above hashes, which lie at the given height and
+// are padded to width.
+func parent(hashes [][]byte, height, width int) [][]byte {
+	pad := PadHash(height)
+	next := make([][]byte, width/2)
+	for i := range next {
+		left, right := pad, pad
+		if 2*i < len(hashes) {
+			left = hashes[2*i]
+		}
+		if 2*i+1 < len(hashes) {
+			right = hashes[2*i+1]
+		}
+		next[i] = hashPair(left, right)
+	}
+	return next
+}
+
+// Root returns the root of a tree whose layer at the given height holds
+// hashes, padded to width entries. Width must be a power of two no smaller
+// than len(hashes).
+func Root(hashes [][]byte, height, width int) []byte {
+	if width == 0 {
+		return nil
+	}
+	for ; width > 1; width /= 2 {
+		hashes = parent(hashes, height, width)
+		height++
+	}
+	if len(hashes) == 0 {
+		return PadHash(height)
+	}
+	return hashes[0]
+}
+
+// FileRoot returns the pieces root of a file from its leaf hashes.
+func FileRoot(leaves [][]byte) []byte {
+	return Root(leaves, 0, NextPowerOfTwo(len(leaves)))
+}
+
+// PieceLayer returns the piece layer of a file from its leaf hashes. Each
+// piece covers blocksPerPiece leaves, and the final piece is padded.
+func PieceLayer(leaves [][]byte, blocksPerPiece int) (layer [][]byte) {
+	for start := 0; start < len(leaves); start += blocksPerPiece {
+		end := start + blocksPerPiece
+		if end > len(leaves) {
+			end = len(leaves)
+		}
+		layer = append(layer, Root(leaves[start:end], 0, blocksPerPiece))
+	}
+	return
+}
+
+// LayerRoot returns the pieces root of a file from its piece layer.
+func LayerRoot(layer [][]byte, blocksPerPiece int) []byte {
+	return Root(layer, Log2(blocksPerPiece), NextPowerOfTwo(len(layer)))
+}
+
+// Proof returns the uncle hashes needed to verify hashes[index] against the
+// root, ordered from the bottom of the tree up. The hashes lie at the given
+// height and are padded to width.
+func Proof(hashes [][]byte, height, width, index int) (proof [][]byte, err error) {
+	if index < 0 || index >= width {
+		err = errors.New(fmt.Sprintf("Proof index %d out of range", index))
+		return
+	}
+	for ; width > 1; width /= 2 {
+		sibling := index ^ 1
+		if sibling < len(hashes) {
+			proof = append(proof, hashes[sibling])
+		} else {
+			proof = append(proof, PadHash(height))
+		}
+		hashes = parent(hashes, height, width)
+		index /= 2
+		height++
+	}
+	return
+}
+
+// Verify checks that hash sits at index in the tree with the given root,
+// using the uncle hashes from Proof.
+func Verify(root, hash []byte, index int, proof [][]byte) bool {
+	for _, uncle := range proof {
+		if index%2 == 0 {
+			hash = hashPair(hash, uncle)
+		} else {
+			hash = hashPair(uncle, hash)
+		}
+		index /= 2
+	}
+	return index == 0 && bytes.Equal(hash, root)
+}
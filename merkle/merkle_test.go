@@ -0,0 +1,101 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+)
+
+func testData(length int) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(int64(length))).Read(data)
+	return data
+}
+
+func TestFileRootSingleBlock(t *testing.T) {
+	data := testData(1000)
+	expected := sha256.Sum256(data)
+	if root := FileRoot(Leaves(data)); !bytes.Equal(root, expected[:]) {
+		t.Errorf("Single block root should be the block hash, got %x", root)
+	}
+}
+
+func TestFileRootPadding(t *testing.T) {
+	// Three blocks are padded to four with a zero leaf
+	data := testData(2*BlockSize + 10)
+	leaves := Leaves(data)
+	if len(leaves) != 3 {
+		t.Fatal("Incorrect number of leaves: ", len(leaves))
+	}
+	zero := make([]byte, HashSize)
+	expected := hashPair(hashPair(leaves[0], leaves[1]), hashPair(leaves[2], zero))
+	if root := FileRoot(leaves); !bytes.Equal(root, expected) {
+		t.Errorf("Incorrect root: %x, expected %x", root, expected)
+	}
+}
+
+func TestPieceLayerRoot(t *testing.T) {
+	// Five pieces of four blocks each, with the last piece partial
+	data := testData(17*BlockSize + 100)
+	leaves := Leaves(data)
+	layer := PieceLayer(leaves, 4)
+	if len(layer) != 5 {
+		t.Fatal("Incorrect piece layer length: ", len(layer))
+	}
+	if root := LayerRoot(layer, 4); !bytes.Equal(root, FileRoot(leaves)) {
+		t.Errorf("Root from piece layer %x does not match root from leaves %x", root, FileRoot(leaves))
+	}
+	if !bytes.Equal(layer[4], Root(leaves[16:], 0, 4)) {
+		t.Error("Final piece not padded to a full piece")
+	}
+}
+
+func TestPadHash(t *testing.T) {
+	zero := make([]byte, HashSize)
+	if !bytes.Equal(PadHash(0), zero) {
+		t.Error("Pad hash at height 0 should be zero")
+	}
+	if !bytes.Equal(PadHash(2), hashPair(hashPair(zero, zero), hashPair(zero, zero))) {
+		t.Error("Incorrect pad hash at height 2")
+	}
+}
+
+func TestProofAndVerify(t *testing.T) {
+	leaves := Leaves(testData(5*BlockSize + 1))
+	width := NextPowerOfTwo(len(leaves))
+	root := FileRoot(leaves)
+
+	for i, leaf := range leaves {
+		proof, err := Proof(leaves, 0, width, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(proof) != 3 {
+			t.Errorf("Proof %d has %d hashes, expected 3", i, len(proof))
+		}
+		if !Verify(root, leaf, i, proof) {
+			t.Errorf("Leaf %d failed to verify", i)
+		}
+		if Verify(root, leaf, (i+1)%len(leaves), proof) {
+			t.Errorf("Leaf %d verified at the wrong index", i)
+		}
+		if Verify(root, HashBlock([]byte("bad")), i, proof) {
+			t.Errorf("Bad leaf %d verified", i)
+		}
+	}
+
+	// Proofs can also start from a higher layer, such as the piece layer
+	layer := PieceLayer(leaves, 2)
+	proof, err := Proof(layer, 1, NextPowerOfTwo(len(layer)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Verify(root, layer[2], 2, proof) {
+		t.Error("Piece layer hash failed to verify")
+	}
+
+	if _, err := Proof(leaves, 0, width, width); err == nil {
+		t.Error("Expected error for out of range index")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/torrance/libtorrent/bitfield"
+	"github.com/torrance/libtorrent/merkle"
 	"io"
 	"io/ioutil"
 )
@@ -22,21 +23,33 @@ const (
 	Cancel
 )
 
+// BitTorrent v2 hash transfer messages (BEP 52)
+const (
+	HashRequest = uint8(21)
+	Hashes      = uint8(22)
+	HashReject  = uint8(23)
+)
+
+// Peers that support BitTorrent v2 set this bit in the last reserved byte of
+// their handshake.
+const reservedV2 = 0x10
+
 type binaryDumper interface {
 	BinaryDump(w io.Writer) error
 }
 
 type handshake struct {
 	protocol []byte
+	reserved [8]byte
 	infoHash []byte
 	peerId   []byte
 }
 
-func newHandshake(infoHash []byte) (hs *handshake) {
+func newHandshake(infoHash []byte, peerId []byte) (hs *handshake) {
 	hs = &handshake{
 		protocol: []byte("BitTorrent protocol"),
 		infoHash: infoHash,
-		peerId:   PeerId,
+		peerId:   peerId,
 	}
 	return
 }
@@ -46,7 +59,7 @@ func parseHandshake(r io.Reader) (hs *handshake, err error) {
 	hs = new(handshake)
 
 	// Name length
-	_, err = r.Read(buf[0:1])
+	_, err = io.ReadFull(r, buf[0:1])
 	if err != nil {
 		return
 	} else if int(buf[0]) != 19 {
@@ -55,7 +68,7 @@ func parseHandshake(r io.Reader) (hs *handshake, err error) {
 	}
 
 	// Protocol
-	_, err = r.Read(buf[0:19])
+	_, err = io.ReadFull(r, buf[0:19])
 	if err != nil {
 		return
 	} else if !bytes.Equal(buf[0:19], []byte("BitTorrent protocol")) {
@@ -63,21 +76,21 @@ func parseHandshake(r io.Reader) (hs *handshake, err error) {
 	}
 	hs.protocol = append(hs.protocol, buf[0:19]...)
 
-	// Skip reserved bytes
-	_, err = r.Read(buf[0:8])
+	// Reserved bytes
+	_, err = io.ReadFull(r, hs.reserved[:])
 	if err != nil {
 		return
 	}
 
 	// Info Hash
-	_, err = r.Read(buf)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
 		return
 	}
 	hs.infoHash = append(hs.infoHash, buf...)
 
 	// PeerID
-	_, err = r.Read(buf)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
 		return
 	}
@@ -88,14 +101,18 @@ func parseHandshake(r io.Reader) (hs *handshake, err error) {
 
 func (hs *handshake) BinaryDump(w io.Writer) error {
 	mw := &monadWriter{w: w}
-	mw.Write(uint8(19))       // Name length
-	mw.Write(hs.protocol)     // Protocol name
-	mw.Write(make([]byte, 8)) // Reserved 8 bytes
-	mw.Write(hs.infoHash)     // InfoHash
-	mw.Write(hs.peerId)       // PeerId
+	mw.Write(uint8(19))      // Name length
+	mw.Write(hs.protocol)    // Protocol name
+	mw.Write(hs.reserved[:]) // Reserved 8 bytes
+	mw.Write(hs.infoHash)    // InfoHash
+	mw.Write(hs.peerId)      // PeerId
 	return mw.err
 }
 
+func (hs *handshake) supportsV2() bool {
+	return hs.reserved[7]&reservedV2 != 0
+}
+
 func (hs *handshake) String() string {
 	return fmt.Sprintf("[Handshake Protocol: %s infoHash: %x peerId: %s]", hs.protocol, hs.infoHash, hs.peerId)
 
@@ -121,10 +138,10 @@ func parsePeerMessage(r io.Reader) (msg interface{}, err error) {
 	err = binary.Read(r, binary.BigEndian, &id)
 	if err != nil {
 		return
-	} else if id > Cancel {
+	} else if id > Cancel && (id < HashRequest || id > HashReject) {
 		// Return error on unknown messages
 		discard := make([]byte, length-1)
-		_, err = r.Read(discard)
+		_, err = io.ReadFull(r, discard)
 		if err != nil {
 			return
 		}
@@ -135,7 +152,7 @@ func parsePeerMessage(r io.Reader) (msg interface{}, err error) {
 	// Read payload (arbitrary size)
 	payload := make([]byte, length-1)
 	if length-1 > 0 {
-		if _, err = r.Read(payload); err != nil {
+		if _, err = io.ReadFull(r, payload); err != nil {
 			return
 		}
 	}
@@ -148,6 +165,8 @@ func parsePeerMessage(r io.Reader) (msg interface{}, err error) {
 		return parseUnchokeMessage(payloadReader)
 	case Interested:
 		return parseInterestedMessage(payloadReader)
+	case Uninterested:
+		return parseUninterestedMessage(payloadReader)
 	case Have:
 		return parseHaveMessage(payloadReader)
 	case Bitfield:
@@ -156,6 +175,12 @@ func parsePeerMessage(r io.Reader) (msg interface{}, err error) {
 		return parseRequestMessage(payloadReader)
 	case Piece:
 		return parsePieceMessage(payloadReader)
+	case HashRequest:
+		return parseHashRequestMessage(payloadReader)
+	case Hashes:
+		return parseHashesMessage(payloadReader)
+	case HashReject:
+		return parseHashRejectMessage(payloadReader)
 	}
 
 	return
@@ -203,6 +228,20 @@ func (msg *interestedMessage) BinaryDump(w io.Writer) error {
 	return mw.err
 }
 
+type uninterestedMessage struct{}
+
+func parseUninterestedMessage(r io.Reader) (msg *uninterestedMessage, err error) {
+	msg = new(uninterestedMessage)
+	return
+}
+
+func (msg *uninterestedMessage) BinaryDump(w io.Writer) error {
+	mw := monadWriter{w: w}
+	mw.Write(uint32(1))
+	mw.Write(Uninterested)
+	return mw.err
+}
+
 type haveMessage struct {
 	pieceIndex uint32
 }
@@ -299,6 +338,104 @@ func (msg *pieceMessage) BinaryDump(w io.Writer) error {
 	return mw.err
 }
 
+// hashRequest identifies a range of hashes within one layer of a file's
+// merkle tree. Layers are counted from the leaves, which are 16 KiB blocks.
+type hashRequest struct {
+	piecesRoot  []byte
+	baseLayer   uint32
+	index       uint32 // Offset of the first hash within the base layer
+	length      uint32 // Number of hashes
+	proofLayers uint32 // Number of ancestor layers to include uncle hashes for
+}
+
+func parseHashRequest(r io.Reader) (req hashRequest, err error) {
+	req.piecesRoot = make([]byte, merkle.HashSize)
+	if _, err = io.ReadFull(r, req.piecesRoot); err != nil {
+		return
+	}
+	mr := &monadReader{r: r}
+	mr.Read(&req.baseLayer)
+	mr.Read(&req.index)
+	mr.Read(&req.length)
+	mr.Read(&req.proofLayers)
+	return req, mr.err
+}
+
+func (req hashRequest) dump(mw *monadWriter, id uint8, payloadLength int) {
+	mw.Write(uint32(49 + payloadLength)) // Length: id + 48 byte header + payload
+	mw.Write(id)
+	mw.Write(req.piecesRoot)
+	mw.Write(req.baseLayer)
+	mw.Write(req.index)
+	mw.Write(req.length)
+	mw.Write(req.proofLayers)
+}
+
+type hashRequestMessage struct {
+	hashRequest
+}
+
+func parseHashRequestMessage(r io.Reader) (msg *hashRequestMessage, err error) {
+	msg = new(hashRequestMessage)
+	msg.hashRequest, err = parseHashRequest(r)
+	return
+}
+
+func (msg *hashRequestMessage) BinaryDump(w io.Writer) error {
+	mw := &monadWriter{w: w}
+	msg.dump(mw, HashRequest, 0)
+	return mw.err
+}
+
+// hashesMessage answers a hash request with the requested hashes followed by
+// the uncle hashes needed to verify them, from the bottom of the tree up.
+type hashesMessage struct {
+	hashRequest
+	hashes [][]byte
+}
+
+func parseHashesMessage(r io.Reader) (msg *hashesMessage, err error) {
+	msg = new(hashesMessage)
+	if msg.hashRequest, err = parseHashRequest(r); err != nil {
+		return
+	}
+	for {
+		hash := make([]byte, merkle.HashSize)
+		if _, err = io.ReadFull(r, hash); err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+		msg.hashes = append(msg.hashes, hash)
+	}
+}
+
+func (msg *hashesMessage) BinaryDump(w io.Writer) error {
+	mw := &monadWriter{w: w}
+	msg.dump(mw, Hashes, len(msg.hashes)*merkle.HashSize)
+	for _, hash := range msg.hashes {
+		mw.Write(hash)
+	}
+	return mw.err
+}
+
+type hashRejectMessage struct {
+	hashRequest
+}
+
+func parseHashRejectMessage(r io.Reader) (msg *hashRejectMessage, err error) {
+	msg = new(hashRejectMessage)
+	msg.hashRequest, err = parseHashRequest(r)
+	return
+}
+
+func (msg *hashRejectMessage) BinaryDump(w io.Writer) error {
+	mw := &monadWriter{w: w}
+	msg.dump(mw, HashReject, 0)
+	return mw.err
+}
+
 type unknownMessage struct {
 	id     uint8
 	length uint32
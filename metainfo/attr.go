@@ -0,0 +1,82 @@
+package metainfo
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"path/filepath"
+	"strings"
+)
+
+// BEP 47 file attributes, as found in a file's attr string
+const (
+	AttrPad        = 'p'
+	AttrExecutable = 'x'
+	AttrHidden     = 'h'
+	AttrSymlink    = 'l'
+)
+
+func hasAttr(attr string, a rune) bool {
+	return strings.ContainsRune(attr, a)
+}
+
+// pathKey compares torrent paths the same way localPaths does. Names that
+// differ only by case are distinct.
+func pathKey(path []string) string {
+	key := ""
+	for _, name := range path {
+		key += "/" + norm.NFC.String(name)
+	}
+	return key
+}
+
+// resolveSymlinks finds the local path of each symlink's target. A target must
+// be a file or directory within the torrent, so that following the link can
+// never leave the download directory. paths and local are the non-pad entries
+// and their local paths, in order.
+func resolveSymlinks(entries []fileEntry, paths [][]string, local []string, name string, multiFile bool) (targets map[int]string, err error) {
+	// Each torrent path component maps to exactly one local component, so a
+	// directory's local path is a prefix of the local path of any file in it.
+	byKey := make(map[string]string)
+	for i, path := range paths {
+		components := strings.Split(local[i], string(filepath.Separator))
+		for j := range path {
+			key := pathKey(path[:j+1])
+			if _, ok := byKey[key]; !ok {
+				byKey[key] = filepath.Join(components[:j+1]...)
+			}
+		}
+	}
+
+	targets = make(map[int]string)
+	for i, e := range entries {
+		if e.pad || !hasAttr(e.attr, AttrSymlink) {
+			continue
+		}
+		if e.length != 0 {
+			err = validationError(ErrSymlink, "'%s' has length %d", strings.Join(e.path, "/"), e.length)
+			return
+		}
+		if len(e.symlink) == 0 {
+			err = validationError(ErrSymlink, "'%s' has no target", strings.Join(e.path, "/"))
+			return
+		}
+		for _, component := range e.symlink {
+			if err = validateName(component); err != nil {
+				return
+			}
+		}
+
+		// Targets are relative to the torrent's directory
+		target := e.symlink
+		if multiFile {
+			target = append([]string{name}, target...)
+		}
+		key := pathKey(target)
+		resolved, ok := byKey[key]
+		if !ok || key == pathKey(e.path) {
+			err = validationError(ErrSymlink, "'%s' points outside the torrent", strings.Join(e.path, "/"))
+			return
+		}
+		targets[i] = resolved
+	}
+	return
+}
@@ -0,0 +1,84 @@
+package metainfo
+
+import (
+	"bytes"
+	"errors"
+	"github.com/zeebo/bencode"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func encodeAttrTorrent(t *testing.T, files ...map[string]interface{}) []byte {
+	var total int64
+	for _, f := range files {
+		total += int64(f["length"].(int))
+	}
+	info := map[string]interface{}{
+		"name":         "dir",
+		"piece length": 16384,
+		"pieces":       strings.Repeat("a", int((total+16383)/16384)*20),
+		"files":        files,
+	}
+	data, err := bencode.EncodeBytes(map[string]interface{}{"info": info})
+	if err != nil {
+		t.Fatal("Failed to encode torrent: ", err)
+	}
+	return data
+}
+
+func TestParseMetainfoAttributes(t *testing.T) {
+	data := encodeAttrTorrent(t,
+		map[string]interface{}{"length": 100, "path": []string{"bin", "run"}, "attr": "x"},
+		map[string]interface{}{"length": 16284, "path": []string{".pad", "16284"}, "attr": "p"},
+		map[string]interface{}{"length": 10, "path": []string{".hidden"}, "attr": "h"},
+		map[string]interface{}{"length": 0, "path": []string{"link"}, "attr": "l", "symlink path": []string{"bin", "run"}},
+		map[string]interface{}{"length": 0, "path": []string{"dirlink"}, "attr": "l", "symlink path": []string{"bin"}},
+	)
+	m, err := ParseMetainfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Failed to parse metainfo: ", err)
+	}
+	if len(m.Files) != 5 {
+		t.Fatal("Incorrect files: ", m.Files)
+	}
+	if f := m.Files[0]; !f.Executable || f.Hidden || f.Attr != "x" {
+		t.Error("Incorrect executable file: ", f)
+	}
+	if f := m.Files[1]; !f.Pad || f.LocalPath != "" {
+		t.Error("Incorrect padding: ", f)
+	}
+	if f := m.Files[2]; !f.Hidden || f.Executable {
+		t.Error("Incorrect hidden file: ", f)
+	}
+	if f := m.Files[3]; f.SymlinkTarget != filepath.Join("dir", "bin", "run") {
+		t.Error("Incorrect symlink target: ", f.SymlinkTarget)
+	}
+	if f := m.Files[4]; f.SymlinkTarget != filepath.Join("dir", "bin") {
+		t.Error("Incorrect directory symlink target: ", f.SymlinkTarget)
+	}
+}
+
+func TestParseMetainfoInvalidSymlinks(t *testing.T) {
+	target := map[string]interface{}{"length": 10, "path": []string{"a"}}
+	link := func(length int, path ...string) map[string]interface{} {
+		return map[string]interface{}{"length": length, "path": []string{"link"}, "attr": "l", "symlink path": path}
+	}
+	tests := []struct {
+		name string
+		link map[string]interface{}
+		err  error
+	}{
+		{"no target", link(0), ErrSymlink},
+		{"missing target", link(0, "b"), ErrSymlink},
+		{"self", link(0, "link"), ErrSymlink},
+		{"dot dot", link(0, "..", "a"), ErrInvalidPath},
+		{"length", link(5, "a"), ErrSymlink},
+	}
+	for _, test := range tests {
+		data := encodeAttrTorrent(t, target, test.link)
+		if _, err := ParseMetainfo(bytes.NewReader(data)); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
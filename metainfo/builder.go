@@ -0,0 +1,335 @@
+package metainfo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/zeebo/bencode"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minPieceLength = 16384
+	maxPieceLength = 16777216
+	// Automatic piece lengths aim for no more than this many pieces
+	targetPieceCount = 1500
+)
+
+// Builder creates a torrent from a file or directory on disk. Set any optional
+// fields before calling WriteTo. The info dictionary depends only on the content,
+// name, piece length and private flag, so the infohash is stable across builds.
+type Builder struct {
+	// Tiers of tracker URLs. The first URL of the first tier becomes the primary announce URL.
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	// CreationDate defaults to the time NewBuilder was called. Set to the zero
+	// value to omit it.
+	CreationDate time.Time
+	Private      bool
+	// WebSeeds are written to the url-list key (BEP 19)
+	WebSeeds []string
+	// PieceLength is chosen automatically if 0. It must otherwise be a power of
+	// two of at least 16KiB.
+	PieceLength int64
+	// Name defaults to the base name of the path
+	Name string
+	// PadFiles inserts BEP 47 padding files so that each file of a directory
+	// starts on a piece boundary.
+	PadFiles bool
+
+	path  string
+	files []builderFile
+}
+
+type builderFile struct {
+	absPath    string
+	path       []string // Path components relative to the root
+	length     int64
+	executable bool
+	pad        bool // Padding has no absPath and is all zeros
+}
+
+func NewBuilder(path string) *Builder {
+	return &Builder{
+		path:         path,
+		CreationDate: time.Now(),
+	}
+}
+
+// infoDict and torrentDict are the bencoded forms of a torrent. Fields are
+// sorted by key when encoded, giving a canonical encoding.
+type infoDict struct {
+	Files       []fileDict `bencode:"files,omitempty"`
+	Length      int64      `bencode:"length,omitempty"`
+	Name        string     `bencode:"name"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      []byte     `bencode:"pieces"`
+	Private     int        `bencode:"private,omitempty"`
+}
+
+type fileDict struct {
+	Attr   string   `bencode:"attr,omitempty"`
+	Length int64    `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type torrentDict struct {
+	Announce     string             `bencode:"announce,omitempty"`
+	AnnounceList [][]string         `bencode:"announce-list,omitempty"`
+	Comment      string             `bencode:"comment,omitempty"`
+	CreatedBy    string             `bencode:"created by,omitempty"`
+	CreationDate int64              `bencode:"creation date,omitempty"`
+	Info         bencode.RawMessage `bencode:"info"`
+	URLList      []string           `bencode:"url-list,omitempty"`
+}
+
+// WriteTo hashes the content and writes the bencoded torrent to w.
+func (b *Builder) WriteTo(w io.Writer) (n int64, err error) {
+	info, err := b.buildInfo()
+	if err != nil {
+		return
+	}
+	rawInfo, err := bencode.EncodeBytes(info)
+	if err != nil {
+		return
+	}
+
+	t := torrentDict{
+		Comment:   b.Comment,
+		CreatedBy: b.CreatedBy,
+		Info:      rawInfo,
+		URLList:   b.WebSeeds,
+	}
+	if !b.CreationDate.IsZero() {
+		t.CreationDate = b.CreationDate.Unix()
+	}
+
+	// Drop empty tiers and only include announce-list if there is more than one tracker
+	var tiers [][]string
+	trackers := 0
+	for _, tier := range b.AnnounceList {
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+			trackers += len(tier)
+		}
+	}
+	if len(tiers) > 0 {
+		t.Announce = tiers[0][0]
+	}
+	if trackers > 1 {
+		t.AnnounceList = tiers
+	}
+
+	buf := new(bytes.Buffer)
+	if err = bencode.NewEncoder(buf).Encode(t); err != nil {
+		return
+	}
+	return buf.WriteTo(w)
+}
+
+func (b *Builder) buildInfo() (info *infoDict, err error) {
+	if err = b.walk(); err != nil {
+		return
+	}
+
+	var totalLength int64
+	for _, f := range b.files {
+		totalLength += f.length
+	}
+	if totalLength == 0 {
+		err = errors.New("Builder: torrent contains no data")
+		return
+	}
+
+	pieceLength := b.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(totalLength)
+	} else if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		err = errors.New("Builder: piece length must be a power of two of at least 16KiB")
+		return
+	}
+
+	stat, err := os.Stat(b.path)
+	if err != nil {
+		return
+	}
+	if stat.IsDir() && b.PadFiles {
+		b.padFiles(pieceLength)
+		totalLength = 0
+		for _, f := range b.files {
+			totalLength += f.length
+		}
+	}
+
+	info = &infoDict{
+		Name:        b.Name,
+		PieceLength: pieceLength,
+	}
+	if info.Name == "" {
+		info.Name = filepath.Base(filepath.Clean(b.path))
+	}
+	if b.Private {
+		info.Private = 1
+	}
+
+	if stat.IsDir() {
+		for _, f := range b.files {
+			fd := fileDict{Length: f.length, Path: f.path}
+			if f.pad {
+				fd.Attr = string(AttrPad)
+			} else if f.executable {
+				fd.Attr = string(AttrExecutable)
+			}
+			info.Files = append(info.Files, fd)
+		}
+	} else {
+		info.Length = totalLength
+	}
+
+	info.Pieces, err = b.hashPieces(pieceLength, totalLength)
+	return
+}
+
+// walk collects the regular files under the builder's path in lexical order.
+// Symlinks and other special files are skipped.
+func (b *Builder) walk() error {
+	b.files = nil
+	root := filepath.Clean(b.path)
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		var components []string
+		if rel != "." {
+			components = strings.Split(filepath.ToSlash(rel), "/")
+		}
+		b.files = append(b.files, builderFile{
+			absPath:    path,
+			path:       components,
+			length:     fi.Size(),
+			executable: fi.Mode()&0111 != 0,
+		})
+		return nil
+	})
+}
+
+// padFiles inserts padding after each file that does not end on a piece
+// boundary, except the last.
+func (b *Builder) padFiles(pieceLength int64) {
+	var padded []builderFile
+	for i, f := range b.files {
+		padded = append(padded, f)
+		if i == len(b.files)-1 || f.length%pieceLength == 0 {
+			continue
+		}
+		padLength := pieceLength - f.length%pieceLength
+		padded = append(padded, builderFile{
+			path:   []string{".pad", fmt.Sprintf("%d", padLength)},
+			length: padLength,
+			pad:    true,
+		})
+	}
+	b.files = padded
+}
+
+// hashPieces reads the files sequentially as one continuous stream, hashing
+// each piece on a pool of workers.
+func (b *Builder) hashPieces(pieceLength, totalLength int64) (pieces []byte, err error) {
+	pieceCount := int((totalLength + pieceLength - 1) / pieceLength)
+	pieces = make([]byte, pieceCount*sha1.Size)
+
+	type job struct {
+		index int
+		data  []byte
+	}
+	jobs := make(chan job, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				h := sha1.Sum(j.data)
+				copy(pieces[j.index*sha1.Size:], h[:])
+			}
+		}()
+	}
+
+	readers := make([]io.Reader, 0, len(b.files))
+	fds := make([]*os.File, 0, len(b.files))
+	defer func() {
+		for _, fd := range fds {
+			fd.Close()
+		}
+	}()
+	for _, f := range b.files {
+		if f.pad {
+			readers = append(readers, io.LimitReader(zeroReader{}, f.length))
+			continue
+		}
+		var fd *os.File
+		if fd, err = os.Open(f.absPath); err != nil {
+			break
+		}
+		fds = append(fds, fd)
+		readers = append(readers, io.LimitReader(fd, f.length))
+	}
+
+	if err == nil {
+		r := io.MultiReader(readers...)
+		for i := 0; i < pieceCount; i++ {
+			length := pieceLength
+			if i == pieceCount-1 && totalLength%pieceLength != 0 {
+				length = totalLength % pieceLength
+			}
+			data := make([]byte, length)
+			if _, err = io.ReadFull(r, data); err != nil {
+				break
+			}
+			jobs <- job{index: i, data: data}
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = errors.New("Builder: files changed size whilst hashing")
+	}
+	return
+}
+
+// zeroReader reads an endless stream of zeros, for hashing padding.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (n int, err error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// choosePieceLength picks the smallest power of two piece length that keeps
+// the number of pieces near targetPieceCount.
+func choosePieceLength(totalLength int64) int64 {
+	pieceLength := int64(minPieceLength)
+	for pieceLength < maxPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
@@ -0,0 +1,169 @@
+package metainfo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuilderSingleFile(t *testing.T) {
+	b := NewBuilder(filepath.Join("..", "testData", "test.txt"))
+	b.PieceLength = 32768
+	b.AnnounceList = [][]string{{"udp://tracker.openbittorrent.com:80/announce"}}
+	b.Comment = "A comment"
+	b.CreatedBy = "libtorrent"
+
+	buf := new(bytes.Buffer)
+	if _, err := b.WriteTo(buf); err != nil {
+		t.Fatal("Failed to build torrent: ", err)
+	}
+
+	m, err := ParseMetainfo(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal("Failed to parse built torrent: ", err)
+	}
+
+	// Compare against the torrent Transmission created for the same file
+	f, err := os.Open(filepath.Join("..", "testData", "test.txt.torrent"))
+	if err != nil {
+		t.Fatal("Failed to open torrent file: ", err)
+	}
+	defer f.Close()
+	expected, err := ParseMetainfo(f)
+	if err != nil {
+		t.Fatal("Failed to parse metainfo file: ", err)
+	}
+
+	if m.Name != "test.txt" || len(m.Files) != 1 || m.Files[0].Length != 36880 {
+		t.Errorf("Incorrect file data: %s %v", m.Name, m.Files)
+	}
+	if m.PieceCount != expected.PieceCount {
+		t.Fatalf("Incorrect piece count, got: %d", m.PieceCount)
+	}
+	for i := range m.Pieces {
+		if !bytes.Equal(m.Pieces[i], expected.Pieces[i]) {
+			t.Errorf("Incorrect hash for piece %d", i)
+		}
+	}
+	if len(m.AnnounceList) != 1 || m.AnnounceList[0] != "udp://tracker.openbittorrent.com:80/announce" {
+		t.Error("Incorrect announce list: ", m.AnnounceList)
+	}
+}
+
+func TestBuilderDirectory(t *testing.T) {
+	b := NewBuilder(filepath.Join("..", "testData", "multitest"))
+	b.PieceLength = 16384
+	b.AnnounceList = [][]string{{"udp://a.example.com:80"}, {"udp://b.example.com:80", "udp://c.example.com:80"}}
+	b.WebSeeds = []string{"http://mirror.example.com/"}
+	b.Private = true
+
+	buf := new(bytes.Buffer)
+	if _, err := b.WriteTo(buf); err != nil {
+		t.Fatal("Failed to build torrent: ", err)
+	}
+	m, err := ParseMetainfo(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal("Failed to parse built torrent: ", err)
+	}
+
+	if m.Name != "multitest" {
+		t.Error("Incorrect name: ", m.Name)
+	}
+	if len(m.Files) != 3 || m.Files[0].Path != filepath.Join("multitest", "test1.txt") || m.Files[2].Length != 36880 {
+		t.Errorf("Incorrect files: %v", m.Files)
+	}
+	// 24893 + 34113 + 36880 bytes in 16KiB pieces
+	if m.PieceCount != 6 {
+		t.Errorf("Incorrect piece count, got: %d", m.PieceCount)
+	}
+	if len(m.AnnounceList) != 3 {
+		t.Errorf("Incorrect announce list: %v", m.AnnounceList)
+	}
+
+	// Building again at a different time must not change the infohash
+	b.CreationDate = time.Now().Add(time.Hour)
+	b.Comment = "Changed"
+	buf2 := new(bytes.Buffer)
+	if _, err := b.WriteTo(buf2); err != nil {
+		t.Fatal("Failed to rebuild torrent: ", err)
+	}
+	m2, err := ParseMetainfo(buf2)
+	if err != nil {
+		t.Fatal("Failed to parse rebuilt torrent: ", err)
+	}
+	if !bytes.Equal(m.InfoHash, m2.InfoHash) {
+		t.Error("Infohash changed between builds")
+	}
+}
+
+func TestBuilderPadFiles(t *testing.T) {
+	b := NewBuilder(filepath.Join("..", "testData", "multitest"))
+	b.PieceLength = 16384
+	b.PadFiles = true
+
+	buf := new(bytes.Buffer)
+	if _, err := b.WriteTo(buf); err != nil {
+		t.Fatal("Failed to build torrent: ", err)
+	}
+	m, err := ParseMetainfo(buf)
+	if err != nil {
+		t.Fatal("Failed to parse built torrent: ", err)
+	}
+
+	// Each file but the last is padded to a piece boundary
+	if len(m.Files) != 5 || !m.Files[1].Pad || !m.Files[3].Pad || m.Files[4].Pad {
+		t.Fatalf("Incorrect files: %v", m.Files)
+	}
+	var offset int64
+	for _, f := range m.Files {
+		if !f.Pad && offset%m.PieceLength != 0 {
+			t.Errorf("File %s starts at %d, not on a piece boundary", f.Path, offset)
+		}
+		offset += f.Length
+	}
+	// 32768 + 49152 + 36880 bytes in 16KiB pieces
+	if m.PieceCount != 8 {
+		t.Errorf("Incorrect piece count, got: %d", m.PieceCount)
+	}
+
+	// The padding is hashed as zeros
+	data, err := ioutil.ReadFile(filepath.Join("..", "testData", "multitest", "test1.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha1.Sum(append(data[16384:], make([]byte, 32768-len(data))...))
+	if !bytes.Equal(m.Pieces[1], h[:]) {
+		t.Error("Incorrect hash for padded piece")
+	}
+}
+
+func TestBuilderPieceLength(t *testing.T) {
+	if l := choosePieceLength(1000); l != minPieceLength {
+		t.Errorf("Incorrect piece length for small torrent, got: %d", l)
+	}
+	if l := choosePieceLength(4 << 30); l != 4194304 {
+		t.Errorf("Incorrect piece length for 4GiB torrent, got: %d", l)
+	}
+
+	b := NewBuilder(filepath.Join("..", "testData", "test.txt"))
+	b.PieceLength = 20000
+	if _, err := b.WriteTo(ioutil.Discard); err == nil {
+		t.Error("Expected error for piece length that is not a power of two")
+	}
+}
+
+func TestBuilderEmptyDirectory(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if _, err := NewBuilder(tmpDir).WriteTo(ioutil.Discard); err == nil {
+		t.Error("Expected error building torrent with no data")
+	}
+}
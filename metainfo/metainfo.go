@@ -3,112 +3,526 @@ package metainfo
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"github.com/torrance/libtorrent/merkle"
 	"github.com/zeebo/bencode"
+	"golang.org/x/text/encoding"
 	"io"
+	"math"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Metainfo struct {
-	Name         string
+	// Name is the UTF-8 form of the torrent's name, and RawName the name as
+	// it appears in the info dictionary.
+	Name    string
+	RawName string
+	// AnnounceList is every tracker URL from announce and announce-list, in
+	// order with duplicates removed.
 	AnnounceList []string
 	Pieces       [][]byte
 	PieceCount   int
 	PieceLength  int64
 	InfoHash     []byte
-	Files        []struct {
-		Length int64
-		Path   string
+	Files        []File
+
+	// The remaining fields hold the torrent as written, so that it can be
+	// re-encoded with WriteTo. Announce, AnnounceTiers, Comment, CreatedBy,
+	// CreationDate, Encoding, URLList, HTTPSeeds, Nodes and Unknown may be
+	// edited freely. Private and Source live in the info dictionary and are
+	// read only, as changing them would change the infohash.
+	Announce      string
+	AnnounceTiers [][]string
+	Comment       string
+	CreatedBy     string
+	CreationDate  time.Time
+	Encoding      string
+	Private       bool
+	Source        string
+	URLList       []string // BEP 19 web seeds
+	HTTPSeeds     []string // BEP 17 HTTP seeds
+	Nodes         []Node   // DHT bootstrap nodes
+	// MetaVersion is 2 for v2 and hybrid torrents, and 1 otherwise. Hybrid
+	// torrents carry both v1 and v2 metadata, and are stored and verified
+	// using the v1 layout.
+	MetaVersion int
+	Hybrid      bool
+	// InfoHashV2 is the full SHA-256 infohash of v2 and hybrid torrents
+	InfoHashV2 []byte
+	// PieceLayers maps each file's pieces root to its concatenated piece layer hashes
+	PieceLayers map[string][]byte
+	// Unknown holds any top level keys not listed above, verbatim
+	Unknown map[string]bencode.RawMessage
+	// RawInfo is the info dictionary exactly as it appeared in the torrent
+	RawInfo []byte
+}
+
+type File struct {
+	Length int64
+	// Path is the file's path within the torrent, including the torrent name,
+	// decoded to UTF-8.
+	Path string
+	// LocalPath is Path mapped to a name that is safe to create on the local
+	// filesystem. This is where the file is stored, relative to the download
+	// directory.
+	LocalPath string
+	// RawPath holds the path components exactly as they appear in the torrent.
+	RawPath []string
+	// PiecesRoot is the root of the file's merkle tree in v2 torrents
+	PiecesRoot []byte
+	// Pad is true for padding that aligns the following file to a piece
+	// boundary. Padding is all zeros and is never stored.
+	Pad bool
+	// Attr holds the file's BEP 47 attributes as written. Executable files are
+	// created with their executable bits set, while Hidden is informational.
+	Attr       string
+	Executable bool
+	Hidden     bool
+	// SymlinkTarget is set for symlinks, and is the local path of the file or
+	// directory within the torrent that the link points to. Symlinks have no
+	// data and are created rather than downloaded.
+	SymlinkTarget string
+}
+
+type Node struct {
+	Host string
+	Port int
+}
+
+// Keys decoded into named Metainfo fields. Anything else is kept in Unknown.
+var knownKeys = map[string]bool{
+	"announce":      true,
+	"announce-list": true,
+	"comment":       true,
+	"created by":    true,
+	"creation date": true,
+	"encoding":      true,
+	"info":          true,
+	"url-list":      true,
+	"httpseeds":     true,
+	"nodes":         true,
+	"piece layers":  true,
+}
+
+// decodedInfo is the info dictionary as decoded from a torrent. v1 torrents list
+// their files in Length or Files, v2 torrents in FileTree, and hybrid torrents
+// in both.
+type decodedInfo struct {
+	Length      int64
+	Name        string
+	NameUTF8    string `bencode:"name.utf-8"`
+	Pieces      []byte
+	PieceLength int64 `bencode:"piece length"`
+	Private     int64
+	Source      string
+	Attr        string
+	Files       []struct {
+		Length      int64
+		Path        []string
+		PathUTF8    []string `bencode:"path.utf-8"`
+		Attr        string
+		SymlinkPath []string `bencode:"symlink path"`
 	}
+	MetaVersion int64                  `bencode:"meta version"`
+	FileTree    map[string]interface{} `bencode:"file tree"`
 }
 
 func ParseMetainfo(r io.Reader) (m *Metainfo, err error) {
-	var metaDecode struct {
-		Announce string
-		List     [][]string         `bencode:"announce-list"`
-		RawInfo  bencode.RawMessage `bencode:"info"`
-		Info     struct {
-			Length      int64
-			Name        string
-			Pieces      []byte
-			PieceLength int64 `bencode:"piece length"`
-			Files       []struct {
-				Length int64
-				Path   []string
+	// We decode the top level dictionary into its raw values first. This gives
+	// us the raw info data to derive the unique info_hash of this torrent, and
+	// lets us keep hold of any keys we don't understand.
+	var raw map[string]bencode.RawMessage
+	dec := bencode.NewDecoder(r)
+	if err = dec.Decode(&raw); err != nil {
+		return
+	}
+	if _, ok := raw["info"]; !ok {
+		err = &ValidationError{Err: ErrMissingInfo}
+		return
+	}
+
+	var info decodedInfo
+	if err = decodeKey(raw, "info", &info); err != nil {
+		return
+	}
+
+	// Names are preferably UTF-8, but older torrents may use another encoding
+	// and declare it at the top level.
+	var enc string
+	if err = decodeKey(raw, "encoding", &enc); err != nil {
+		return
+	}
+	nameDec := nameDecoder(enc)
+	name := decodeName(info.Name, info.NameUTF8, nameDec)
+
+	// Validate the info dictionary before trusting anything in it. File paths in
+	// particular come from an untrusted source and are later joined onto the
+	// download directory.
+	if info.MetaVersion != 0 && info.MetaVersion != 1 && info.MetaVersion != 2 {
+		err = validationError(ErrMetaVersion, "%d", info.MetaVersion)
+		return
+	}
+	hasV2 := info.MetaVersion == 2
+	hasV1 := !hasV2 || info.Pieces != nil || info.Files != nil || info.Length != 0
+
+	var entries []fileEntry
+	var pieces [][]byte
+	if hasV1 {
+		if entries, err = v1Files(&info, name, nameDec); err != nil {
+			return
+		}
+		if len(info.Pieces)%20 != 0 {
+			err = validationError(ErrPieces, "%d bytes", len(info.Pieces))
+			return
+		}
+		// Pieces is a single string of concatenated 20-byte SHA1 hash values for all pieces in the torrent
+		// Cycle through and create an slice of hashes
+		for i := 0; i < len(info.Pieces)/20; i++ {
+			pieces = append(pieces, info.Pieces[i*20:i*20+20])
+		}
+	}
+
+	var v2Entries []fileEntry
+	if hasV2 {
+		if info.PieceLength < merkle.BlockSize || info.PieceLength&(info.PieceLength-1) != 0 {
+			err = validationError(ErrPieceLength, "%d is not a power of two of at least 16 KiB", info.PieceLength)
+			return
+		}
+		if err = parseFileTree(info.FileTree, nil, nameDec, &v2Entries); err != nil {
+			return
+		}
+		// Multi file torrents have their files in a directory named after the torrent
+		if len(v2Entries) != 1 || len(v2Entries[0].path) != 1 {
+			for i := range v2Entries {
+				v2Entries[i].path = append([]string{name}, v2Entries[i].path...)
+				v2Entries[i].rawPath = append([]string{info.Name}, v2Entries[i].rawPath...)
+			}
+		}
+		if hasV1 {
+			// Hybrid torrents are stored and verified using their v1 layout
+			if err = matchHybrid(entries, v2Entries); err != nil {
+				return
 			}
+		} else {
+			entries = alignFiles(v2Entries, info.PieceLength)
 		}
 	}
 
-	// We need the raw info data to derive the unique info_hash
-	// of this torrent. Therefore we decode the metainfo in two steps
-	// to obtain both the raw info data and its decoded form.
-	dec := bencode.NewDecoder(r)
-	if err = dec.Decode(&metaDecode); err != nil {
+	var paths [][]string
+	var totalLength int64
+	for _, e := range entries {
+		if e.length < 0 {
+			err = validationError(ErrFileLength, "'%s' has length %d", strings.Join(e.path, "/"), e.length)
+			return
+		}
+		// A total that wraps around could otherwise match a short pieces string
+		if e.length > math.MaxInt64-totalLength {
+			err = validationError(ErrFileLength, "'%s' takes the total length beyond %d bytes", strings.Join(e.path, "/"), int64(math.MaxInt64))
+			return
+		}
+		if !e.pad {
+			paths = append(paths, e.path)
+		}
+		totalLength += e.length
+	}
+	if err = validatePaths(paths); err != nil {
 		return
 	}
-
-	dec = bencode.NewDecoder(bytes.NewReader(metaDecode.RawInfo))
-	if err = dec.Decode(&metaDecode.Info); err != nil {
+	local := localPaths(paths)
+	multiFile := len(paths) > 1 || (len(paths) == 1 && len(paths[0]) > 1)
+	var symlinks map[int]string
+	if symlinks, err = resolveSymlinks(entries, paths, local, name, multiFile); err != nil {
 		return
 	}
 
-	// Basic error checking
-	if len(metaDecode.Info.Pieces)%20 != 0 {
-		err = errors.New("Metainfo file malformed: Pieces length is not a multiple of 20.")
+	var layers map[string]string
+	if hasV2 {
+		if err = decodeKey(raw, "piece layers", &layers); err != nil {
+			return
+		}
+		var v2Hashes [][]byte
+		if v2Hashes, err = v2Pieces(v2Entries, info.PieceLength, layers); err != nil {
+			return
+		}
+		if !hasV1 {
+			pieces = v2Hashes
+		}
+	}
+	if err = validatePieces(info.PieceLength, len(pieces), totalLength); err != nil {
 		return
 	}
-	// TODO: Other error checking
 
-	// Parse metaDecode into metainfo
+	// Parse info into metainfo
 	m = &Metainfo{
-		Name:        metaDecode.Info.Name,
-		PieceLength: metaDecode.Info.PieceLength,
-		Pieces:      make([][]byte, len(metaDecode.Info.Pieces)/20),
-		PieceCount:  len(metaDecode.Info.Pieces) / 20,
+		Name:        name,
+		RawName:     info.Name,
+		PieceLength: info.PieceLength,
+		Pieces:      pieces,
+		PieceCount:  len(pieces),
+		MetaVersion: 1,
+		Hybrid:      hasV1 && hasV2,
+		Private:     info.Private == 1,
+		Source:      info.Source,
+		RawInfo:     raw["info"],
+		Encoding:    enc,
+		Unknown:     make(map[string]bencode.RawMessage),
+	}
+	if hasV2 {
+		m.MetaVersion = 2
+		m.PieceLayers = make(map[string][]byte)
+		for root, layer := range layers {
+			m.PieceLayers[root] = []byte(layer)
+		}
 	}
 
-	// Append other announce lists
-	// First pass it through a map so we can ensure we have unique entries
-	lists := make(map[string]bool)
-	lists[metaDecode.Announce] = true // Primary announce list
-	for _, tier := range metaDecode.List {
-		for _, list := range tier {
-			lists[list] = true
+	var creationDate int64
+	var urlList, httpSeeds bencode.RawMessage
+	for _, e := range []error{
+		decodeKey(raw, "announce", &m.Announce),
+		decodeKey(raw, "announce-list", &m.AnnounceTiers),
+		decodeKey(raw, "comment", &m.Comment),
+		decodeKey(raw, "created by", &m.CreatedBy),
+		decodeKey(raw, "creation date", &creationDate),
+		decodeKey(raw, "url-list", &urlList),
+		decodeKey(raw, "httpseeds", &httpSeeds),
+	} {
+		if e != nil {
+			err = e
+			return
 		}
 	}
-	// Now unravel map into list
-	m.AnnounceList = make([]string, 0, len(lists))
-	for list, _ := range lists {
-		m.AnnounceList = append(m.AnnounceList, list)
+	if creationDate != 0 {
+		m.CreationDate = time.Unix(creationDate, 0)
+	}
+	if m.URLList, err = decodeStringOrList(urlList); err != nil {
+		return
+	}
+	if m.HTTPSeeds, err = decodeStringOrList(httpSeeds); err != nil {
+		return
+	}
+	if m.Nodes, err = decodeNodes(raw["nodes"]); err != nil {
+		return
+	}
+	for key, value := range raw {
+		if !knownKeys[key] {
+			m.Unknown[key] = value
+		}
 	}
 
-	// Pieces is a single string of concatenated 20-byte SHA1 hash values for all pieces in the torrent
-	// Cycle through and create an slice of hashes
-	for i := 0; i < len(metaDecode.Info.Pieces)/20; i++ {
-		m.Pieces[i] = metaDecode.Info.Pieces[i*20 : i*20+20]
+	// Flatten the primary announce URL and announce lists, keeping the first
+	// occurrence of each so that the order is stable.
+	seen := make(map[string]bool)
+	for _, list := range append([][]string{{m.Announce}}, m.AnnounceTiers...) {
+		for _, url := range list {
+			if url != "" && !seen[url] {
+				seen[url] = true
+				m.AnnounceList = append(m.AnnounceList, url)
+			}
+		}
 	}
 
 	// Single files and multiple files are stored differently. We normalise these into
 	// a single description
-	type file struct {
-		Length int64
-		Path   string
+	for i, e := range entries {
+		f := File{
+			Length:        e.length,
+			Path:          filepath.Join(e.path...),
+			RawPath:       e.rawPath,
+			PiecesRoot:    e.piecesRoot,
+			Pad:           e.pad,
+			Attr:          e.attr,
+			Executable:    hasAttr(e.attr, AttrExecutable),
+			Hidden:        hasAttr(e.attr, AttrHidden),
+			SymlinkTarget: symlinks[i],
+		}
+		if !e.pad {
+			f.LocalPath, local = local[0], local[1:]
+		}
+		m.Files = append(m.Files, f)
 	}
-	if len(metaDecode.Info.Files) == 0 && metaDecode.Info.Length != 0 {
-		// Just one file
-		m.Files = append(m.Files, file{Length: metaDecode.Info.Length, Path: metaDecode.Info.Name})
+
+	// Create infohashes. Torrents with v1 metadata are identified by the SHA-1
+	// infohash, while pure v2 torrents use the SHA-256 infohash truncated to 20
+	// bytes.
+	if hasV2 {
+		h := sha256.Sum256(m.RawInfo)
+		m.InfoHashV2 = h[:]
+	}
+	if hasV1 {
+		h := sha1.Sum(m.RawInfo)
+		m.InfoHash = h[:]
 	} else {
-		// Multiple files
-		for _, f := range metaDecode.Info.Files {
-			path := filepath.Join(append([]string{metaDecode.Info.Name}, f.Path...)...)
-			m.Files = append(m.Files, file{Length: f.Length, Path: path})
+		m.InfoHash = m.InfoHashV2[:20]
+	}
+
+	return
+}
+
+// fileEntry is a file as listed in the info dictionary, before it is mapped to
+// a File.
+type fileEntry struct {
+	path       []string // Decoded path, including the torrent name for multi file torrents
+	rawPath    []string
+	length     int64
+	piecesRoot []byte
+	pad        bool
+	attr       string
+	symlink    []string // Decoded symlink target, relative to the torrent root
+}
+
+// v1Files lists the files of a v1 info dictionary. Single files and multiple
+// files are stored differently, and we normalise these into a single description.
+func v1Files(info *decodedInfo, name string, dec *encoding.Decoder) (entries []fileEntry, err error) {
+	if len(info.Files) == 0 {
+		if info.Length != 0 {
+			entries = append(entries, fileEntry{
+				path:    []string{name},
+				rawPath: []string{info.Name},
+				length:  info.Length,
+				attr:    info.Attr,
+			})
 		}
+		return
 	}
 
-	// Create infohash
-	h := sha1.New()
-	h.Write(metaDecode.RawInfo)
-	m.InfoHash = h.Sum(nil)
+	for _, f := range info.Files {
+		if len(f.Path) == 0 {
+			err = validationError(ErrInvalidPath, "file with no path")
+			return
+		}
+		entries = append(entries, fileEntry{
+			path:    append([]string{name}, decodePath(f.Path, f.PathUTF8, dec)...),
+			rawPath: append([]string{info.Name}, f.Path...),
+			length:  f.Length,
+			pad:     hasAttr(f.Attr, AttrPad),
+			attr:    f.Attr,
+			symlink: decodePath(f.SymlinkPath, nil, dec),
+		})
+	}
+	return
+}
 
+// decodeKey decodes raw[key] into v, leaving v untouched if the key is absent.
+func decodeKey(raw map[string]bencode.RawMessage, key string, v interface{}) error {
+	value, ok := raw[key]
+	if !ok {
+		return nil
+	}
+	if err := bencode.DecodeBytes(value, v); err != nil {
+		return errors.New(fmt.Sprintf("Metainfo file malformed: could not decode '%s': %s", key, err))
+	}
+	return nil
+}
+
+// decodeStringOrList handles keys such as url-list that may hold either a
+// single string or a list of strings.
+func decodeStringOrList(raw bencode.RawMessage) (list []string, err error) {
+	if len(raw) == 0 {
+		return
+	}
+	var v interface{}
+	if err = bencode.DecodeBytes(raw, &v); err != nil {
+		return
+	}
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			list = append(list, v)
+		}
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s != "" {
+				list = append(list, s)
+			}
+		}
+	default:
+		err = errors.New("Metainfo file malformed: expected string or list of strings")
+	}
 	return
 }
+
+// decodeNodes decodes a list of [host, port] pairs. Malformed entries are skipped.
+func decodeNodes(raw bencode.RawMessage) (nodes []Node, err error) {
+	if len(raw) == 0 {
+		return
+	}
+	var v []interface{}
+	if err = bencode.DecodeBytes(raw, &v); err != nil {
+		return
+	}
+	for _, item := range v {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		host, ok1 := pair[0].(string)
+		port, ok2 := pair[1].(int64)
+		if ok1 && ok2 {
+			nodes = append(nodes, Node{Host: host, Port: int(port)})
+		}
+	}
+	return
+}
+
+// WriteTo bencodes the torrent to w. The info dictionary is written back
+// byte for byte, so the infohash never changes.
+func (m *Metainfo) WriteTo(w io.Writer) (n int64, err error) {
+	if len(m.RawInfo) == 0 {
+		err = errors.New("Metainfo has no info dictionary to write")
+		return
+	}
+
+	out := make(map[string]interface{})
+	for key, value := range m.Unknown {
+		out[key] = value
+	}
+	out["info"] = bencode.RawMessage(m.RawInfo)
+	if m.Announce != "" {
+		out["announce"] = m.Announce
+	}
+	if len(m.AnnounceTiers) > 0 {
+		out["announce-list"] = m.AnnounceTiers
+	}
+	if m.Comment != "" {
+		out["comment"] = m.Comment
+	}
+	if m.CreatedBy != "" {
+		out["created by"] = m.CreatedBy
+	}
+	if !m.CreationDate.IsZero() {
+		out["creation date"] = m.CreationDate.Unix()
+	}
+	if m.Encoding != "" {
+		out["encoding"] = m.Encoding
+	}
+	if len(m.URLList) > 0 {
+		out["url-list"] = m.URLList
+	}
+	if len(m.HTTPSeeds) > 0 {
+		out["httpseeds"] = m.HTTPSeeds
+	}
+	if len(m.PieceLayers) > 0 {
+		layers := make(map[string]string)
+		for root, layer := range m.PieceLayers {
+			layers[root] = string(layer)
+		}
+		out["piece layers"] = layers
+	}
+	if len(m.Nodes) > 0 {
+		nodes := make([][]interface{}, len(m.Nodes))
+		for i, node := range m.Nodes {
+			nodes[i] = []interface{}{node.Host, node.Port}
+		}
+		out["nodes"] = nodes
+	}
+
+	buf := new(bytes.Buffer)
+	if err = bencode.NewEncoder(buf).Encode(out); err != nil {
+		return
+	}
+	return buf.WriteTo(w)
+}
@@ -2,6 +2,7 @@ package metainfo
 
 import (
 	"bytes"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -77,3 +78,70 @@ func TestParseMetainfoTwo(t *testing.T) {
 		t.Error("Incorrect infoshash: ", m.InfoHash)
 	}
 }
+
+func TestWriteToRoundTrip(t *testing.T) {
+	for _, name := range []string{"test.txt.torrent", "multitest.torrent"} {
+		original, err := ioutil.ReadFile(filepath.Join("..", "testData", name))
+		if err != nil {
+			t.Fatal("Failed to read torrent file: ", err)
+		}
+		m, err := ParseMetainfo(bytes.NewReader(original))
+		if err != nil {
+			t.Fatal("Failed to parse metainfo file: ", err)
+		}
+
+		buf := new(bytes.Buffer)
+		if _, err := m.WriteTo(buf); err != nil {
+			t.Fatal("Failed to write metainfo: ", err)
+		}
+		if !bytes.Equal(buf.Bytes(), original) {
+			t.Errorf("%s: re-encoded torrent differs from the original", name)
+		}
+	}
+}
+
+func TestParseMetainfoExtraFields(t *testing.T) {
+	info := "d6:lengthi5e4:name5:a.txt12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa7:privatei1e6:source3:fooe"
+	data := "d8:announce5:http:7:comment2:hi13:creation datei1400000000e8:encoding5:UTF-8" +
+		"4:info" + info + "5:nodesll4:host" + "i6881eee" + "8:url-list4:http" + "9:x-unknownli1ei2eee"
+
+	m, err := ParseMetainfo(bytes.NewReader([]byte(data)))
+	if err != nil {
+		t.Fatal("Failed to parse metainfo: ", err)
+	}
+	if m.Comment != "hi" || m.Encoding != "UTF-8" || m.CreationDate.Unix() != 1400000000 {
+		t.Error("Incorrect comment, encoding or creation date: ", m.Comment, m.Encoding, m.CreationDate)
+	}
+	if !m.Private || m.Source != "foo" {
+		t.Error("Incorrect private or source: ", m.Private, m.Source)
+	}
+	if len(m.URLList) != 1 || m.URLList[0] != "http" {
+		t.Error("Incorrect url-list: ", m.URLList)
+	}
+	if len(m.Nodes) != 1 || m.Nodes[0] != (Node{Host: "host", Port: 6881}) {
+		t.Error("Incorrect nodes: ", m.Nodes)
+	}
+	if string(m.Unknown["x-unknown"]) != "li1ei2ee" {
+		t.Error("Unknown key not retained: ", m.Unknown)
+	}
+	if string(m.RawInfo) != info {
+		t.Error("Incorrect raw info: ", string(m.RawInfo))
+	}
+
+	// Edit a field and check that everything else survives re-encoding
+	m.Comment = "edited"
+	buf := new(bytes.Buffer)
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatal("Failed to write metainfo: ", err)
+	}
+	m2, err := ParseMetainfo(buf)
+	if err != nil {
+		t.Fatal("Failed to parse re-encoded metainfo: ", err)
+	}
+	if m2.Comment != "edited" || !bytes.Equal(m2.InfoHash, m.InfoHash) {
+		t.Error("Incorrect comment or infohash after re-encoding: ", m2.Comment, m2.InfoHash)
+	}
+	if string(m2.Unknown["x-unknown"]) != "li1ei2ee" || len(m2.Nodes) != 1 || len(m2.URLList) != 1 {
+		t.Error("Fields lost after re-encoding: ", m2)
+	}
+}
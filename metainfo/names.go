@@ -0,0 +1,172 @@
+package metainfo
+
+import (
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/unicode/norm"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Characters that are invalid in file names on at least one common platform
+const unsafeChars = `<>:"/\|?*`
+
+// The longest file or directory name we create, in bytes. This is the limit of
+// most common filesystems.
+const maxNameLength = 255
+
+// Names Windows reserves for devices, with or without an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// nameDecoder returns a decoder for the torrent's legacy encoding, or nil if
+// the encoding is missing or unknown.
+func nameDecoder(name string) *encoding.Decoder {
+	if name == "" {
+		return nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil
+	}
+	return enc.NewDecoder()
+}
+
+// decodeName picks the best UTF-8 form of a name. The explicit UTF-8 variant
+// (name.utf-8 or path.utf-8) is preferred, then the name itself if it is valid
+// UTF-8, then the name transcoded from the torrent's declared encoding. As a
+// last resort invalid bytes are replaced.
+func decodeName(raw, utf8Variant string, dec *encoding.Decoder) string {
+	if utf8Variant != "" && utf8.ValidString(utf8Variant) {
+		return utf8Variant
+	}
+	if utf8.ValidString(raw) {
+		return raw
+	}
+	if dec != nil {
+		if s, err := dec.String(raw); err == nil && utf8.ValidString(s) {
+			return s
+		}
+	}
+	return strings.ToValidUTF8(raw, string(utf8.RuneError))
+}
+
+// decodePath applies decodeName to each component of a path. The UTF-8 variant
+// is only used if it has the same number of components.
+func decodePath(raw, utf8Variant []string, dec *encoding.Decoder) []string {
+	path := make([]string, len(raw))
+	for i, name := range raw {
+		variant := ""
+		if len(utf8Variant) == len(raw) {
+			variant = utf8Variant[i]
+		}
+		path[i] = decodeName(name, variant, dec)
+	}
+	return path
+}
+
+// safeName maps a single validated path component to a name that can be
+// created on any common filesystem. The name is normalised to NFC, characters
+// that are invalid on some platforms are replaced, Windows device names such as
+// "aux.c" gain an underscore, overlong names are shortened keeping their
+// extension, and a trailing dot or space, which Windows silently strips, is
+// protected.
+func safeName(name string) string {
+	name = norm.NFC.String(name)
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(unsafeChars, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	base := name
+	if i := strings.Index(base, "."); i != -1 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		name = base + "_" + name[len(base):]
+	}
+
+	name = truncateName(name, maxNameLength)
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		if len(name) < maxNameLength {
+			name += "_"
+		} else {
+			name = name[:len(name)-1] + "_"
+		}
+	}
+	return name
+}
+
+// truncateName shortens name to at most max bytes, keeping its extension
+// unless that is unreasonably long, and without splitting a character.
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > max/2 {
+		ext = ""
+	}
+	return truncateUTF8(strings.TrimSuffix(name, ext), max-len(ext)) + ext
+}
+
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// localPaths maps each torrent path to a path on the local filesystem. Every
+// component passes through safeName, and where two different names map to the
+// same local name, ignoring case as the filesystem may, the later one gains a
+// numbered suffix. Directories are mapped once, so all files in a directory
+// stay together.
+func localPaths(paths [][]string) []string {
+	taken := make(map[string]bool)
+	dirs := make(map[string]string) // pathKey of torrent directory -> local directory
+	local := make([]string, len(paths))
+
+	for i, path := range paths {
+		parent := ""
+		for j, name := range path {
+			key := pathKey(path[:j+1])
+			isDir := j < len(path)-1
+			if dir, ok := dirs[key]; ok && isDir {
+				parent = dir
+				continue
+			}
+
+			safe := safeName(name)
+			ext := filepath.Ext(safe)
+			if isDir {
+				ext = ""
+			}
+			candidate := filepath.Join(parent, safe)
+			for n := 1; taken[strings.ToLower(candidate)]; n++ {
+				suffix := fmt.Sprintf(" (%d)", n)
+				base := truncateUTF8(strings.TrimSuffix(safe, ext), maxNameLength-len(suffix)-len(ext))
+				candidate = filepath.Join(parent, base+suffix+ext)
+			}
+			taken[strings.ToLower(candidate)] = true
+			if isDir {
+				dirs[key] = candidate
+			}
+			parent = candidate
+		}
+		local[i] = parent
+	}
+	return local
+}
@@ -0,0 +1,197 @@
+package metainfo
+
+import (
+	"bytes"
+	"github.com/zeebo/bencode"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestDecodeName(t *testing.T) {
+	latin1 := nameDecoder("ISO-8859-1")
+	if latin1 == nil {
+		t.Fatal("No decoder for ISO-8859-1")
+	}
+
+	tests := []struct {
+		raw, variant string
+		dec          bool
+		expected     string
+	}{
+		{"plain", "", false, "plain"},
+		{"caf\xe9", "café", false, "café"},
+		{"ascii", "utf-8 variant", false, "utf-8 variant"},
+		{"caf\xe9", "bad\xff", true, "café"},
+		{"caf\xe9", "", true, "café"},
+		{"caf\xe9", "", false, "caf�"},
+	}
+	for _, test := range tests {
+		var dec = latin1
+		if !test.dec {
+			dec = nil
+		}
+		if name := decodeName(test.raw, test.variant, dec); name != test.expected {
+			t.Errorf("decodeName(%q, %q): expected %q, got %q", test.raw, test.variant, test.expected, name)
+		}
+	}
+
+	if nameDecoder("not-an-encoding") != nil {
+		t.Error("Expected nil decoder for unknown encoding")
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	tests := map[string]string{
+		"normal.txt":      "normal.txt",
+		"a:b?c*.txt":      "a_b_c_.txt",
+		"tab\there":       "tab_here",
+		"e\u0301te\u0301": "\u00e9t\u00e9",
+		"trailing.":       "trailing._",
+		"trailing ":       "trailing _",
+		"aux.c":           "aux_.c",
+		"CON":             "CON_",
+		"nul .txt":        "nul _.txt",
+		"lpt1.tar.gz":     "lpt1_.tar.gz",
+		"auxiliary.c":     "auxiliary.c",
+		"com10":           "com10",
+	}
+	for name, expected := range tests {
+		if safe := safeName(name); safe != expected {
+			t.Errorf("safeName(%q): expected %q, got %q", name, expected, safe)
+		}
+	}
+}
+
+func TestSafeNameTruncates(t *testing.T) {
+	long := safeName(strings.Repeat("x", 300) + ".txt")
+	if len(long) != maxNameLength || !strings.HasSuffix(long, "x.txt") {
+		t.Errorf("Long name not shortened keeping its extension: %d bytes, %q", len(long), long[len(long)-10:])
+	}
+
+	// Multi-byte characters are not split
+	long = safeName(strings.Repeat("é", 200))
+	if len(long) > maxNameLength || !utf8.ValidString(long) {
+		t.Errorf("Long name shortened to %d bytes, valid UTF-8: %t", len(long), utf8.ValidString(long))
+	}
+
+	long = safeName(strings.Repeat("x", 300) + ".")
+	if len(long) != maxNameLength || !strings.HasSuffix(long, "_") {
+		t.Errorf("Trailing dot of long name not protected: %q", long[len(long)-10:])
+	}
+}
+
+func TestLocalPaths(t *testing.T) {
+	paths := [][]string{
+		{"d", "a?.txt"},
+		{"d", "a*.txt"},
+		{"d", "x:", "1"},
+		{"d", "x:", "2"},
+		{"d", "x_", "3"},
+		{"d", "e\u0301"},
+		{"d", "\u00e9", "4"},
+		{"d", "Foo"},
+		{"d", "foo"},
+		{"d", "Bar", "5"},
+		{"d", "bar", "6"},
+		{"d", strings.Repeat("y", 255)},
+		{"d", strings.Repeat("Y", 255)},
+	}
+	expected := []string{
+		filepath.Join("d", "a_.txt"),
+		filepath.Join("d", "a_ (1).txt"),
+		filepath.Join("d", "x_", "1"),
+		filepath.Join("d", "x_", "2"),
+		filepath.Join("d", "x_ (1)", "3"),
+		filepath.Join("d", "\u00e9"),
+		filepath.Join("d", "\u00e9 (1)", "4"),
+		filepath.Join("d", "Foo"),
+		filepath.Join("d", "foo (1)"),
+		filepath.Join("d", "Bar", "5"),
+		filepath.Join("d", "bar (1)", "6"),
+		filepath.Join("d", strings.Repeat("y", 255)),
+		filepath.Join("d", strings.Repeat("Y", 251)+" (1)"),
+	}
+
+	local := localPaths(paths)
+	for i := range expected {
+		if local[i] != expected[i] {
+			t.Errorf("Path %v: expected %q, got %q", paths[i], expected[i], local[i])
+		}
+	}
+}
+
+func TestParseMetainfoUTF8Names(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         "caf\xe9",
+		"name.utf-8":   "café",
+		"piece length": 16,
+		"pieces":       strings.Repeat("a", 20),
+		"files": []map[string]interface{}{
+			{"length": 5, "path": []string{"\xe9t\xe9:1"}, "path.utf-8": []string{"été:1"}},
+			{"length": 5, "path": []string{"legacy\xe9"}},
+		},
+	}
+	data, err := bencode.EncodeBytes(map[string]interface{}{"encoding": "ISO-8859-1", "info": info})
+	if err != nil {
+		t.Fatal("Failed to encode torrent: ", err)
+	}
+
+	m, err := ParseMetainfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Failed to parse metainfo: ", err)
+	}
+	if m.Name != "café" || m.RawName != "caf\xe9" {
+		t.Errorf("Incorrect name %q or raw name %q", m.Name, m.RawName)
+	}
+	if len(m.Files) != 2 {
+		t.Fatal("Incorrect number of files: ", m.Files)
+	}
+	if f := m.Files[0]; f.Path != filepath.Join("café", "été:1") || f.LocalPath != filepath.Join("café", "été_1") {
+		t.Errorf("Incorrect path %q or local path %q", f.Path, f.LocalPath)
+	}
+	if f := m.Files[0]; len(f.RawPath) != 2 || f.RawPath[1] != "\xe9t\xe9:1" {
+		t.Errorf("Incorrect raw path %q", f.RawPath)
+	}
+	if f := m.Files[1]; f.Path != filepath.Join("café", "legacyé") {
+		t.Errorf("Legacy encoded path not transcoded: %q", f.Path)
+	}
+}
+
+func TestParseMetainfoUnsafeNames(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         "dir",
+		"piece length": 16,
+		"pieces":       strings.Repeat("a", 20),
+		"files": []map[string]interface{}{
+			{"length": 4, "path": []string{"Foo"}},
+			{"length": 4, "path": []string{"foo"}},
+			{"length": 4, "path": []string{"aux.c"}},
+			{"length": 4, "path": []string{strings.Repeat("z", 300) + ".bin"}},
+		},
+	}
+	data, err := bencode.EncodeBytes(map[string]interface{}{"info": info})
+	if err != nil {
+		t.Fatal("Failed to encode torrent: ", err)
+	}
+
+	m, err := ParseMetainfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Failed to parse metainfo: ", err)
+	}
+	expected := []string{
+		filepath.Join("dir", "Foo"),
+		filepath.Join("dir", "foo (1)"),
+		filepath.Join("dir", "aux_.c"),
+		filepath.Join("dir", strings.Repeat("z", maxNameLength-4)+".bin"),
+	}
+	for i, f := range m.Files {
+		if f.LocalPath != expected[i] {
+			t.Errorf("File %d: expected local path %q, got %q", i, expected[i], f.LocalPath)
+		}
+	}
+	if m.Files[2].Path != filepath.Join("dir", "aux.c") {
+		t.Errorf("Torrent path changed: %q", m.Files[2].Path)
+	}
+}
@@ -0,0 +1,144 @@
+package metainfo
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/torrance/libtorrent/merkle"
+	"golang.org/x/text/encoding"
+	"sort"
+	"strings"
+)
+
+// parseFileTree flattens a v2 file tree into a list of files, in the order
+// given by the sorted keys of the tree. Paths are relative to the torrent.
+func parseFileTree(tree map[string]interface{}, dir []string, dec *encoding.Decoder, entries *[]fileEntry) error {
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		node, ok := tree[key].(map[string]interface{})
+		if !ok {
+			return validationError(ErrFileTree, "'%s' is not a dictionary", strings.Join(append(dir, key), "/"))
+		}
+
+		// A key of "" marks a file, and its value describes the file
+		if key == "" {
+			if len(dir) == 0 {
+				return validationError(ErrFileTree, "file with no path")
+			}
+			length, _ := node["length"].(int64)
+			root, _ := node["pieces root"].(string)
+			attr, _ := node["attr"].(string)
+			var symlink []string
+			if list, ok := node["symlink path"].([]interface{}); ok {
+				for _, item := range list {
+					component, _ := item.(string)
+					symlink = append(symlink, component)
+				}
+			}
+			rawPath := make([]string, len(dir))
+			copy(rawPath, dir)
+			*entries = append(*entries, fileEntry{
+				path:       decodePath(rawPath, nil, dec),
+				rawPath:    rawPath,
+				length:     length,
+				piecesRoot: []byte(root),
+				attr:       attr,
+				symlink:    decodePath(symlink, nil, dec),
+			})
+			continue
+		}
+
+		if err := parseFileTree(node, append(dir, key), dec, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// v2Pieces checks each file's pieces root and piece layer, and returns the
+// hash of every piece in the torrent. Files no larger than a piece have a
+// single piece whose hash is the pieces root. Larger files must have a piece
+// layer that hashes to the pieces root. The piece length must already have
+// been checked.
+func v2Pieces(entries []fileEntry, pieceLength int64, layers map[string]string) (pieces [][]byte, err error) {
+	blocksPerPiece := int(pieceLength / merkle.BlockSize)
+
+	for _, e := range entries {
+		if e.length == 0 {
+			continue
+		}
+		if len(e.piecesRoot) != merkle.HashSize {
+			err = validationError(ErrPiecesRoot, "'%s'", strings.Join(e.path, "/"))
+			return
+		}
+		if e.length <= pieceLength {
+			pieces = append(pieces, e.piecesRoot)
+			continue
+		}
+
+		layer := layers[string(e.piecesRoot)]
+		count := (e.length + pieceLength - 1) / pieceLength
+		if int64(len(layer)) != count*merkle.HashSize {
+			err = validationError(ErrPieceLayers, "'%s' has %d bytes of piece layer, expected %d", strings.Join(e.path, "/"), len(layer), count*merkle.HashSize)
+			return
+		}
+		hashes := make([][]byte, count)
+		for i := range hashes {
+			hashes[i] = []byte(layer[i*merkle.HashSize : (i+1)*merkle.HashSize])
+		}
+		if !bytes.Equal(merkle.LayerRoot(hashes, blocksPerPiece), e.piecesRoot) {
+			err = validationError(ErrPieceLayers, "'%s' piece layer does not match its pieces root", strings.Join(e.path, "/"))
+			return
+		}
+		pieces = append(pieces, hashes...)
+	}
+	return
+}
+
+// alignFiles inserts padding after each file that does not end on a piece
+// boundary, as v2 starts every file at the beginning of a piece.
+func alignFiles(entries []fileEntry, pieceLength int64) (aligned []fileEntry) {
+	for i, e := range entries {
+		aligned = append(aligned, e)
+		if i == len(entries)-1 || e.length%pieceLength == 0 {
+			continue
+		}
+		padLength := pieceLength - e.length%pieceLength
+		padPath := []string{".pad", fmt.Sprintf("%d", padLength)}
+		aligned = append(aligned, fileEntry{
+			path:    padPath,
+			rawPath: padPath,
+			length:  padLength,
+			pad:     true,
+		})
+	}
+	return
+}
+
+// matchHybrid checks that a hybrid torrent's v1 file list, ignoring padding,
+// holds exactly the files of its v2 file tree with the same lengths, so that
+// v1 and v2 peers see the same content. It copies the pieces roots across.
+func matchHybrid(v1, v2 []fileEntry) error {
+	byPath := make(map[string]int)
+	for i, e := range v1 {
+		if !e.pad {
+			byPath[strings.Join(e.path, "/")] = i
+		}
+	}
+	if len(byPath) != len(v2) {
+		return validationError(ErrHybrid, "%d v1 files, %d v2 files", len(byPath), len(v2))
+	}
+	for _, e := range v2 {
+		path := strings.Join(e.path, "/")
+		i, ok := byPath[path]
+		if !ok || v1[i].length != e.length {
+			return validationError(ErrHybrid, "'%s'", path)
+		}
+		v1[i].piecesRoot = e.piecesRoot
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package metainfo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"github.com/torrance/libtorrent/merkle"
+	"github.com/zeebo/bencode"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+const v2PieceLength = 2 * merkle.BlockSize
+
+type v2TestFile struct {
+	name string
+	data []byte
+}
+
+// encodeV2Torrent builds a v2 torrent in directory "dir". If hybrid is true the
+// torrent also has v1 metadata, with pad files aligning each file to a piece.
+func encodeV2Torrent(t *testing.T, files []v2TestFile, hybrid bool) (data []byte, layers map[string]string) {
+	tree := make(map[string]interface{})
+	layers = make(map[string]string)
+	var v1Files []map[string]interface{}
+	var v1Data []byte
+
+	for i, f := range files {
+		leaves := merkle.Leaves(f.data)
+		root := merkle.FileRoot(leaves)
+		tree[f.name] = map[string]interface{}{
+			"": map[string]interface{}{"length": len(f.data), "pieces root": string(root)},
+		}
+		if len(f.data) > v2PieceLength {
+			var layer []byte
+			for _, h := range merkle.PieceLayer(leaves, v2PieceLength/merkle.BlockSize) {
+				layer = append(layer, h...)
+			}
+			layers[string(root)] = string(layer)
+		}
+
+		v1Files = append(v1Files, map[string]interface{}{"length": len(f.data), "path": []string{f.name}})
+		v1Data = append(v1Data, f.data...)
+		if pad := len(f.data) % v2PieceLength; pad != 0 && i != len(files)-1 {
+			padLength := v2PieceLength - pad
+			v1Files = append(v1Files, map[string]interface{}{"length": padLength, "path": []string{".pad", "x"}, "attr": "p"})
+			v1Data = append(v1Data, make([]byte, padLength)...)
+		}
+	}
+
+	info := map[string]interface{}{
+		"name":         "dir",
+		"piece length": v2PieceLength,
+		"meta version": 2,
+		"file tree":    tree,
+	}
+	if hybrid {
+		var pieces []byte
+		for offset := 0; offset < len(v1Data); offset += v2PieceLength {
+			end := offset + v2PieceLength
+			if end > len(v1Data) {
+				end = len(v1Data)
+			}
+			h := sha1.Sum(v1Data[offset:end])
+			pieces = append(pieces, h[:]...)
+		}
+		info["files"] = v1Files
+		info["pieces"] = string(pieces)
+	}
+
+	data, err := bencode.EncodeBytes(map[string]interface{}{"info": info, "piece layers": layers})
+	if err != nil {
+		t.Fatal("Failed to encode torrent: ", err)
+	}
+	return
+}
+
+func randomData(length int) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(int64(length))).Read(data)
+	return data
+}
+
+func TestParseMetainfoV2(t *testing.T) {
+	small := randomData(1000)
+	large := randomData(3*v2PieceLength + 5)
+	data, _ := encodeV2Torrent(t, []v2TestFile{{"a", small}, {"b", large}}, false)
+
+	m, err := ParseMetainfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Failed to parse metainfo: ", err)
+	}
+	if m.MetaVersion != 2 || m.Hybrid {
+		t.Error("Incorrect meta version or hybrid: ", m.MetaVersion, m.Hybrid)
+	}
+
+	// The small file has one piece and the large file four
+	if m.PieceCount != 5 || len(m.Pieces[0]) != merkle.HashSize {
+		t.Fatal("Incorrect pieces: ", m.PieceCount)
+	}
+	if !bytes.Equal(m.Pieces[0], merkle.FileRoot(merkle.Leaves(small))) {
+		t.Error("Small file piece hash should be its pieces root")
+	}
+	if !bytes.Equal(m.Pieces[4], merkle.Root(merkle.Leaves(large[3*v2PieceLength:]), 0, 2)) {
+		t.Error("Incorrect piece layer hash for the last piece")
+	}
+
+	// The small file is padded so that the large file starts on a piece boundary
+	if len(m.Files) != 3 {
+		t.Fatal("Incorrect files: ", m.Files)
+	}
+	if f := m.Files[0]; f.Path != filepath.Join("dir", "a") || f.Length != 1000 || f.Pad {
+		t.Error("Incorrect first file: ", f)
+	}
+	if f := m.Files[1]; !f.Pad || f.Length != v2PieceLength-1000 || f.LocalPath != "" {
+		t.Error("Incorrect padding: ", f)
+	}
+	if f := m.Files[2]; f.Path != filepath.Join("dir", "b") || !bytes.Equal(f.PiecesRoot, merkle.FileRoot(merkle.Leaves(large))) {
+		t.Error("Incorrect second file: ", f)
+	}
+
+	h := sha256.Sum256(m.RawInfo)
+	if !bytes.Equal(m.InfoHashV2, h[:]) || !bytes.Equal(m.InfoHash, h[:20]) {
+		t.Error("Incorrect infohashes: ", m.InfoHash, m.InfoHashV2)
+	}
+
+	// Piece layers survive re-encoding
+	buf := new(bytes.Buffer)
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatal("Failed to write metainfo: ", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("Re-encoded v2 torrent differs from the original")
+	}
+}
+
+func TestParseMetainfoSingleFileV2(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         "a.txt",
+		"piece length": v2PieceLength,
+		"meta version": 2,
+		"file tree": map[string]interface{}{
+			"a.txt": map[string]interface{}{
+				"": map[string]interface{}{"length": 10, "pieces root": string(merkle.HashBlock(make([]byte, 10)))},
+			},
+		},
+	}
+	data, err := bencode.EncodeBytes(map[string]interface{}{"info": info})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseMetainfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Failed to parse metainfo: ", err)
+	}
+	if len(m.Files) != 1 || m.Files[0].Path != "a.txt" {
+		t.Error("Incorrect files: ", m.Files)
+	}
+}
+
+func TestParseMetainfoHybrid(t *testing.T) {
+	data, _ := encodeV2Torrent(t, []v2TestFile{{"a", randomData(1000)}, {"b", randomData(3 * v2PieceLength)}}, true)
+	m, err := ParseMetainfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Failed to parse metainfo: ", err)
+	}
+	if m.MetaVersion != 2 || !m.Hybrid {
+		t.Error("Incorrect meta version or hybrid: ", m.MetaVersion, m.Hybrid)
+	}
+
+	// Hybrid torrents use their v1 pieces and infohash
+	if m.PieceCount != 4 || len(m.Pieces[0]) != 20 {
+		t.Error("Incorrect pieces: ", m.PieceCount)
+	}
+	h1 := sha1.Sum(m.RawInfo)
+	h2 := sha256.Sum256(m.RawInfo)
+	if !bytes.Equal(m.InfoHash, h1[:]) || !bytes.Equal(m.InfoHashV2, h2[:]) {
+		t.Error("Incorrect infohashes: ", m.InfoHash, m.InfoHashV2)
+	}
+	if len(m.Files) != 3 || len(m.Files[0].PiecesRoot) != merkle.HashSize || len(m.Files[2].PiecesRoot) != merkle.HashSize {
+		t.Error("Pieces roots not matched to v1 files: ", m.Files)
+	}
+}
+
+func TestParseMetainfoV2Invalid(t *testing.T) {
+	encode := func(info map[string]interface{}, layers map[string]string) []byte {
+		data, err := bencode.EncodeBytes(map[string]interface{}{"info": info, "piece layers": layers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	large := randomData(3 * v2PieceLength)
+	root := string(merkle.FileRoot(merkle.Leaves(large)))
+	fileTree := func(root string) map[string]interface{} {
+		return map[string]interface{}{
+			"b": map[string]interface{}{"": map[string]interface{}{"length": len(large), "pieces root": root}},
+		}
+	}
+	badLayer := make([]byte, 3*merkle.HashSize)
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"meta version", encode(map[string]interface{}{"name": "d", "piece length": v2PieceLength, "meta version": 3}, nil), ErrMetaVersion},
+		{"piece length", encode(map[string]interface{}{"name": "d", "piece length": 20000, "meta version": 2, "file tree": fileTree(root)}, nil), ErrPieceLength},
+		{"no root", encode(map[string]interface{}{"name": "d", "piece length": v2PieceLength, "meta version": 2, "file tree": fileTree("short")}, nil), ErrPiecesRoot},
+		{"no layer", encode(map[string]interface{}{"name": "d", "piece length": v2PieceLength, "meta version": 2, "file tree": fileTree(root)}, nil), ErrPieceLayers},
+		{"bad layer", encode(map[string]interface{}{"name": "d", "piece length": v2PieceLength, "meta version": 2, "file tree": fileTree(root)}, map[string]string{root: string(badLayer)}), ErrPieceLayers},
+		{"file tree", encode(map[string]interface{}{"name": "d", "piece length": v2PieceLength, "meta version": 2, "file tree": map[string]interface{}{"a": 1}}, nil), ErrFileTree},
+		{"dot dot", encode(map[string]interface{}{"name": "d", "piece length": v2PieceLength, "meta version": 2, "file tree": map[string]interface{}{"..": fileTree(root), "c": fileTree(root)}}, nil), ErrInvalidPath},
+	}
+	for _, test := range tests {
+		if _, err := ParseMetainfo(bytes.NewReader(test.data)); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	// A hybrid torrent whose v1 files differ from its v2 files is rejected
+	data, _ := encodeV2Torrent(t, []v2TestFile{{"a", randomData(1000)}, {"b", large}}, true)
+	var torrent map[string]interface{}
+	if err := bencode.DecodeBytes(data, &torrent); err != nil {
+		t.Fatal(err)
+	}
+	info := torrent["info"].(map[string]interface{})
+	info["files"].([]interface{})[0].(map[string]interface{})["length"] = int64(999)
+	data, err := bencode.EncodeBytes(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseMetainfo(bytes.NewReader(data)); !errors.Is(err, ErrHybrid) {
+		t.Errorf("Expected %v, got %v", ErrHybrid, err)
+	}
+
+	// As is one with a v1 file missing from its v2 file tree
+	info["files"].([]interface{})[0].(map[string]interface{})["length"] = int64(1000)
+	info["files"] = append(info["files"].([]interface{}), map[string]interface{}{"length": int64(1), "path": []interface{}{"extra"}})
+	if data, err = bencode.EncodeBytes(torrent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseMetainfo(bytes.NewReader(data)); !errors.Is(err, ErrHybrid) {
+		t.Errorf("Expected %v for an extra v1 file, got %v", ErrHybrid, err)
+	}
+}
@@ -0,0 +1,109 @@
+package metainfo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Reasons a torrent can fail validation. ParseMetainfo wraps these in a
+// *ValidationError, which may be compared with errors.Is.
+var (
+	ErrMissingInfo   = errors.New("missing info dictionary")
+	ErrPieces        = errors.New("pieces length is not a multiple of 20")
+	ErrPieceLength   = errors.New("piece length must be positive")
+	ErrPieceCount    = errors.New("piece count does not match total length")
+	ErrFileLength    = errors.New("file length is negative or too large")
+	ErrInvalidPath   = errors.New("invalid path")
+	ErrDuplicatePath = errors.New("duplicate path")
+	ErrMetaVersion   = errors.New("unsupported meta version")
+	ErrFileTree      = errors.New("malformed file tree")
+	ErrPiecesRoot    = errors.New("missing or invalid pieces root")
+	ErrPieceLayers   = errors.New("missing or invalid piece layer")
+	ErrHybrid        = errors.New("v1 and v2 file lists differ")
+	ErrSymlink       = errors.New("invalid symlink")
+)
+
+type ValidationError struct {
+	Err    error  // One of the Err* values above
+	Detail string // What was being validated when the error occurred
+}
+
+func (e *ValidationError) Error() string {
+	if e.Detail == "" {
+		return "Metainfo file malformed: " + e.Err.Error()
+	}
+	return fmt.Sprintf("Metainfo file malformed: %s: %s", e.Err, e.Detail)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func validationError(err error, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Err: err, Detail: fmt.Sprintf(format, args...)}
+}
+
+// validateName checks a single path component taken from a torrent. Anything
+// that could escape the download directory is rejected. Names that are merely
+// awkward on some filesystems are left for safeName to map.
+func validateName(name string) error {
+	switch {
+	case name == "":
+		return validationError(ErrInvalidPath, "empty path component")
+	case name == "." || name == "..":
+		return validationError(ErrInvalidPath, "path component '%s'", name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return validationError(ErrInvalidPath, "path component '%s' contains a separator or NUL", name)
+	}
+	return nil
+}
+
+// validatePaths checks every component of each file path, and that no two
+// files share a path or have one file where another needs a directory. Paths
+// that differ only by case are distinct here; localPaths keeps them apart on
+// disk.
+func validatePaths(paths [][]string) error {
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, path := range paths {
+		if len(path) == 0 {
+			return validationError(ErrInvalidPath, "file with no path")
+		}
+		for _, name := range path {
+			if err := validateName(name); err != nil {
+				return err
+			}
+		}
+
+		key := strings.Join(path, "/")
+		if files[key] || dirs[key] {
+			return validationError(ErrDuplicatePath, "'%s'", key)
+		}
+		files[key] = true
+		for i := 1; i < len(path); i++ {
+			dir := strings.Join(path[:i], "/")
+			if files[dir] {
+				return validationError(ErrDuplicatePath, "'%s' is both a file and a directory", dir)
+			}
+			dirs[dir] = true
+		}
+	}
+	return nil
+}
+
+// validatePieces checks the piece length and that there is exactly one piece
+// hash for each piece of data.
+func validatePieces(pieceLength int64, pieceCount int, totalLength int64) error {
+	if pieceLength <= 0 {
+		return validationError(ErrPieceLength, "%d", pieceLength)
+	}
+	expected := totalLength / pieceLength
+	if totalLength%pieceLength != 0 {
+		expected++
+	}
+	if int64(pieceCount) != expected {
+		return validationError(ErrPieceCount, "have %d pieces, expected %d", pieceCount, expected)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package metainfo
+
+import (
+	"bytes"
+	"errors"
+	"github.com/zeebo/bencode"
+	"math"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	length int64
+	path   []string
+}
+
+func file(length int64, path ...string) testFile {
+	return testFile{length, path}
+}
+
+// encodeTorrent builds a multi file torrent with the given files.
+func encodeTorrent(t *testing.T, name string, pieceLength int64, pieces int, files ...testFile) []byte {
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       strings.Repeat("a", pieces*20),
+	}
+	var list []map[string]interface{}
+	for _, f := range files {
+		list = append(list, map[string]interface{}{"length": f.length, "path": f.path})
+	}
+	info["files"] = list
+
+	data, err := bencode.EncodeBytes(map[string]interface{}{"info": info})
+	if err != nil {
+		t.Fatal("Failed to encode torrent: ", err)
+	}
+	return data
+}
+
+func TestValidateMetainfo(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"valid", encodeTorrent(t, "dir", 16, 2, file(10, "a"), file(10, "b", "c")), nil},
+		{"no info", []byte("d8:announce3:fooe"), ErrMissingInfo},
+		{"zero piece length", encodeTorrent(t, "dir", 0, 0, file(10, "a")), ErrPieceLength},
+		{"too few pieces", encodeTorrent(t, "dir", 16, 1, file(20, "a")), ErrPieceCount},
+		{"too many pieces", encodeTorrent(t, "dir", 16, 3, file(20, "a")), ErrPieceCount},
+		{"negative length", encodeTorrent(t, "dir", 16, 1, file(-1, "a"), file(17, "b")), ErrFileLength},
+		{"total overflow", encodeTorrent(t, "dir", 16, 0, file(1<<62, "a"), file(1<<62, "b"), file(1<<62, "c"), file(1<<62, "d")), ErrFileLength},
+		{"maximum length", encodeTorrent(t, "dir", 16, 0, file(math.MaxInt64, "a")), ErrPieceCount},
+		{"dot dot", encodeTorrent(t, "dir", 16, 1, file(10, "..", "etc", "passwd")), ErrInvalidPath},
+		{"dot dot name", encodeTorrent(t, "..", 16, 1, file(10, "a")), ErrInvalidPath},
+		{"empty component", encodeTorrent(t, "dir", 16, 1, file(10, "a", "", "b")), ErrInvalidPath},
+		{"no path", encodeTorrent(t, "dir", 16, 1, file(10)), ErrInvalidPath},
+		{"separator", encodeTorrent(t, "dir", 16, 1, file(10, "a/../../b")), ErrInvalidPath},
+		{"absolute", encodeTorrent(t, "/etc", 16, 1, file(10, "passwd")), ErrInvalidPath},
+		{"backslash", encodeTorrent(t, "dir", 16, 1, file(10, "..\\b")), ErrInvalidPath},
+		{"case only", encodeTorrent(t, "dir", 16, 2, file(10, "a"), file(10, "A")), nil},
+		{"duplicate", encodeTorrent(t, "dir", 16, 2, file(10, "a"), file(10, "a")), ErrDuplicatePath},
+		{"file and dir", encodeTorrent(t, "dir", 16, 2, file(10, "a"), file(10, "a", "b")), ErrDuplicatePath},
+		{"dir and file", encodeTorrent(t, "dir", 16, 2, file(10, "a", "b"), file(10, "a")), ErrDuplicatePath},
+		{"reserved", encodeTorrent(t, "dir", 16, 1, file(10, "con")), nil},
+		{"reserved extension", encodeTorrent(t, "dir", 16, 1, file(10, "LPT1.txt")), nil},
+		{"too long", encodeTorrent(t, "dir", 16, 1, file(10, strings.Repeat("x", 256))), nil},
+	}
+
+	for _, test := range tests {
+		_, err := ParseMetainfo(bytes.NewReader(test.data))
+		if test.err == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		if _, ok := err.(*ValidationError); !ok {
+			t.Errorf("%s: expected *ValidationError, got %T", test.name, err)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"a", "console", "file.con", "..a", "a..", "aux.c", strings.Repeat("x", 300)} {
+		if err := validateName(name); err != nil {
+			t.Errorf("Unexpected error for '%s': %s", name, err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package libtorrent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/torrance/libtorrent/filestore"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Policies for files already at the destination of MoveStorage.
+const (
+	MoveFailIfExists    = iota // Move nothing if any of our files is already there, downloaded or not
+	MoveReplaceExisting        // Replace files already there with ours
+	MoveKeepExisting           // Use files already there in place of ours
+)
+
+// MoveEvent reports the progress of MoveStorage. The last event has Done set.
+type MoveEvent struct {
+	File  string // The file being moved, as a path within the torrent
+	Moved int64  // Bytes moved so far, of Total
+	Total int64
+	Err   error // Why File could not be moved, or with Done, why the move failed
+	Done  bool
+}
+
+// sendMoveEvent reports ev unless the channel is full. Any send that could
+// block must not be made while the receive loop is paused.
+func sendMoveEvent(events chan<- MoveEvent, ev MoveEvent) {
+	select {
+	case events <- ev:
+	default:
+	}
+}
+
+// storagePause asks the receive loop to finish its disk jobs and then wait,
+// doing nothing, until resume is closed.
+type storagePause struct {
+	ready  chan struct{}
+	resume chan struct{}
+}
+
+// RootDirectory returns the directory the torrent's files are stored in.
+func (t *Torrent) RootDirectory() string {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.rootDirectory
+}
+
+// MoveStorage moves the torrent's files, part file and symlinks to the same
+// paths within newRoot, where they are kept from then on. Files are renamed
+// if they can be and copied otherwise, such as between filesystems. A running
+// torrent stops reading and writing while its files are moved. Files already
+// at the destination are dealt with according to policy; data kept with
+// MoveKeepExisting is not checked, so the torrent should be rechecked after.
+//
+// Progress is reported on the returned channel, which is closed after the
+// last event. The torrent does not wait for the channel to be read, so
+// progress and per-file errors are dropped whenever it is full; only the last
+// event, with Done set, is always delivered. If a file cannot be moved, those
+// already moved are moved back and the torrent stays where it was. If the
+// files will not fit in newRoot, nothing is moved and the move fails with an
+// *InsufficientSpaceError. Only torrents stored on disk under their Config's
+// RootDirectory can be moved.
+func (t *Torrent) MoveStorage(newRoot string, policy int) <-chan MoveEvent {
+	events := make(chan MoveEvent, 16)
+	go func() {
+		err := t.moveStorage(newRoot, policy, events)
+		if err != nil {
+			logger.Error("Failed to move %s to %s: %s", t.meta.Name, newRoot, err)
+		}
+		events <- MoveEvent{Err: err, Done: true}
+		close(events)
+	}()
+	return events
+}
+
+func (t *Torrent) moveStorage(newRoot string, policy int, events chan<- MoveEvent) (err error) {
+	if t.partFile == nil {
+		return errors.New(fmt.Sprintf("%s is not stored under a root directory", t.meta.Name))
+	}
+	oldRoot := t.RootDirectory()
+	if filepath.Clean(newRoot) == filepath.Clean(oldRoot) {
+		return
+	}
+	if err = os.MkdirAll(newRoot, 0755); err != nil {
+		return
+	}
+
+	if t.State() != Stopped {
+		pause := &storagePause{ready: make(chan struct{}), resume: make(chan struct{})}
+		t.readChan <- peerDouble{msg: pause}
+		<-pause.ready
+		defer close(pause.resume)
+	} else if err = t.diskQueue.Flush(t.fileStore); err != nil {
+		return
+	}
+
+	plan, total, err := t.planMove(newRoot, policy, events)
+	if err != nil {
+		return
+	}
+	if stat, statErr := t.partFile.Stat(); statErr == nil {
+		total += stat.Size()
+	}
+	if err = t.checkMoveSpace(newRoot, policy); err != nil {
+		return
+	}
+
+	if err = t.fileStore.Close(); err != nil {
+		return
+	}
+
+	var moved int64
+	progress := func(file string) func(n int64) {
+		return func(n int64) {
+			moved += n
+			sendMoveEvent(events, MoveEvent{File: file, Moved: moved, Total: total})
+		}
+	}
+	var done []fileMove
+	rollback := func() {
+		for j := len(done) - 1; j >= 0; j-- {
+			if backErr := t.undoMove(done[j], oldRoot, newRoot); backErr != nil {
+				sendMoveEvent(events, MoveEvent{File: t.meta.Files[done[j].index].Path, Err: backErr})
+			}
+		}
+	}
+	for _, fm := range plan {
+		lf := t.lazyFiles[fm.index]
+		path := t.meta.Files[fm.index].Path
+		switch fm.action {
+		case moveKept:
+			err = lf.Relocate(newRoot)
+		case moveReplaced:
+			dst := filepath.Join(newRoot, t.meta.Files[fm.index].LocalPath)
+			if err = os.Rename(dst, fm.aside); err != nil {
+				break
+			}
+			if err = lf.Move(newRoot, progress(path)); err != nil {
+				os.Rename(fm.aside, dst)
+			}
+		default:
+			err = lf.Move(newRoot, progress(path))
+		}
+		if err != nil {
+			sendMoveEvent(events, MoveEvent{File: path, Err: err})
+			rollback()
+			return
+		}
+		done = append(done, fm)
+	}
+	partName := t.partFileName()
+	if err = t.partFile.Move(filepath.Join(newRoot, partName), progress(partName)); err != nil {
+		sendMoveEvent(events, MoveEvent{File: partName, Err: err})
+		rollback()
+		return
+	}
+
+	// Symlinks are remade rather than moved, as they are relative to
+	// the root directory
+	for _, file := range t.meta.Files {
+		if file.SymlinkTarget == "" {
+			continue
+		}
+		if linkErr := filestore.NewSymlink(newRoot, file.LocalPath, file.SymlinkTarget); linkErr != nil {
+			sendMoveEvent(events, MoveEvent{File: file.Path, Err: linkErr})
+			continue
+		}
+		os.Remove(filepath.Join(oldRoot, file.LocalPath))
+	}
+	// What was put aside is only let go once nothing can be undone
+	for _, fm := range done {
+		switch fm.action {
+		case moveKept:
+			os.Remove(filepath.Join(oldRoot, t.meta.Files[fm.index].LocalPath))
+		case moveReplaced:
+			os.Remove(fm.aside)
+		}
+	}
+	for _, file := range t.meta.Files {
+		removeEmptyDirs(oldRoot, file.LocalPath)
+	}
+
+	t.stateLock.Lock()
+	t.rootDirectory = newRoot
+	t.stateLock.Unlock()
+	logger.Info("Moved %s to %s", t.meta.Name, newRoot)
+	return
+}
+
+// How MoveStorage deals with each file, recorded so that a failed move can be
+// undone.
+const (
+	moveMoved    = iota // Ours moved, if on disk
+	moveKept            // Theirs used, and ours removed once the move succeeds
+	moveReplaced        // Theirs put aside, and removed once the move succeeds
+)
+
+type fileMove struct {
+	index  int
+	action int
+	aside  string // Where theirs is put aside, for moveReplaced
+}
+
+// planMove decides how each file is to be moved to newRoot under policy, and
+// the total bytes to be moved. Any file of ours that is already in newRoot,
+// whether or not we have it on disk, is a conflict.
+func (t *Torrent) planMove(newRoot string, policy int, events chan<- MoveEvent) (plan []fileMove, total int64, err error) {
+	for i, lf := range t.lazyFiles {
+		if lf == nil {
+			continue
+		}
+		fm := fileMove{index: i, action: moveMoved}
+		var size int64
+		if stat, statErr := os.Stat(lf.Path()); statErr == nil {
+			size = stat.Size()
+		}
+		dst := filepath.Join(newRoot, t.meta.Files[i].LocalPath)
+		if _, statErr := os.Lstat(dst); statErr == nil {
+			switch policy {
+			case MoveFailIfExists:
+				err = errors.New(fmt.Sprintf("%s already exists in %s", t.meta.Files[i].Path, newRoot))
+				sendMoveEvent(events, MoveEvent{File: t.meta.Files[i].Path, Err: err})
+				return
+			case MoveKeepExisting:
+				fm.action = moveKept
+				size = 0
+			default:
+				fm.action = moveReplaced
+				fm.aside = dst + ".replaced"
+				if _, statErr = os.Lstat(fm.aside); statErr == nil {
+					err = errors.New(fmt.Sprintf("Cannot put %s aside, %s already exists", dst, fm.aside))
+					return
+				}
+			}
+		}
+		total += size
+		plan = append(plan, fm)
+	}
+	return
+}
+
+// undoMove moves a file back to oldRoot, restoring whatever was in newRoot
+// before.
+func (t *Torrent) undoMove(fm fileMove, oldRoot string, newRoot string) (err error) {
+	lf := t.lazyFiles[fm.index]
+	switch fm.action {
+	case moveKept:
+		return lf.Relocate(oldRoot)
+	case moveReplaced:
+		if err = lf.Move(oldRoot, func(int64) {}); err != nil {
+			return
+		}
+		return os.Rename(fm.aside, filepath.Join(newRoot, t.meta.Files[fm.index].LocalPath))
+	}
+	return lf.Move(oldRoot, func(int64) {})
+}
+
+// removeEmptyDirs removes the directories of path within root that have been
+// left empty.
+func removeEmptyDirs(root string, path string) {
+	root = filepath.Clean(root)
+	for dir := filepath.Dir(filepath.Join(root, path)); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
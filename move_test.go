@@ -0,0 +1,214 @@
+package libtorrent
+
+import (
+	"bytes"
+	"github.com/torrance/libtorrent/metainfo"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// drainMove collects the events of a move, returning the final event.
+func drainMove(events <-chan MoveEvent) (progress []MoveEvent, last MoveEvent) {
+	for ev := range events {
+		if ev.Done {
+			last = ev
+		} else {
+			progress = append(progress, ev)
+		}
+	}
+	return
+}
+
+func TestMoveStorage(t *testing.T) {
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-movemovemove", true)
+	defer cleanup()
+	tor.Start()
+	oldRoot := tor.RootDirectory()
+
+	newRoot, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(newRoot)
+	newRoot = filepath.Join(newRoot, "archive")
+
+	progress, last := drainMove(tor.MoveStorage(newRoot, MoveFailIfExists))
+	if last.Err != nil {
+		t.Fatal("Move failed: ", last.Err)
+	}
+	if len(progress) == 0 || progress[len(progress)-1].Moved != tor.meta.Files[0].Length || progress[len(progress)-1].Total != tor.meta.Files[0].Length {
+		t.Errorf("Incorrect progress: %v", progress)
+	}
+	if tor.RootDirectory() != newRoot {
+		t.Error("Root directory not updated: ", tor.RootDirectory())
+	}
+	if _, err = os.Stat(filepath.Join(oldRoot, "test.txt")); !os.IsNotExist(err) {
+		t.Error("File left behind in the old root directory")
+	}
+
+	// The torrent carries on from the new location
+	if ok, err := tor.fileStore.ValidatePiece(0); !ok || err != nil {
+		t.Error("Moved file failed validation: ", err)
+	}
+	if tor.State() != Seeding {
+		t.Errorf("Torrent has state %d after moving, expected Seeding", tor.State())
+	}
+}
+
+func TestMoveStorageConflicts(t *testing.T) {
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-moveconflict", true)
+	defer cleanup()
+	oldRoot := tor.RootDirectory()
+
+	newRoot, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(newRoot)
+	theirs := filepath.Join(newRoot, "test.txt")
+	if err = ioutil.WriteFile(theirs, []byte("theirs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, last := drainMove(tor.MoveStorage(newRoot, MoveFailIfExists)); last.Err == nil {
+		t.Error("Move over an existing file succeeded")
+	}
+	if tor.RootDirectory() != oldRoot {
+		t.Error("Failed move changed the root directory")
+	}
+	if data, _ := ioutil.ReadFile(theirs); string(data) != "theirs" {
+		t.Error("Failed move replaced an existing file")
+	}
+
+	if _, last := drainMove(tor.MoveStorage(newRoot, MoveKeepExisting)); last.Err != nil {
+		t.Fatal("Move keeping existing files failed: ", last.Err)
+	}
+	if data, _ := ioutil.ReadFile(theirs); string(data) != "theirs" {
+		t.Error("Existing file replaced despite the policy")
+	}
+	if _, err = os.Stat(filepath.Join(oldRoot, "test.txt")); !os.IsNotExist(err) {
+		t.Error("Our copy left behind in the old root directory")
+	}
+}
+
+func TestMoveStorageRollback(t *testing.T) {
+	content, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(content)
+	files := map[string][]byte{
+		filepath.Join("a", "1"): bytes.Repeat([]byte("1"), 20000),
+		filepath.Join("b", "2"): bytes.Repeat([]byte("2"), 20000),
+	}
+	for path, data := range files {
+		os.MkdirAll(filepath.Join(content, filepath.Dir(path)), 0755)
+		ioutil.WriteFile(filepath.Join(content, path), data, 0644)
+	}
+	b := metainfo.NewBuilder(content)
+	b.PieceLength = 16384
+	buf := new(bytes.Buffer)
+	if _, err = b.WriteTo(buf); err != nil {
+		t.Fatal("Failed to build torrent: ", err)
+	}
+	m, err := metainfo.ParseMetainfo(buf)
+	if err != nil {
+		t.Fatal("Failed to parse torrent: ", err)
+	}
+	name := filepath.Base(content)
+	seeded := make(map[string][]byte)
+	for path, data := range files {
+		seeded[filepath.Join(name, path)] = data
+	}
+
+	for _, policy := range []int{MoveReplaceExisting, MoveKeepExisting} {
+		tor, _, cleanup := newTestTorrentFromMeta(t, m, "-LT0000-moverollback", seeded)
+		tor.Start()
+		oldRoot := tor.RootDirectory()
+		newRoot, err := ioutil.TempDir("", "libtorrentTesting")
+		if err != nil {
+			t.Fatal("Could not create temporary directory to run tests: ", err)
+		}
+
+		// The first file is already there, and the second cannot be moved
+		theirs := filepath.Join(newRoot, name, "a", "1")
+		os.MkdirAll(filepath.Dir(theirs), 0755)
+		ioutil.WriteFile(theirs, []byte("theirs"), 0644)
+		ioutil.WriteFile(filepath.Join(newRoot, name, "b"), nil, 0644)
+
+		if _, last := drainMove(tor.MoveStorage(newRoot, policy)); last.Err == nil {
+			t.Fatalf("Policy %d: move succeeded despite a file that cannot be moved", policy)
+		}
+		if tor.RootDirectory() != oldRoot {
+			t.Errorf("Policy %d: failed move changed the root directory", policy)
+		}
+		if data, _ := ioutil.ReadFile(theirs); string(data) != "theirs" {
+			t.Errorf("Policy %d: existing file not restored, got %d bytes", policy, len(data))
+		}
+		if _, err = os.Stat(theirs + ".replaced"); !os.IsNotExist(err) {
+			t.Errorf("Policy %d: existing file left aside", policy)
+		}
+		for path, data := range seeded {
+			if ours, _ := ioutil.ReadFile(filepath.Join(oldRoot, path)); !bytes.Equal(ours, data) {
+				t.Errorf("Policy %d: %s not restored", policy, path)
+			}
+		}
+		if ok, err := tor.fileStore.ValidatePiece(0); !ok || err != nil {
+			t.Errorf("Policy %d: torrent not using its own files after rollback: %v", policy, err)
+		}
+		cleanup()
+		os.RemoveAll(newRoot)
+	}
+}
+
+func TestMoveStorageConflictNotDownloaded(t *testing.T) {
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-moveconflict", false)
+	defer cleanup()
+	oldRoot := tor.RootDirectory()
+
+	newRoot, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(newRoot)
+	ioutil.WriteFile(filepath.Join(newRoot, "test.txt"), []byte("theirs"), 0644)
+
+	// Nothing of ours is on disk, but the file would still be used
+	if _, last := drainMove(tor.MoveStorage(newRoot, MoveFailIfExists)); last.Err == nil {
+		t.Error("Move over an existing file succeeded")
+	}
+	if tor.RootDirectory() != oldRoot {
+		t.Error("Failed move changed the root directory")
+	}
+}
+
+func TestMoveStorageUnread(t *testing.T) {
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-moveunreadmv", true)
+	defer cleanup()
+	tor.Start()
+
+	newRoot, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(newRoot)
+
+	// A full channel must not hold up the move or the paused torrent
+	full := make(chan MoveEvent, 1)
+	sendMoveEvent(full, MoveEvent{})
+	sendMoveEvent(full, MoveEvent{})
+
+	events := tor.MoveStorage(newRoot, MoveFailIfExists)
+	if !waitFor(time.Second*5, func() bool { return tor.RootDirectory() == newRoot }) {
+		t.Fatal("Move did not finish whilst its events were unread")
+	}
+	if tor.State() != Seeding {
+		t.Errorf("Torrent has state %d after moving, expected Seeding", tor.State())
+	}
+	if _, last := drainMove(events); !last.Done || last.Err != nil {
+		t.Errorf("Incorrect final event: %v", last)
+	}
+}
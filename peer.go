@@ -2,14 +2,26 @@ package libtorrent
 
 import (
 	"github.com/torrance/libtorrent/bitfield"
+	"github.com/torrance/libtorrent/ratelimit"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 	//"testing/iotest"
 )
 
 type peer struct {
 	name           string
-	conn           io.ReadWriter
+	addr           string
+	ip             string
+	outgoing       bool
+	candidateAddr  string // The candidate list entry this connection satisfies, if any
+	connectedAt    time.Time
+	conn           io.ReadWriteCloser
+	reader         io.Reader
+	writer         io.Writer
+	done           chan struct{}
+	closeOnce      sync.Once
 	write          chan binaryDumper
 	read           chan peerDouble
 	amChoking      bool
@@ -18,6 +30,30 @@ type peer struct {
 	peerInterested bool
 	mutex          sync.RWMutex
 	bitf           *bitfield.Bitfield
+	upLimiter      *ratelimit.Limiter
+	downLimiter    *ratelimit.Limiter
+	stats          transferStats
+	parentStats    *transferStats
+}
+
+// transferStats counts bytes moved over peer connections. The total counts
+// include protocol overhead, whilst uploaded and downloaded only count piece data.
+type transferStats struct {
+	uploaded        int64
+	downloaded      int64
+	uploadedTotal   int64
+	downloadedTotal int64
+	hashFailures    int64
+}
+
+type PeerStats struct {
+	Name            string
+	Uploaded        int64
+	Downloaded      int64
+	UploadedTotal   int64
+	DownloadedTotal int64
+	// HashFailures counts the pieces this peer contributed to that failed verification
+	HashFailures int64
 }
 
 type peerDouble struct {
@@ -25,29 +61,59 @@ type peerDouble struct {
 	peer *peer
 }
 
-func newPeer(name string, conn io.ReadWriter, readChan chan peerDouble) (p *peer) {
+// peerClosed is delivered on the read channel exactly once, after the peer's
+// connection has been closed for whatever reason.
+type peerClosed struct{}
+
+// newPeer prepares a peer for conn. Traffic is throttled by the peer's own
+// limiters as well as any supplied torrent or global limiters, and is counted
+// against both the peer and parentStats.
+func newPeer(name string, conn io.ReadWriteCloser, readChan chan peerDouble, parentStats *transferStats, up, down []*ratelimit.Limiter) (p *peer) {
 	p = &peer{
 		name:           name,
 		conn:           conn,
+		connectedAt:    time.Now(),
+		done:           make(chan struct{}),
 		write:          make(chan binaryDumper, 10),
 		read:           readChan,
 		amChoking:      true,
 		amInterested:   false,
 		peerChoking:    true,
 		peerInterested: false,
+		upLimiter:      ratelimit.NewLimiter(0),
+		downLimiter:    ratelimit.NewLimiter(0),
+		parentStats:    parentStats,
 	}
 
+	upLimiters := append([]*ratelimit.Limiter{p.upLimiter}, up...)
+	downLimiters := append([]*ratelimit.Limiter{p.downLimiter}, down...)
+	p.writer = ratelimit.NewWriter(&countingWriter{w: conn, p: p}, upLimiters...)
+	p.reader = ratelimit.NewReader(&countingReader{r: conn, p: p}, downLimiters...)
+	return
+}
+
+// start begins the read and write loops. Messages read are delivered on the
+// peer's read channel.
+func (p *peer) start() {
 	// Write loop
 	go func() {
 		for {
 			//conn := iotest.NewWriteLogger("Writing", conn)
 			// TODO: send regular keep alive requests
-			msg := <-p.write
-			if err := msg.BinaryDump(conn); err != nil {
-				// TODO: Close peer
-				logger.Error("%s Received error writing to connection: %s", p.name, err)
+			var msg binaryDumper
+			select {
+			case msg = <-p.write:
+			case <-p.done:
 				return
 			}
+			if err := msg.BinaryDump(p.writer); err != nil {
+				logger.Debug("%s Received error writing to connection: %s", p.name, err)
+				p.Close()
+				return
+			}
+			if msg, ok := msg.(*pieceMessage); ok {
+				p.addUploaded(int64(len(msg.data)))
+			}
 		}
 	}()
 
@@ -55,21 +121,50 @@ func newPeer(name string, conn io.ReadWriter, readChan chan peerDouble) (p *peer
 	go func() {
 		for {
 			//conn := iotest.NewReadLogger("Reading", conn)
-			msg, err := parsePeerMessage(conn)
+			msg, err := parsePeerMessage(p.reader)
 
 			if _, ok := err.(unknownMessage); ok {
 				// Log unknown messages and then ignore
 				logger.Info(err.Error())
 			} else if err != nil {
-				// TODO: Close peer
 				logger.Debug("%s Received error reading connection: %s", p.name, err)
-				break
+				p.Close()
+				p.read <- peerDouble{msg: &peerClosed{}, peer: p}
+				return
+			}
+			if msg, ok := msg.(*pieceMessage); ok {
+				p.addDownloaded(int64(len(msg.data)))
 			}
-			readChan <- peerDouble{msg: msg, peer: p}
+			p.read <- peerDouble{msg: msg, peer: p}
 		}
 	}()
+}
 
-	return
+// Send queues msg to be written to the peer. Messages sent after the peer has
+// closed are dropped.
+func (p *peer) Send(msg binaryDumper) {
+	select {
+	case p.write <- msg:
+	case <-p.done:
+	}
+}
+
+// Close shuts down the connection. It is safe to call more than once.
+func (p *peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.conn.Close()
+	})
+}
+
+// closed reports whether Close has been called.
+func (p *peer) closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
 }
 
 func (p *peer) GetAmChoking() (b bool) {
@@ -85,6 +180,26 @@ func (p *peer) SetAmChoking(b bool) {
 	p.mutex.Unlock()
 }
 
+func (p *peer) GetAmInterested() (b bool) {
+	p.mutex.RLock()
+	b = p.amInterested
+	p.mutex.RUnlock()
+	return
+}
+
+func (p *peer) SetAmInterested(b bool) {
+	p.mutex.Lock()
+	p.amInterested = b
+	p.mutex.Unlock()
+}
+
+func (p *peer) GetPeerChoking() (b bool) {
+	p.mutex.RLock()
+	b = p.peerChoking
+	p.mutex.RUnlock()
+	return
+}
+
 func (p *peer) SetPeerChoking(b bool) {
 	p.mutex.Lock()
 	p.peerChoking = b
@@ -110,8 +225,81 @@ func (p *peer) SetBitfield(bitf *bitfield.Bitfield) {
 	p.mutex.Unlock()
 }
 
+func (p *peer) Bitfield() (bitf *bitfield.Bitfield) {
+	p.mutex.RLock()
+	bitf = p.bitf
+	p.mutex.RUnlock()
+	return
+}
+
 func (p *peer) HasPiece(index int) {
 	p.mutex.Lock()
 	p.bitf.SetTrue(index)
 	p.mutex.Unlock()
 }
+
+func (p *peer) Has(index int) (b bool) {
+	p.mutex.RLock()
+	b = p.bitf.Get(index)
+	p.mutex.RUnlock()
+	return
+}
+
+func (p *peer) SetUploadLimit(rate int64) {
+	p.upLimiter.SetRate(rate)
+}
+
+func (p *peer) SetDownloadLimit(rate int64) {
+	p.downLimiter.SetRate(rate)
+}
+
+func (p *peer) addUploaded(n int64) {
+	atomic.AddInt64(&p.stats.uploaded, n)
+	atomic.AddInt64(&p.parentStats.uploaded, n)
+}
+
+func (p *peer) addDownloaded(n int64) {
+	atomic.AddInt64(&p.stats.downloaded, n)
+	atomic.AddInt64(&p.parentStats.downloaded, n)
+}
+
+func (p *peer) addHashFailure() {
+	atomic.AddInt64(&p.stats.hashFailures, 1)
+}
+
+func (p *peer) Stats() PeerStats {
+	return PeerStats{
+		Name:            p.name,
+		Uploaded:        atomic.LoadInt64(&p.stats.uploaded),
+		Downloaded:      atomic.LoadInt64(&p.stats.downloaded),
+		UploadedTotal:   atomic.LoadInt64(&p.stats.uploadedTotal),
+		DownloadedTotal: atomic.LoadInt64(&p.stats.downloadedTotal),
+		HashFailures:    atomic.LoadInt64(&p.stats.hashFailures),
+	}
+}
+
+// countingWriter and countingReader sit directly on the connection so that
+// every byte, including message headers, is accounted for.
+type countingWriter struct {
+	w io.Writer
+	p *peer
+}
+
+func (cw *countingWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.w.Write(b)
+	atomic.AddInt64(&cw.p.stats.uploadedTotal, int64(n))
+	atomic.AddInt64(&cw.p.parentStats.uploadedTotal, int64(n))
+	return
+}
+
+type countingReader struct {
+	r io.Reader
+	p *peer
+}
+
+func (cr *countingReader) Read(b []byte) (n int, err error) {
+	n, err = cr.r.Read(b)
+	atomic.AddInt64(&cr.p.stats.downloadedTotal, int64(n))
+	atomic.AddInt64(&cr.p.parentStats.downloadedTotal, int64(n))
+	return
+}
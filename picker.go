@@ -0,0 +1,194 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/bitfield"
+)
+
+const (
+	blockSize = 16384
+	// The number of block requests we keep outstanding with each peer
+	maxPeerRequests = 10
+)
+
+// pieceDownload tracks the blocks of a piece that is in the middle of being downloaded.
+type pieceDownload struct {
+	index     int
+	length    int64
+	requested []*peer  // The peer each block was requested from, or nil
+	received  []bool   // Whether each block has arrived
+	sources   []string // The IP address each block was received from
+	remaining int
+	writing   int // Blocks received but not yet written
+}
+
+func newPieceDownload(index int, length int64) *pieceDownload {
+	n := int((length + blockSize - 1) / blockSize)
+	return &pieceDownload{
+		index:     index,
+		length:    length,
+		requested: make([]*peer, n),
+		received:  make([]bool, n),
+		sources:   make([]string, n),
+		remaining: n,
+	}
+}
+
+func (pd *pieceDownload) blockLength(block int) int64 {
+	if block == len(pd.received)-1 && pd.length%blockSize != 0 {
+		return pd.length % blockSize
+	}
+	return blockSize
+}
+
+// piecePicker decides which blocks to request from which peers. It is only
+// accessed from the torrent's receive loop.
+type piecePicker struct {
+	pieceLength func(index int) int64
+	priorities  func() []int // The priority of every piece, or nil if all are normal
+	downloads   map[int]*pieceDownload
+}
+
+func newPiecePicker(pieceLength func(index int) int64, priorities func() []int) *piecePicker {
+	return &piecePicker{
+		pieceLength: pieceLength,
+		priorities:  priorities,
+		downloads:   make(map[int]*pieceDownload),
+	}
+}
+
+func (pp *piecePicker) priority(priorities []int, index int) int {
+	if priorities == nil {
+		return PriorityNormal
+	}
+	return priorities[index]
+}
+
+// outstanding returns the number of blocks requested from p that have not yet arrived.
+func (pp *piecePicker) outstanding(p *peer) (n int) {
+	for _, pd := range pp.downloads {
+		for i, q := range pd.requested {
+			if q == p && !pd.received[i] {
+				n++
+			}
+		}
+	}
+	return
+}
+
+// pick returns up to n block requests for p. Pieces already in progress are
+// finished first, after which new pieces are started in order of priority,
+// rarest first. Pieces with priority PrioritySkip are never picked.
+func (pp *piecePicker) pick(p *peer, peerHas *bitfield.Bitfield, tally swarmTally, n int) (reqs []*requestMessage) {
+	if n <= 0 {
+		return
+	}
+
+	request := func(pd *pieceDownload) {
+		for i := range pd.requested {
+			if len(reqs) >= n {
+				return
+			}
+			if pd.requested[i] != nil || pd.received[i] {
+				continue
+			}
+			pd.requested[i] = p
+			reqs = append(reqs, &requestMessage{
+				pieceIndex:  uint32(pd.index),
+				blockOffset: uint32(i * blockSize),
+				blockLength: uint32(pd.blockLength(i)),
+			})
+		}
+	}
+
+	var priorities []int
+	if pp.priorities != nil {
+		priorities = pp.priorities()
+	}
+
+	for _, pd := range pp.downloads {
+		if peerHas.Get(pd.index) && pp.priority(priorities, pd.index) != PrioritySkip {
+			request(pd)
+		}
+	}
+
+	for len(reqs) < n {
+		// A tally of -1 means we already have the piece
+		rarest, rarestPriority := -1, PrioritySkip
+		for i, count := range tally {
+			if count <= 0 || !peerHas.Get(i) {
+				continue
+			}
+			if _, ok := pp.downloads[i]; ok {
+				continue
+			}
+			priority := pp.priority(priorities, i)
+			if priority == PrioritySkip {
+				continue
+			}
+			if rarest == -1 || priority > rarestPriority || (priority == rarestPriority && count < tally[rarest]) {
+				rarest, rarestPriority = i, priority
+			}
+		}
+		if rarest == -1 {
+			break
+		}
+		pd := newPieceDownload(rarest, pp.pieceLength(rarest))
+		pp.downloads[rarest] = pd
+		request(pd)
+	}
+	return
+}
+
+// received records that a block has arrived from p, who must have been asked
+// for it. It returns the piece's download state, or nil if the block was
+// unsolicited and should be discarded.
+func (pp *piecePicker) received(p *peer, ip string, index int, offset int64, length int) *pieceDownload {
+	pd, ok := pp.downloads[index]
+	if !ok || offset%blockSize != 0 {
+		return nil
+	}
+	block := int(offset / blockSize)
+	if block >= len(pd.requested) || pd.requested[block] != p || pd.received[block] {
+		return nil
+	}
+	if int64(length) != pd.blockLength(block) {
+		return nil
+	}
+	pd.received[block] = true
+	pd.sources[block] = ip
+	pd.remaining--
+	return pd
+}
+
+// cancelPeer releases every outstanding request made to p, so that the blocks
+// can be requested from someone else.
+func (pp *piecePicker) cancelPeer(p *peer) {
+	for _, pd := range pp.downloads {
+		for i, q := range pd.requested {
+			if q == p && !pd.received[i] {
+				pd.requested[i] = nil
+			}
+		}
+	}
+}
+
+// restore resumes a piece from a previous session, of which the blocks set in
+// received are already in storage. Their sources are unknown.
+func (pp *piecePicker) restore(index int, received *bitfield.Bitfield) {
+	pd := newPieceDownload(index, pp.pieceLength(index))
+	for i := range pd.received {
+		if received.Get(i) {
+			pd.received[i] = true
+			pd.remaining--
+		}
+	}
+	if pd.remaining > 0 && pd.remaining < len(pd.received) {
+		pp.downloads[index] = pd
+	}
+}
+
+// finished removes a piece from the set of pieces in progress, whether it
+// passed or failed verification.
+func (pp *piecePicker) finished(index int) {
+	delete(pp.downloads, index)
+}
@@ -0,0 +1,93 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/bitfield"
+	"testing"
+)
+
+func TestPickerRarestFirst(t *testing.T) {
+	pp := newPiecePicker(func(index int) int64 { return blockSize * 2 }, nil)
+	tally := swarmTally{3, 1, -1, 2}
+
+	peerHas := bitfield.NewBitfield(4)
+	for i := 0; i < 4; i++ {
+		peerHas.SetTrue(i)
+	}
+
+	p := &peer{}
+	reqs := pp.pick(p, peerHas, tally, 3)
+	if len(reqs) != 3 {
+		t.Fatalf("Expected 3 requests, got: %d", len(reqs))
+	}
+	// Piece 1 is rarest, then piece 3. Piece 2 we already have.
+	if reqs[0].pieceIndex != 1 || reqs[1].pieceIndex != 1 || reqs[2].pieceIndex != 3 {
+		t.Errorf("Pieces not requested rarest first: %d %d %d", reqs[0].pieceIndex, reqs[1].pieceIndex, reqs[2].pieceIndex)
+	}
+	if reqs[1].blockOffset != blockSize || reqs[1].blockLength != blockSize {
+		t.Errorf("Incorrect second block request: %+v", reqs[1])
+	}
+	if pp.outstanding(p) != 3 {
+		t.Errorf("Incorrect outstanding count, got: %d", pp.outstanding(p))
+	}
+}
+
+func TestPickerReceivedAndCancel(t *testing.T) {
+	pp := newPiecePicker(func(index int) int64 { return blockSize + 100 }, nil)
+	tally := swarmTally{1}
+	peerHas := bitfield.NewBitfield(1)
+	peerHas.SetTrue(0)
+
+	p1, p2 := &peer{}, &peer{}
+	reqs := pp.pick(p1, peerHas, tally, 10)
+	if len(reqs) != 2 || reqs[1].blockLength != 100 {
+		t.Fatalf("Incorrect requests for short final block: %v", reqs)
+	}
+
+	// Blocks from peers we didn't ask are discarded
+	if pd := pp.received(p2, "10.0.0.2", 0, 0, blockSize); pd != nil {
+		t.Error("Accepted block from peer that was not asked for it")
+	}
+	pd := pp.received(p1, "10.0.0.1", 0, 0, blockSize)
+	if pd == nil || pd.remaining != 1 || pd.sources[0] != "10.0.0.1" {
+		t.Fatal("Requested block not recorded")
+	}
+
+	// Once p1 is cancelled its remaining block is available to p2
+	pp.cancelPeer(p1)
+	reqs = pp.pick(p2, peerHas, tally, 10)
+	if len(reqs) != 1 || reqs[0].blockOffset != blockSize {
+		t.Fatalf("Cancelled block not reassigned: %v", reqs)
+	}
+	if pd = pp.received(p2, "10.0.0.2", 0, blockSize, 100); pd == nil || pd.remaining != 0 {
+		t.Error("Final block not recorded")
+	}
+}
+
+func TestPickerPriorities(t *testing.T) {
+	priorities := []int{PriorityNormal, PrioritySkip, PriorityHigh, PriorityLow}
+	pp := newPiecePicker(func(index int) int64 { return blockSize }, func() []int { return priorities })
+	tally := swarmTally{2, 1, 3, 1}
+
+	peerHas := bitfield.NewBitfield(4)
+	for i := 0; i < 4; i++ {
+		peerHas.SetTrue(i)
+	}
+
+	p := &peer{}
+	reqs := pp.pick(p, peerHas, tally, 10)
+	if len(reqs) != 3 {
+		t.Fatalf("Expected 3 requests, got: %d", len(reqs))
+	}
+	// Highest priority first regardless of rarity, and skipped pieces never
+	if reqs[0].pieceIndex != 2 || reqs[1].pieceIndex != 0 || reqs[2].pieceIndex != 3 {
+		t.Errorf("Pieces not requested by priority: %d %d %d", reqs[0].pieceIndex, reqs[1].pieceIndex, reqs[2].pieceIndex)
+	}
+
+	// Pieces in progress are abandoned once skipped
+	pp.cancelPeer(p)
+	priorities = []int{PrioritySkip, PrioritySkip, PrioritySkip, PriorityLow}
+	reqs = pp.pick(p, peerHas, tally, 10)
+	if len(reqs) != 1 || reqs[0].pieceIndex != 3 {
+		t.Errorf("Skipped pieces in progress were requested: %v", reqs)
+	}
+}
@@ -0,0 +1,199 @@
+package libtorrent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// File priorities. Skipped files are not downloaded and are not created on
+// disk. Their share of any pieces they have in common with wanted files is
+// kept in the torrent's part file. Pieces of higher priority files are
+// downloaded first.
+const (
+	PrioritySkip = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+// priorityChanged is delivered on the read channel, without a peer, when file
+// priorities change so that the receive loop can update our interest in peers.
+type priorityChanged struct{}
+
+// SetFilePriority sets the priority of the file at index in the metainfo's
+// Files. Files that become wanted are created straight away, moving any of
+// their data out of the part file. The torrent is Finished rather than Seeding
+// once every wanted file is complete. While the torrent is running, wanting a
+// skipped file fails with an *InsufficientSpaceError, leaving its priority
+// unchanged, if it will not fit on disk.
+func (t *Torrent) SetFilePriority(index int, priority int) (err error) {
+	if index < 0 || index >= len(t.meta.Files) {
+		return errors.New(fmt.Sprintf("SetFilePriority: no file at index %d", index))
+	}
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return errors.New(fmt.Sprintf("SetFilePriority: invalid priority %d", priority))
+	}
+
+	t.priorityLock.Lock()
+	old := t.filePriorities[index]
+	t.filePriorities[index] = priority
+	t.updatePiecePriorities()
+	t.priorityLock.Unlock()
+
+	// Start checks the space of a stopped torrent
+	if old == PrioritySkip && priority != PrioritySkip && t.State() != Stopped {
+		if err = t.checkSpace(); err != nil {
+			logger.Error("Cannot download %s: %s", t.meta.Files[index].Path, err)
+			t.priorityLock.Lock()
+			t.filePriorities[index] = old
+			t.updatePiecePriorities()
+			t.priorityLock.Unlock()
+			return
+		}
+	}
+
+	if lf := t.lazyFiles[index]; lf != nil {
+		if priority == PrioritySkip {
+			lf.SetPartFile(t.partFile, t.fileOffset(index))
+		} else if t.State() != Stopped {
+			if err = lf.Create(); err != nil {
+				logger.Error("Failed to create file %s: %s", t.meta.Files[index].Path, err)
+				return
+			}
+			t.freePartPieces()
+		}
+	}
+
+	t.updateState()
+	// The receive loop may not be running yet, in which case our interest
+	// is worked out when peers connect.
+	select {
+	case t.readChan <- peerDouble{msg: &priorityChanged{}}:
+	default:
+	}
+	return
+}
+
+func (t *Torrent) FilePriority(index int) (priority int) {
+	t.priorityLock.RLock()
+	priority = t.filePriorities[index]
+	t.priorityLock.RUnlock()
+	return
+}
+
+// updatePiecePriorities gives each piece the highest priority of the files it
+// overlaps. Padding has no priority of its own. The slice is replaced rather
+// than modified, so that snapshots from piecePriorities stay valid. The
+// caller must hold priorityLock.
+func (t *Torrent) updatePiecePriorities() {
+	priorities := make([]int, t.meta.PieceCount)
+	for i, file := range t.meta.Files {
+		if file.Pad {
+			continue
+		}
+		for _, p := range t.filePieces(i) {
+			if t.filePriorities[i] > priorities[p] {
+				priorities[p] = t.filePriorities[i]
+			}
+		}
+	}
+	t.piecePriorityList = priorities
+}
+
+// fileOffset returns the offset of the file at index within the torrent.
+func (t *Torrent) fileOffset(index int) (offset int64) {
+	for _, file := range t.meta.Files[:index] {
+		offset += file.Length
+	}
+	return
+}
+
+// filePieces returns the pieces that hold data of the file at index.
+func (t *Torrent) filePieces(index int) (pieces []int) {
+	length := t.meta.Files[index].Length
+	if length == 0 {
+		return
+	}
+	offset := t.fileOffset(index)
+	last := int((offset + length - 1) / t.meta.PieceLength)
+	for p := int(offset / t.meta.PieceLength); p <= last && p < t.meta.PieceCount; p++ {
+		pieces = append(pieces, p)
+	}
+	return
+}
+
+// freePartPieces releases the part file's slots for pieces that no longer
+// hold data of any file kept in the part file.
+func (t *Torrent) freePartPieces() {
+	if t.partFile == nil {
+		return
+	}
+	needed := make(map[int]bool)
+	for i, lf := range t.lazyFiles {
+		if lf != nil && lf.InPartFile() {
+			for _, p := range t.filePieces(i) {
+				needed[p] = true
+			}
+		}
+	}
+	for _, p := range t.partFile.Pieces() {
+		if !needed[p] {
+			if err := t.partFile.Free(p); err != nil {
+				logger.Error("Failed to free piece %d of part file: %s", p, err)
+			}
+		}
+	}
+}
+
+// piecePriorities returns the priority of every piece. It must not be modified.
+func (t *Torrent) piecePriorities() (priorities []int) {
+	t.priorityLock.RLock()
+	priorities = t.piecePriorityList
+	t.priorityLock.RUnlock()
+	return
+}
+
+// completionState works out whether we are Seeding every piece, Finished
+// with every wanted piece, or still Leeching. A read only torrent missing
+// pieces is Finished, as it cannot download them.
+func (t *Torrent) completionState() int {
+	priorities := t.piecePriorities()
+	t.bitfLock.RLock()
+	defer t.bitfLock.RUnlock()
+
+	if t.bitf.SumTrue() == t.bitf.Length() {
+		return Seeding
+	}
+	if t.config.ReadOnly {
+		return Finished
+	}
+	for i, priority := range priorities {
+		if priority != PrioritySkip && !t.bitf.Get(i) {
+			return Leeching
+		}
+	}
+	return Finished
+}
+
+// updateState moves a running torrent between Leeching, Finished and Seeding.
+// A torrent being rechecked is left alone until the check is done.
+func (t *Torrent) updateState() {
+	state := t.completionState()
+	t.stateLock.Lock()
+	previous := t.state
+	if previous == Stopped || previous == Checking {
+		t.stateLock.Unlock()
+		return
+	}
+	t.state = state
+	t.stateLock.Unlock()
+
+	if previous != state {
+		switch state {
+		case Seeding:
+			logger.Info("Torrent completed: %s", t.meta.Name)
+		case Finished:
+			logger.Info("Torrent finished downloading wanted files: %s", t.meta.Name)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package libtorrent
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/torrance/libtorrent/metainfo"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSetFilePriority(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testData")))
+	defer server.Close()
+
+	// Padding gives each file pieces of its own
+	b := metainfo.NewBuilder(filepath.Join("testData", "multitest"))
+	b.PieceLength = 16384
+	b.PadFiles = true
+	b.WebSeeds = []string{server.URL + "/"}
+	buf := new(bytes.Buffer)
+	if _, err := b.WriteTo(buf); err != nil {
+		t.Fatal("Failed to build torrent: ", err)
+	}
+	m, err := metainfo.ParseMetainfo(buf)
+	if err != nil {
+		t.Fatal("Failed to parse torrent: ", err)
+	}
+
+	tor, _, cleanup := newTestTorrentFromMeta(t, m, "-LT0000-priorityprio", nil)
+	defer cleanup()
+
+	skipped := -1
+	for i, f := range m.Files {
+		if f.Path == filepath.Join("multitest", "test2.txt") {
+			skipped = i
+		}
+	}
+	if skipped == -1 {
+		t.Fatal("test2.txt missing from torrent")
+	}
+	if err := tor.SetFilePriority(skipped, PrioritySkip); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.SetFilePriority(len(m.Files), PriorityHigh); err == nil {
+		t.Error("Accepted priority for a file that does not exist")
+	}
+	if err := tor.SetFilePriority(0, PriorityHigh+1); err == nil {
+		t.Error("Accepted invalid priority")
+	}
+	// test1.txt is padded out to two whole pieces
+	if tor.Left() != 2*16384+36880 {
+		t.Errorf("Incorrect bytes left before download, got: %d", tor.Left())
+	}
+
+	tor.Start()
+	if !waitFor(time.Second*10, func() bool { return tor.State() == Finished }) {
+		t.Fatalf("Download of wanted files did not finish, %d bytes left", tor.Left())
+	}
+	if tor.Left() != 0 {
+		t.Errorf("Incorrect bytes left once finished, got: %d", tor.Left())
+	}
+	for _, name := range []string{"test1.txt", "test3.txt"} {
+		original, _ := ioutil.ReadFile(filepath.Join("testData", "multitest", name))
+		downloaded, _ := ioutil.ReadFile(filepath.Join(tor.config.RootDirectory, "multitest", name))
+		if !bytes.Equal(original, downloaded) {
+			t.Errorf("Downloaded file %s does not match original", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tor.config.RootDirectory, "multitest", "test2.txt")); !os.IsNotExist(err) {
+		t.Error("Skipped file was created: ", err)
+	}
+
+	// Wanting the file again resumes the download
+	if err := tor.SetFilePriority(skipped, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(time.Second*10, func() bool { return tor.State() == Seeding }) {
+		t.Fatalf("Download did not complete, %d bytes left", tor.Left())
+	}
+	checkMultitest(t, tor)
+}
+
+func TestSkippedFilePartFile(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testData")))
+	defer server.Close()
+
+	// Without padding test2.txt shares its first and last pieces with the
+	// files either side of it
+	m := newWebSeedMetainfo(t, server.URL+"/")
+	tor, _, cleanup := newTestTorrentFromMeta(t, m, "-LT0000-partfilepart", nil)
+	defer cleanup()
+
+	skipped := -1
+	for i, f := range m.Files {
+		if f.Path == filepath.Join("multitest", "test2.txt") {
+			skipped = i
+		}
+	}
+	if err := tor.SetFilePriority(skipped, PrioritySkip); err != nil {
+		t.Fatal(err)
+	}
+
+	tor.Start()
+	if !waitFor(time.Second*10, func() bool { return tor.State() == Finished }) {
+		t.Fatalf("Download of wanted files did not finish, %d bytes left", tor.Left())
+	}
+	if _, err := os.Stat(filepath.Join(tor.config.RootDirectory, "multitest", "test2.txt")); !os.IsNotExist(err) {
+		t.Error("Skipped file was created: ", err)
+	}
+	if pieces := tor.partFile.Pieces(); len(pieces) != 2 {
+		t.Errorf("Expected the 2 shared pieces in the part file, got: %v", pieces)
+	}
+	// Shared pieces are complete, so they can be uploaded
+	for _, p := range tor.filePieces(skipped) {
+		if tor.piecePriorities()[p] != PrioritySkip && !tor.hasPiece(p) {
+			t.Errorf("Shared piece %d not complete", p)
+		}
+	}
+
+	// Wanting the file again moves its data out of the part file
+	if err := tor.SetFilePriority(skipped, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(time.Second*10, func() bool { return tor.State() == Seeding }) {
+		t.Fatalf("Download did not complete, %d bytes left", tor.Left())
+	}
+	checkMultitest(t, tor)
+	partPath := filepath.Join(tor.config.RootDirectory, fmt.Sprintf(".%x.parts", m.InfoHash))
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Error("Part file not removed: ", err)
+	}
+}
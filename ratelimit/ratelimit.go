@@ -0,0 +1,183 @@
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// chunkSize is the largest number of bytes a Reader or Writer will move before
+// consulting its limiters again. Keeping this small smooths out bursts.
+const chunkSize = 4096
+
+// Limiter is a token bucket measured in bytes per second. A nil Limiter, or
+// one with a rate of 0, never throttles. The bucket holds at most one second
+// of tokens and may go into debt, in which case subsequent callers wait until
+// the debt has been repaid.
+type Limiter struct {
+	mutex  sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate int64) (l *Limiter) {
+	l = &Limiter{
+		rate:   rate,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+	return
+}
+
+// SetRate adjusts the rate in bytes per second. It is safe to call whilst
+// the limiter is in use.
+func (l *Limiter) SetRate(rate int64) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	l.refill(time.Now())
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.mutex.Unlock()
+}
+
+func (l *Limiter) Rate() (rate int64) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	rate = l.rate
+	l.mutex.Unlock()
+	return
+}
+
+// Take removes n tokens from the bucket and returns how long the caller must
+// wait before the bytes may be considered sent.
+func (l *Limiter) Take(n int) (delay time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate <= 0 {
+		return
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	return
+}
+
+// Must be called with mutex held
+func (l *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last)
+	l.last = now
+	if l.rate <= 0 {
+		l.tokens = 0
+		return
+	}
+	l.tokens += elapsed.Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+}
+
+// debt returns how long until the bucket is out of debt.
+func (l *Limiter) debt() (delay time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate <= 0 {
+		return
+	}
+	l.refill(time.Now())
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	return
+}
+
+// Wait sleeps until none of the limiters is in debt, then takes n tokens from
+// every one of them. Limiters are only charged once the transfer goes ahead, so
+// bytes held back by the tightest limiter do not also put the others into
+// debt and slow down their other users.
+func Wait(n int, limiters ...*Limiter) {
+	for {
+		var delay time.Duration
+		for _, l := range limiters {
+			if d := l.debt(); d > delay {
+				delay = d
+			}
+		}
+		if delay == 0 {
+			break
+		}
+		time.Sleep(delay)
+	}
+	for _, l := range limiters {
+		l.Take(n)
+	}
+}
+
+// Writer throttles writes to the underlying writer through each of its
+// limiters. Everything passing through is counted, so protocol overhead is
+// charged against the limit as well as payload.
+type Writer struct {
+	w        io.Writer
+	limiters []*Limiter
+}
+
+func NewWriter(w io.Writer, limiters ...*Limiter) *Writer {
+	return &Writer{w: w, limiters: limiters}
+}
+
+func (lw *Writer) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		Wait(len(chunk), lw.limiters...)
+
+		var m int
+		m, err = lw.w.Write(chunk)
+		n += m
+		if err != nil {
+			return
+		}
+		p = p[m:]
+	}
+	return
+}
+
+// Reader throttles reads from the underlying reader. Bytes are charged after
+// they have been read, leaving the limiters in debt if necessary.
+type Reader struct {
+	r        io.Reader
+	limiters []*Limiter
+}
+
+func NewReader(r io.Reader, limiters ...*Limiter) *Reader {
+	return &Reader{r: r, limiters: limiters}
+}
+
+func (lr *Reader) Read(p []byte) (n int, err error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err = lr.r.Read(p)
+	if n > 0 {
+		Wait(n, lr.limiters...)
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestLimiterTake(t *testing.T) {
+	l := NewLimiter(1000)
+
+	// The bucket starts full, so the first second's worth is free
+	if d := l.Take(1000); d != 0 {
+		t.Errorf("Expected no delay on full bucket, got: %s", d)
+	}
+
+	// Going 500 bytes into debt should cost roughly half a second
+	if d := l.Take(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("Incorrect delay after overdrawing bucket, got: %s", d)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var l *Limiter
+	if d := l.Take(1 << 30); d != 0 {
+		t.Errorf("Nil limiter returned delay: %s", d)
+	}
+
+	l = NewLimiter(0)
+	if d := l.Take(1 << 30); d != 0 {
+		t.Errorf("Zero rate limiter returned delay: %s", d)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	l := NewLimiter(0)
+	l.SetRate(100)
+	if l.Rate() != 100 {
+		t.Errorf("Rate not updated, got: %d", l.Rate())
+	}
+	if d := l.Take(200); d < 900*time.Millisecond {
+		t.Errorf("Expected delay of about 1 second after SetRate, got: %s", d)
+	}
+}
+
+func TestWriterThrottles(t *testing.T) {
+	global := NewLimiter(0)
+	local := NewLimiter(200000)
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf, global, local)
+
+	start := time.Now()
+	if _, err := w.Write(make([]byte, 300000)); err != nil {
+		t.Fatal("Write failed: ", err)
+	}
+	elapsed := time.Since(start)
+
+	if buf.Len() != 300000 {
+		t.Errorf("Incorrect number of bytes written: %d", buf.Len())
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Write not throttled to rate, took: %s", elapsed)
+	}
+}
+
+func TestReaderThrottles(t *testing.T) {
+	r := NewReader(bytes.NewReader(make([]byte, 300000)), NewLimiter(200000))
+
+	start := time.Now()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Read failed: ", err)
+	}
+	elapsed := time.Since(start)
+
+	if len(b) != 300000 {
+		t.Errorf("Incorrect number of bytes read: %d", len(b))
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Read not throttled to rate, took: %s", elapsed)
+	}
+}
+
+func TestWaitChargesOnlyOnTransfer(t *testing.T) {
+	shared := NewLimiter(10000)
+	slow := NewLimiter(1000)
+	// Leave slow a second in debt
+	slow.Take(2000)
+
+	done := make(chan struct{})
+	go func() {
+		Wait(4000, slow, shared)
+		close(done)
+	}()
+
+	// Whilst the other transfer waits on slow, shared must not be charged for it
+	time.Sleep(50 * time.Millisecond)
+	if d := shared.Take(9000); d != 0 {
+		t.Errorf("Shared limiter charged for a transfer still waiting, delay: %s", d)
+	}
+	<-done
+}
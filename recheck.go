@@ -0,0 +1,123 @@
+package libtorrent
+
+import (
+	"context"
+	"github.com/torrance/libtorrent/bitfield"
+	"sync/atomic"
+)
+
+// recheckStart asks the receive loop to abandon the pieces in progress and
+// stop requesting blocks, so that storage is left alone while it is checked.
+type recheckStart struct {
+	ready chan struct{}
+}
+
+// recheckDone delivers the result of a recheck to the receive loop. A nil
+// bitfield means the check was cancelled and the old one still stands.
+type recheckDone struct {
+	bitf *bitfield.Bitfield
+}
+
+// ForceRecheck hashes every piece again, in case the files have been changed
+// behind our back. A running torrent stops downloading and is in the Checking
+// state until the check finishes. It returns ctx's error if the check is
+// cancelled, in which case the pieces we have are left as they were. Progress
+// can be followed with CheckProgress.
+func (t *Torrent) ForceRecheck(ctx context.Context) (err error) {
+	running := t.State() != Stopped
+	if running {
+		req := &recheckStart{ready: make(chan struct{})}
+		t.readChan <- peerDouble{msg: req}
+		<-req.ready
+	} else if err = t.diskQueue.Flush(t.fileStore); err != nil {
+		logger.Error("Failed to write cached blocks: %s", err)
+	}
+
+	logger.Info("Rechecking torrent: %s", t.meta.Name)
+	atomic.StoreInt64(&t.checkTotal, int64(t.meta.PieceCount))
+	atomic.StoreInt64(&t.checked, 0)
+	bitf, err := t.fileStore.Check(ctx, func(checked, total int) {
+		atomic.StoreInt64(&t.checked, int64(checked))
+	})
+	if err != nil {
+		logger.Info("Recheck of %s cancelled: %s", t.meta.Name, err)
+	}
+
+	if running {
+		t.readChan <- peerDouble{msg: &recheckDone{bitf: bitf}}
+	} else if bitf != nil {
+		t.setBitfield(bitf)
+	}
+	return
+}
+
+// CheckProgress returns the number of pieces hashed by the current or most
+// recent recheck, and the number of pieces to check.
+func (t *Torrent) CheckProgress() (checked, total int) {
+	return int(atomic.LoadInt64(&t.checked)), int(atomic.LoadInt64(&t.checkTotal))
+}
+
+// beginRecheck is called from the receive loop when a recheck starts. Disk
+// jobs already queued are finished and the cache written out first, so that
+// nothing is written while the files are checked.
+func (t *Torrent) beginRecheck() {
+	t.picker.downloads = make(map[int]*pieceDownload)
+	if err := t.diskQueue.Flush(t.fileStore); err != nil {
+		logger.Error("Failed to write cached blocks: %s", err)
+	}
+	t.stateLock.Lock()
+	t.state = Checking
+	t.stateLock.Unlock()
+}
+
+// endRecheck is called from the receive loop when a recheck finishes. Peers
+// are told about pieces we now have, but cannot be told about pieces we
+// have lost.
+func (t *Torrent) endRecheck(bitf *bitfield.Bitfield) {
+	if bitf != nil {
+		old := t.bitf.Copy()
+		t.setBitfield(bitf)
+		for i := 0; i < bitf.Length(); i++ {
+			if bitf.Get(i) && !old.Get(i) {
+				for _, p := range t.peers() {
+					p.Send(&haveMessage{pieceIndex: uint32(i)})
+				}
+			}
+		}
+	}
+
+	state := t.completionState()
+	t.stateLock.Lock()
+	t.state = state
+	t.stateLock.Unlock()
+
+	for _, ws := range t.webSeedList() {
+		t.updateInterest(ws.peer)
+	}
+	for _, p := range t.peers() {
+		t.updateInterest(p)
+	}
+}
+
+// setBitfield replaces the pieces we have and recounts the swarm's copies of
+// the rest. It must be called from the receive loop, or before the torrent is
+// started.
+func (t *Torrent) setBitfield(bitf *bitfield.Bitfield) {
+	t.bitfLock.Lock()
+	t.bitf = bitf
+	t.verified = nil // Every piece has now been hashed
+	t.bitfLock.Unlock()
+
+	for i := range t.swarmTally {
+		t.swarmTally[i] = 0
+		if bitf.Get(i) {
+			t.swarmTally[i] = -1
+		}
+	}
+	for _, ws := range t.webSeedList() {
+		t.swarmTally.AddBitfield(ws.peer.Bitfield())
+	}
+	for _, p := range t.peers() {
+		t.swarmTally.AddBitfield(p.Bitfield())
+	}
+}
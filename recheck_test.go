@@ -0,0 +1,49 @@
+package libtorrent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestForceRecheck(t *testing.T) {
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-recheckreche", true)
+	defer cleanup()
+	tor.Start()
+	if tor.State() != Seeding {
+		t.Fatal("Seed data did not validate")
+	}
+
+	// Corrupt the first piece behind the torrent's back
+	f, err := os.OpenFile(filepath.Join(tor.config.RootDirectory, "test.txt"), os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("corrupt"), 0)
+	f.Close()
+
+	// A cancelled recheck leaves the pieces we have alone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tor.ForceRecheck(ctx); err != context.Canceled {
+		t.Error("Cancelled recheck did not fail: ", err)
+	}
+	if !waitFor(time.Second, func() bool { return tor.State() == Seeding }) || !tor.hasPiece(0) {
+		t.Error("Cancelled recheck changed the pieces we have")
+	}
+
+	if err := tor.ForceRecheck(context.Background()); err != nil {
+		t.Fatal("Recheck failed: ", err)
+	}
+	if !waitFor(time.Second, func() bool { return tor.State() == Leeching }) {
+		t.Fatal("Torrent still seeding after corrupt piece was rechecked")
+	}
+	if tor.hasPiece(0) || tor.Left() != tor.fileStore.PieceLength(0) || tor.swarmTally[0] != 0 {
+		t.Error("Corrupt piece still marked as had")
+	}
+	if checked, total := tor.CheckProgress(); checked != total || total != tor.meta.PieceCount {
+		t.Errorf("Incorrect progress: %d of %d", checked, total)
+	}
+}
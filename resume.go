@@ -0,0 +1,243 @@
+package libtorrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/torrance/libtorrent/bitfield"
+	"github.com/zeebo/bencode"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	resumeFileFormat  = "libtorrent resume file"
+	resumeFileVersion = 1
+)
+
+// resumeData is saved between sessions so that a torrent can start without
+// rechecking every piece. It is only trusted if every file still has the size
+// and modification time it had when the resume data was written.
+type resumeData struct {
+	FileFormat  string          `bencode:"file-format"`
+	FileVersion int             `bencode:"file-version"`
+	InfoHash    []byte          `bencode:"info-hash"`
+	Pieces      []byte          `bencode:"pieces"`
+	Files       []resumeFile    `bencode:"files"`
+	PartFile    resumeFile      `bencode:"part file"`
+	Partial     []resumePartial `bencode:"partial pieces"`
+	Priorities  []int           `bencode:"file priorities"`
+	Peers       []resumePeer    `bencode:"peers"`
+	Trackers    []string        `bencode:"trackers"`
+	Uploaded    int64           `bencode:"uploaded"`
+	Downloaded  int64           `bencode:"downloaded"`
+}
+
+// resumeFile records a file as it was on disk. Files that did not exist have a
+// size of -1.
+type resumeFile struct {
+	Size  int64 `bencode:"size"`
+	Mtime int64 `bencode:"mtime"` // Nanoseconds since the epoch
+}
+
+// resumePartial records the blocks received of a piece still being downloaded.
+type resumePartial struct {
+	Piece  int    `bencode:"piece"`
+	Blocks []byte `bencode:"blocks"` // A bitfield of received blocks
+}
+
+type resumePeer struct {
+	Addr   string `bencode:"addr"`
+	Source int    `bencode:"source"`
+}
+
+// partialPiecesRequest asks the receive loop, which owns the picker, for the
+// pieces currently being downloaded.
+type partialPiecesRequest struct {
+	reply chan []resumePartial
+}
+
+func statResumeFile(stat os.FileInfo, err error) resumeFile {
+	if err != nil {
+		return resumeFile{Size: -1}
+	}
+	return resumeFile{Size: stat.Size(), Mtime: stat.ModTime().UnixNano()}
+}
+
+// statter is implemented by storage whose files can be checked for changes.
+type statter interface {
+	Stat() (os.FileInfo, error)
+}
+
+// fileStats records the current state on disk of every file, and the part file.
+// Padding and symlinks hold no data and are recorded as empty. If any file's
+// storage cannot be examined, ok is false.
+func (t *Torrent) fileStats() (files []resumeFile, part resumeFile, ok bool) {
+	ok = true
+	files = make([]resumeFile, len(t.meta.Files))
+	for i, tfile := range t.storers {
+		if tfile == nil {
+			continue
+		}
+		if s, statable := tfile.(statter); statable {
+			files[i] = statResumeFile(s.Stat())
+		} else {
+			ok = false
+		}
+	}
+	part = resumeFile{Size: -1}
+	if t.partFile != nil {
+		part = statResumeFile(t.partFile.Stat())
+	}
+	return
+}
+
+// partialPieces returns the received blocks of every piece in progress. It
+// must be called from the receive loop, or before the torrent is started.
+func (t *Torrent) partialPieces() (partial []resumePartial) {
+	for index, pd := range t.picker.downloads {
+		blocks := bitfield.NewBitfield(len(pd.received))
+		for i, received := range pd.received {
+			if received {
+				blocks.SetTrue(i)
+			}
+		}
+		if blocks.SumTrue() > 0 {
+			partial = append(partial, resumePartial{Piece: index, Blocks: blocks.Bytes()})
+		}
+	}
+	return
+}
+
+// WriteResumeData saves the torrent's state so that a later session can be
+// started with NewTorrentFromResume. It is best written once the torrent has
+// stopped writing to disk, as any file modified afterwards forces a recheck.
+func (t *Torrent) WriteResumeData(w io.Writer) (err error) {
+	// Blocks still in the cache would be lost
+	if err = t.diskQueue.Cache().Flush(t.fileStore); err != nil {
+		return
+	}
+
+	var partial []resumePartial
+	if t.State() == Stopped {
+		partial = t.partialPieces()
+	} else {
+		req := &partialPiecesRequest{reply: make(chan []resumePartial, 1)}
+		t.readChan <- peerDouble{msg: req}
+		partial = <-req.reply
+	}
+
+	rd := &resumeData{
+		FileFormat:  resumeFileFormat,
+		FileVersion: resumeFileVersion,
+		InfoHash:    t.meta.InfoHash,
+		Partial:     partial,
+		Trackers:    t.announceList,
+		Uploaded:    t.TotalUploaded(),
+		Downloaded:  t.TotalDownloaded(),
+	}
+	// The bitfield is taken before the files are examined, so that a piece
+	// completed in between leaves the files looking modified
+	t.bitfLock.RLock()
+	rd.Pieces = append([]byte(nil), t.bitf.Bytes()...)
+	t.bitfLock.RUnlock()
+	rd.Files, rd.PartFile, _ = t.fileStats()
+
+	t.priorityLock.RLock()
+	rd.Priorities = append([]int(nil), t.filePriorities...)
+	t.priorityLock.RUnlock()
+
+	for _, pc := range t.candidates.snapshot() {
+		rd.Peers = append(rd.Peers, resumePeer{Addr: pc.addr, Source: pc.source})
+	}
+
+	data, err := bencode.EncodeBytes(rd)
+	if err != nil {
+		return
+	}
+	_, err = w.Write(data)
+	return
+}
+
+func readResumeData(r io.Reader) (rd *resumeData, err error) {
+	rd = new(resumeData)
+	if err = bencode.NewDecoder(r).Decode(rd); err != nil {
+		return nil, err
+	}
+	if rd.FileFormat != resumeFileFormat || rd.FileVersion != resumeFileVersion {
+		return nil, errors.New(fmt.Sprintf("Unsupported resume data: %s version %d", rd.FileFormat, rd.FileVersion))
+	}
+	return
+}
+
+// applyResumeData restores the settings and history saved in rd. It returns
+// the bitfield of pieces we have if the files on disk still match, otherwise
+// nil and the torrent must be rechecked.
+func (t *Torrent) applyResumeData(rd *resumeData) (bitf *bitfield.Bitfield) {
+	if !bytes.Equal(rd.InfoHash, t.meta.InfoHash) {
+		logger.Info("Ignoring resume data for a different torrent: %s", t.meta.Name)
+		return
+	}
+
+	if len(rd.Priorities) == len(t.meta.Files) {
+		for i, priority := range rd.Priorities {
+			if priority >= PrioritySkip && priority <= PriorityHigh {
+				t.filePriorities[i] = priority
+				if priority == PrioritySkip && t.lazyFiles[i] != nil {
+					t.lazyFiles[i].SetPartFile(t.partFile, t.fileOffset(i))
+				}
+			}
+		}
+		t.priorityLock.Lock()
+		t.updatePiecePriorities()
+		t.priorityLock.Unlock()
+	}
+	for _, p := range rd.Peers {
+		if t.sourceAllowed(p.Source) {
+			t.candidates.add(p.Addr, p.Source)
+		}
+	}
+	if len(rd.Trackers) > 0 {
+		t.announceList = rd.Trackers
+	}
+	atomic.StoreInt64(&t.uploadedBefore, rd.Uploaded)
+	atomic.StoreInt64(&t.downloadedBefore, rd.Downloaded)
+
+	files, part, ok := t.fileStats()
+	if !ok {
+		logger.Info("Storage cannot be checked for changes, rechecking: %s", t.meta.Name)
+		return
+	}
+	if len(rd.Files) != len(files) || rd.PartFile != part {
+		logger.Info("Files have changed since resume data was saved, rechecking: %s", t.meta.Name)
+		return
+	}
+	for i := range files {
+		if rd.Files[i] != files[i] {
+			logger.Info("%s has changed since resume data was saved, rechecking", t.meta.Files[i].Path)
+			return
+		}
+	}
+
+	saved, _ := bitfield.ParseBitfield(bytes.NewReader(rd.Pieces))
+	if err := saved.SetLength(t.meta.PieceCount); err != nil {
+		logger.Info("Resume data has the wrong number of pieces, rechecking: %s", t.meta.Name)
+		return
+	}
+	bitf = bitfield.NewBitfield(t.meta.PieceCount)
+	for i := 0; i < t.meta.PieceCount; i++ {
+		if saved.Get(i) {
+			bitf.SetTrue(i)
+		}
+	}
+
+	for _, partial := range rd.Partial {
+		if partial.Piece < 0 || partial.Piece >= t.meta.PieceCount || bitf.Get(partial.Piece) {
+			continue
+		}
+		blocks, _ := bitfield.ParseBitfield(bytes.NewReader(partial.Blocks))
+		t.picker.restore(partial.Piece, blocks)
+	}
+	return
+}
@@ -0,0 +1,122 @@
+package libtorrent
+
+import (
+	"bytes"
+	"github.com/torrance/libtorrent/metainfo"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeDataTrustedWhenFilesUnchanged(t *testing.T) {
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-resumeresume", true)
+	defer cleanup()
+	if tor.bitf.SumTrue() != tor.meta.PieceCount {
+		t.Fatal("Seed data did not validate")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := tor.WriteResumeData(buf); err != nil {
+		t.Fatal("Failed to write resume data: ", err)
+	}
+	resume := buf.Bytes()
+
+	// Corrupt the data without changing the file's size or modification
+	// time. Resume data is trusted, so nothing is rehashed.
+	path := filepath.Join(tor.config.RootDirectory, "test.txt")
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("corrupt"), 0)
+	f.Close()
+	os.Chtimes(path, stat.ModTime(), stat.ModTime())
+
+	resumed, err := NewTorrentFromResume(tor.meta, tor.config, bytes.NewReader(resume))
+	if err != nil {
+		t.Fatal("Failed to create torrent from resume data: ", err)
+	}
+	if resumed.bitf.SumTrue() != tor.meta.PieceCount {
+		t.Error("Resume data not trusted for unchanged files")
+	}
+
+	// Once the modification time changes the torrent is rechecked
+	later := stat.ModTime().Add(time.Second)
+	os.Chtimes(path, later, later)
+	rechecked, err := NewTorrentFromResume(tor.meta, tor.config, bytes.NewReader(resume))
+	if err != nil {
+		t.Fatal("Failed to create torrent from resume data: ", err)
+	}
+	if rechecked.hasPiece(0) || rechecked.bitf.SumTrue() != tor.meta.PieceCount-1 {
+		t.Errorf("Modified file not rechecked, have %d pieces", rechecked.bitf.SumTrue())
+	}
+
+	// Unreadable resume data also falls back to a recheck
+	garbage, err := NewTorrentFromResume(tor.meta, tor.config, strings.NewReader("garbage"))
+	if err != nil {
+		t.Fatal("Failed to create torrent from bad resume data: ", err)
+	}
+	if garbage.hasPiece(0) || garbage.bitf.SumTrue() != tor.meta.PieceCount-1 {
+		t.Error("Bad resume data not rechecked")
+	}
+}
+
+func TestResumeDataRoundTrip(t *testing.T) {
+	// Pieces of several blocks, so that one can be partly downloaded
+	b := metainfo.NewBuilder(filepath.Join("testData", "multitest"))
+	b.PieceLength = 4 * blockSize
+	mbuf := new(bytes.Buffer)
+	if _, err := b.WriteTo(mbuf); err != nil {
+		t.Fatal("Failed to build torrent: ", err)
+	}
+	m, err := metainfo.ParseMetainfo(mbuf)
+	if err != nil {
+		t.Fatal("Failed to parse torrent: ", err)
+	}
+	tor, _, cleanup := newTestTorrentFromMeta(t, m, "-LT0000-roundtriprou", nil)
+	defer cleanup()
+
+	tor.SetFilePriority(0, PriorityHigh)
+	tor.SetFilePriority(2, PrioritySkip)
+	tor.addCandidate("10.0.0.1:6881", SourceTracker)
+	tor.stats.uploaded = 100
+	tor.stats.downloaded = 200
+
+	// Half of a piece has arrived
+	if err := tor.fileStore.WriteBlock(0, 0, make([]byte, blockSize)); err != nil {
+		t.Fatal(err)
+	}
+	pd := newPieceDownload(0, tor.fileStore.PieceLength(0))
+	pd.received[0] = true
+	pd.remaining--
+	tor.picker.downloads[0] = pd
+
+	buf := new(bytes.Buffer)
+	if err := tor.WriteResumeData(buf); err != nil {
+		t.Fatal("Failed to write resume data: ", err)
+	}
+	resumed, err := NewTorrentFromResume(tor.meta, tor.config, buf)
+	if err != nil {
+		t.Fatal("Failed to create torrent from resume data: ", err)
+	}
+
+	if resumed.FilePriority(0) != PriorityHigh || resumed.FilePriority(1) != PriorityNormal || resumed.FilePriority(2) != PrioritySkip {
+		t.Error("File priorities not restored")
+	}
+	if resumed.candidates.Len() != 1 || resumed.candidates.snapshot()[0].addr != "10.0.0.1:6881" {
+		t.Error("Peer candidates not restored")
+	}
+	if resumed.TotalUploaded() != 100 || resumed.TotalDownloaded() != 200 || resumed.Uploaded() != 0 {
+		t.Errorf("Incorrect transfer totals: %d %d", resumed.TotalUploaded(), resumed.TotalDownloaded())
+	}
+	restored, ok := resumed.picker.downloads[0]
+	if !ok || !restored.received[0] || restored.received[1] || restored.remaining != 3 {
+		t.Fatal("Partial piece not restored")
+	}
+}
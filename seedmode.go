@@ -0,0 +1,131 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/bitfield"
+)
+
+// FileError returns the reason file index of a read only torrent could not be
+// opened, such as it being missing or the wrong size. Its pieces are not
+// seeded. It returns nil for files that opened normally.
+func (t *Torrent) FileError(index int) error {
+	if index < 0 || index >= len(t.fileErrors) {
+		return nil
+	}
+	return t.fileErrors[index]
+}
+
+// seedModeBitfield claims every piece without hashing, except those touching
+// files that could not be opened. Pieces are verified as peers ask for them.
+func (t *Torrent) seedModeBitfield() (bitf *bitfield.Bitfield) {
+	logger.Info("Trusting data without hashing in seed mode: %s", t.meta.Name)
+	bitf = bitfield.NewBitfield(t.meta.PieceCount)
+	for i := 0; i < t.meta.PieceCount; i++ {
+		bitf.SetTrue(i)
+	}
+	for i, err := range t.fileErrors {
+		if err != nil {
+			for _, index := range t.filePieces(i) {
+				bitf.SetFalse(index)
+			}
+		}
+	}
+	t.verified = bitfield.NewBitfield(t.meta.PieceCount)
+	return
+}
+
+// pieceVerified is delivered on the read channel, without a peer, when the
+// disk queue has hashed a piece for its first upload in seed mode.
+type pieceVerified struct {
+	index int
+	ok    bool
+	err   error
+}
+
+// pendingUpload is a request waiting for its piece to be verified.
+type pendingUpload struct {
+	peer *peer
+	msg  *requestMessage
+}
+
+// uploadVerified uploads a requested block, first hashing its piece on the
+// disk queue if this is its first upload in seed mode. It must be called from
+// the receive loop.
+func (t *Torrent) uploadVerified(peer *peer, msg *requestMessage) {
+	index := int(msg.pieceIndex)
+	if t.verified == nil || t.verified.Get(index) {
+		t.uploadBlock(peer, msg)
+		return
+	}
+	if t.verifying == nil {
+		t.verifying = make(map[int][]pendingUpload)
+	}
+	waiting, started := t.verifying[index]
+	t.verifying[index] = append(waiting, pendingUpload{peer: peer, msg: msg})
+	if !started {
+		t.verifyPiece(index)
+	}
+}
+
+// verifyPiece hashes a piece we claim to have on the disk queue. The result is
+// delivered back to the receive loop.
+func (t *Torrent) verifyPiece(index int) {
+	t.diskQueue.Hash(t.fileStore, index, func(ok bool, err error) {
+		go func() { t.readChan <- peerDouble{msg: &pieceVerified{index: index, ok: ok, err: err}} }()
+	})
+}
+
+// handlePieceVerified is called from the receive loop when a piece has been
+// hashed in seed mode. A piece that fails is dropped, and the requests waiting
+// for it ignored.
+func (t *Torrent) handlePieceVerified(msg *pieceVerified) {
+	waiting := t.verifying[msg.index]
+	delete(t.verifying, msg.index)
+	if msg.err != nil {
+		logger.Error("Failed to verify piece %d: %s", msg.index, msg.err)
+	}
+	// A recheck meanwhile has hashed every piece already
+	if t.verified != nil && !t.verified.Get(msg.index) {
+		if msg.ok {
+			t.verified.SetTrue(msg.index)
+		} else {
+			logger.Info("Piece %d failed verification in seed mode: %s", msg.index, t.meta.Name)
+			t.losePiece(msg.index)
+		}
+	}
+
+	for _, w := range waiting {
+		if !t.hasPiece(msg.index) || w.peer.GetAmChoking() {
+			logger.Debug("Peer %s has asked for a block (%d, %d, %d), but the piece failed verification", w.peer.name, w.msg.pieceIndex, w.msg.blockOffset, w.msg.blockLength)
+			continue
+		}
+		t.uploadBlock(w.peer, w.msg)
+	}
+}
+
+// losePiece forgets a piece we had. Peers cannot be told, so they are left to
+// have their requests for it ignored. It must be called from the receive loop.
+func (t *Torrent) losePiece(index int) {
+	t.bitfLock.Lock()
+	t.bitf.SetFalse(index)
+	t.bitfLock.Unlock()
+
+	t.swarmTally[index] = 0
+	for _, ws := range t.webSeedList() {
+		if ws.peer.Bitfield().Get(index) {
+			t.swarmTally[index]++
+		}
+	}
+	for _, p := range t.peers() {
+		if p.Bitfield().Get(index) {
+			t.swarmTally[index]++
+		}
+	}
+
+	t.updateState()
+	for _, ws := range t.webSeedList() {
+		t.updateInterest(ws.peer)
+	}
+	for _, p := range t.peers() {
+		t.updateInterest(p)
+	}
+}
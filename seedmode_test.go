@@ -0,0 +1,109 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/metainfo"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newSeedModeTorrent(t *testing.T, config *Config) *Torrent {
+	f, err := os.Open(filepath.Join("testData", "test.txt.torrent"))
+	if err != nil {
+		t.Fatal("Could not open torrent file: ", err)
+	}
+	defer f.Close()
+	m, err := metainfo.ParseMetainfo(f)
+	if err != nil {
+		t.Fatal("Could not parse torrent file: ", err)
+	}
+	config.PeerId = []byte("-LT0000-seedmodeseed")
+	tor, err := NewTorrent(m, config)
+	if err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+	return tor
+}
+
+func TestReadOnlyMissingFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tor := newSeedModeTorrent(t, &Config{RootDirectory: tmpDir, ReadOnly: true})
+	if tor.FileError(0) == nil {
+		t.Error("Missing file not reported")
+	}
+	tor.Start()
+	if tor.State() != Finished {
+		t.Errorf("Read only torrent missing data has state %d, expected Finished", tor.State())
+	}
+	if entries, _ := ioutil.ReadDir(tmpDir); len(entries) != 0 {
+		t.Errorf("Read only torrent created %d files", len(entries))
+	}
+}
+
+func TestReadOnlyShortFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "test.txt")
+	if err = ioutil.WriteFile(path, []byte("short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tor := newSeedModeTorrent(t, &Config{RootDirectory: tmpDir, ReadOnly: true})
+	if tor.FileError(0) == nil {
+		t.Error("Short file not reported")
+	}
+	tor.Start()
+	if data, _ := ioutil.ReadFile(path); string(data) != "short" {
+		t.Error("Read only torrent modified a short file")
+	}
+}
+
+func TestSeedModeVerifiesLazily(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	data, err := ioutil.ReadFile(filepath.Join("testData", "test.txt"))
+	if err != nil {
+		t.Fatal("Could not read test data: ", err)
+	}
+	copy(data, "corrupt")
+	if err = ioutil.WriteFile(filepath.Join(tmpDir, "test.txt"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tor := newSeedModeTorrent(t, &Config{RootDirectory: tmpDir, ReadOnly: true, SeedMode: true})
+	if tor.FileError(0) != nil {
+		t.Fatal("Complete file reported as an error: ", tor.FileError(0))
+	}
+	if !tor.hasPiece(0) || tor.bitf.SumTrue() != tor.meta.PieceCount {
+		t.Fatal("Seed mode did not trust the data")
+	}
+
+	verify := func(index int) {
+		tor.verifyPiece(index)
+		msg := (<-tor.readChan).msg.(*pieceVerified)
+		tor.handlePieceVerified(msg)
+	}
+	verify(1)
+	if !tor.verified.Get(1) || !tor.hasPiece(1) {
+		t.Error("Intact piece failed verification")
+	}
+	verify(0)
+	if tor.verified.Get(0) {
+		t.Error("Corrupt piece passed verification")
+	}
+	if tor.hasPiece(0) || tor.bitf.SumTrue() != tor.meta.PieceCount-1 {
+		t.Error("Corrupt piece still marked as had")
+	}
+}
@@ -0,0 +1,93 @@
+package libtorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+)
+
+// blockRecord remembers who sent a block of a piece that failed verification,
+// along with a hash of the data they sent.
+type blockRecord struct {
+	ip   string
+	hash []byte
+}
+
+// smartBan identifies peers sending corrupt data. When a piece fails its hash
+// check we record the hash of each block and who sent it. Once the piece has
+// been downloaded again and passes, any block whose earlier hash differs from
+// the good data identifies the peer that sent us garbage.
+type smartBan struct {
+	records map[int]map[int][]blockRecord // piece index -> block index -> records
+}
+
+func newSmartBan() *smartBan {
+	return &smartBan{records: make(map[int]map[int][]blockRecord)}
+}
+
+// wants reports whether pieceFailed would record any block of pd, which it
+// cannot for blocks of unknown source.
+func (sb *smartBan) wants(pd *pieceDownload) bool {
+	for _, ip := range pd.sources {
+		if ip != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// tracking reports whether earlier failures of piece index are recorded.
+func (sb *smartBan) tracking(index int) bool {
+	_, ok := sb.records[index]
+	return ok
+}
+
+// pieceFailed records the blocks of a failed piece. getBlock must return the
+// data as it was received.
+func (sb *smartBan) pieceFailed(pd *pieceDownload, getBlock func(offset, length int64) ([]byte, error)) {
+	blocks, ok := sb.records[pd.index]
+	if !ok {
+		blocks = make(map[int][]blockRecord)
+		sb.records[pd.index] = blocks
+	}
+
+	for i, ip := range pd.sources {
+		// Blocks restored from resume data have no known source
+		if ip == "" {
+			continue
+		}
+		data, err := getBlock(int64(i)*blockSize, pd.blockLength(i))
+		if err != nil {
+			logger.Error("Smart ban failed to read block %d of piece %d: %s", i, pd.index, err)
+			continue
+		}
+		h := sha1.Sum(data)
+		blocks[i] = append(blocks[i], blockRecord{ip: ip, hash: h[:]})
+	}
+}
+
+// piecePassed compares the now verified blocks of a piece against any records
+// of earlier failures, returning the IP addresses that sent corrupt blocks.
+func (sb *smartBan) piecePassed(pd *pieceDownload, getBlock func(offset, length int64) ([]byte, error)) (culprits []string) {
+	blocks, ok := sb.records[pd.index]
+	if !ok {
+		return
+	}
+	delete(sb.records, pd.index)
+
+	seen := make(map[string]bool)
+	for i, records := range blocks {
+		data, err := getBlock(int64(i)*blockSize, pd.blockLength(i))
+		if err != nil {
+			logger.Error("Smart ban failed to read block %d of piece %d: %s", i, pd.index, err)
+			continue
+		}
+		h := sha1.Sum(data)
+		for _, r := range records {
+			if !bytes.Equal(r.hash, h[:]) && !seen[r.ip] {
+				seen[r.ip] = true
+				culprits = append(culprits, r.ip)
+			}
+		}
+	}
+	return
+}
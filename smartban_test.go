@@ -0,0 +1,89 @@
+package libtorrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSmartBanIdentifiesCulprit(t *testing.T) {
+	good := bytes.Repeat([]byte{1}, blockSize*3)
+	bad := append([]byte(nil), good...)
+	bad[blockSize+5] = 0xff // Corrupt the second block
+
+	pd := newPieceDownload(7, int64(len(good)))
+	pd.sources = []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+
+	getBlock := func(data []byte) func(offset, length int64) ([]byte, error) {
+		return func(offset, length int64) ([]byte, error) {
+			return data[offset : offset+length], nil
+		}
+	}
+
+	sb := newSmartBan()
+	sb.pieceFailed(pd, getBlock(bad))
+
+	// The piece is downloaded again, this time from a single honest peer
+	pd = newPieceDownload(7, int64(len(good)))
+	pd.sources = []string{"10.0.0.4", "10.0.0.4", "10.0.0.4"}
+	culprits := sb.piecePassed(pd, getBlock(good))
+
+	if len(culprits) != 1 || culprits[0] != "10.0.0.2" {
+		t.Errorf("Incorrect culprits, got: %v", culprits)
+	}
+	if _, ok := sb.records[7]; ok {
+		t.Error("Records not cleared after piece passed")
+	}
+}
+
+func TestSmartBanIgnoresPiecesWithoutFailures(t *testing.T) {
+	pd := newPieceDownload(0, blockSize)
+	pd.sources = []string{"10.0.0.1"}
+	sb := newSmartBan()
+	culprits := sb.piecePassed(pd, func(offset, length int64) ([]byte, error) {
+		return make([]byte, length), nil
+	})
+	if len(culprits) != 0 {
+		t.Errorf("Expected no culprits, got: %v", culprits)
+	}
+}
+
+func TestFailedPieceReadBeforeDownloadingAgain(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	data, err := ioutil.ReadFile(filepath.Join("testData", "test.txt"))
+	if err != nil {
+		t.Fatal("Could not read test data: ", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(tmpDir, "test.txt"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tor := newSeedModeTorrent(t, &Config{RootDirectory: tmpDir, ReadOnly: true})
+
+	pd := newPieceDownload(0, tor.fileStore.PieceLength(0))
+	for i := range pd.sources {
+		pd.sources[i] = "10.0.0.1"
+	}
+	tor.picker.downloads[0] = pd
+	tor.pieceComplete(pd, false, nil)
+	if tor.picker.downloads[0] != pd {
+		t.Fatal("Failed piece downloaded again before its blocks were recorded")
+	}
+
+	msg, ok := (<-tor.readChan).msg.(*pieceRead)
+	if !ok || msg.pd != pd || msg.passed || msg.err != nil {
+		t.Fatalf("Expected blocks of failed piece to be read, got: %+v", msg)
+	}
+	tor.handlePieceRead(msg)
+	if _, ok := tor.picker.downloads[0]; ok {
+		t.Error("Failed piece not released to be downloaded again")
+	}
+	if !tor.smartBan.tracking(0) {
+		t.Error("Blocks of failed piece not recorded")
+	}
+}
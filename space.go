@@ -0,0 +1,102 @@
+package libtorrent
+
+import (
+	"fmt"
+	"github.com/torrance/libtorrent/filestore"
+	"os"
+	"path/filepath"
+)
+
+// freeSpace is replaced in tests.
+var freeSpace = filestore.FreeSpace
+
+// InsufficientSpaceError is returned by Start, SetFilePriority and
+// MoveStorage when the files of a torrent will not fit in the space left on
+// disk.
+type InsufficientSpaceError struct {
+	Path      string
+	Needed    int64
+	Available int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("Not enough space in %s: %d bytes needed, %d available", e.Path, e.Needed, e.Available)
+}
+
+// checkSpace makes sure there is room on disk for the wanted files to grow to
+// their full size. Sparse files count only the space already allocated to
+// them, where the platform can tell. Space that cannot be measured is assumed
+// to be enough. It is checked when the torrent starts, and again whenever more
+// files are wanted.
+func (t *Torrent) checkSpace() error {
+	var needed int64
+	for i, lf := range t.lazyFiles {
+		if lf == nil || t.FilePriority(i) == PrioritySkip {
+			continue
+		}
+		var have int64
+		if stat, err := lf.Stat(); err == nil {
+			have = filestore.AllocatedSize(stat)
+		}
+		if lf.Length() > have {
+			needed += lf.Length() - have
+		}
+	}
+	return t.checkFree(t.RootDirectory(), needed)
+}
+
+// checkMoveSpace makes sure there is room in newRoot for the torrent's files
+// once MoveStorage has moved them there. Files renamed within a filesystem take
+// no more space, but those copied take their full size, holes and all, and
+// wanted files must still be able to grow to theirs.
+func (t *Torrent) checkMoveSpace(newRoot string, policy int) error {
+	same, err := filestore.SameFilesystem(t.RootDirectory(), newRoot)
+	if err != nil {
+		same = false
+	}
+
+	var needed int64
+	for i, lf := range t.lazyFiles {
+		if lf == nil {
+			continue
+		}
+		wanted := t.FilePriority(i) != PrioritySkip
+		// The size of whatever ends up at the destination
+		var size int64
+		dst, dstErr := os.Stat(filepath.Join(newRoot, t.meta.Files[i].LocalPath))
+		if src, srcErr := os.Stat(lf.Path()); srcErr == nil && (dstErr != nil || policy != MoveKeepExisting) {
+			if same {
+				size = filestore.AllocatedSize(src)
+			} else {
+				size = src.Size()
+				needed += size
+			}
+		} else if dstErr == nil && policy == MoveKeepExisting {
+			size = filestore.AllocatedSize(dst)
+		}
+		if wanted && lf.Length() > size {
+			needed += lf.Length() - size
+		}
+	}
+	if stat, err := t.partFile.Stat(); err == nil && !same {
+		needed += stat.Size()
+	}
+	return t.checkFree(newRoot, needed)
+}
+
+// checkFree fails with an *InsufficientSpaceError if needed bytes will not fit
+// in the filesystem holding root.
+func (t *Torrent) checkFree(root string, needed int64) error {
+	if needed <= 0 {
+		return nil
+	}
+	free, err := freeSpace(root)
+	if err != nil {
+		logger.Debug("Unable to check free space for %s: %s", t.meta.Name, err)
+		return nil
+	}
+	if free < needed {
+		return &InsufficientSpaceError{Path: root, Needed: needed, Available: free}
+	}
+	return nil
+}
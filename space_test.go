@@ -0,0 +1,145 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/filestore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStartInsufficientSpace(t *testing.T) {
+	defer func(original func(string) (int64, error)) { freeSpace = original }(freeSpace)
+	freeSpace = func(path string) (int64, error) { return 1000, nil }
+
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-spacespacesp", false)
+	defer cleanup()
+	err := tor.Start()
+	spaceErr, ok := err.(*InsufficientSpaceError)
+	if !ok {
+		t.Fatal("Start did not fail for lack of space: ", err)
+	}
+	if spaceErr.Available != 1000 || spaceErr.Needed != tor.meta.Files[0].Length {
+		t.Errorf("Incorrect error: %s", spaceErr)
+	}
+	if tor.State() != Stopped {
+		t.Error("Torrent started without enough space")
+	}
+	if _, err := os.Stat(filepath.Join(tor.config.RootDirectory, "test.txt")); !os.IsNotExist(err) {
+		t.Error("File created without enough space")
+	}
+
+	// Files already on disk need no more space
+	freeSpace = func(path string) (int64, error) { return 0, nil }
+	seed, _, seedCleanup := newTestTorrent(t, "-LT0000-spacespaces2", true)
+	defer seedCleanup()
+	if err = seed.Start(); err != nil {
+		t.Error("Complete torrent failed to start: ", err)
+	}
+}
+
+func TestSparseFileChecksSpace(t *testing.T) {
+	defer func(original func(string) (int64, error)) { freeSpace = original }(freeSpace)
+
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-spacesparses", false)
+	defer cleanup()
+
+	// A sparse file of full length, as left by an earlier start
+	path := filepath.Join(tor.config.RootDirectory, "test.txt")
+	length := tor.meta.Files[0].Length
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, length); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocated := filestore.AllocatedSize(stat)
+	if allocated >= length {
+		t.Skip("Sparse files are not supported here")
+	}
+
+	freeSpace = func(path string) (int64, error) { return 1000, nil }
+	err = tor.Start()
+	spaceErr, ok := err.(*InsufficientSpaceError)
+	if !ok {
+		t.Fatal("Start did not fail for lack of space to fill a sparse file: ", err)
+	}
+	if spaceErr.Needed != length-allocated {
+		t.Errorf("Incorrect space needed, got %d, expected %d", spaceErr.Needed, length-allocated)
+	}
+}
+
+func TestWantingFileChecksSpace(t *testing.T) {
+	defer func(original func(string) (int64, error)) { freeSpace = original }(freeSpace)
+
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-spacepriorit", false)
+	defer cleanup()
+	if err := tor.SetFilePriority(0, PrioritySkip); err != nil {
+		t.Fatal(err)
+	}
+	tor.Start()
+
+	freeSpace = func(path string) (int64, error) { return 1000, nil }
+	err := tor.SetFilePriority(0, PriorityNormal)
+	if _, ok := err.(*InsufficientSpaceError); !ok {
+		t.Fatal("Wanting a file did not fail for lack of space: ", err)
+	}
+	if tor.FilePriority(0) != PrioritySkip {
+		t.Error("Priority changed without enough space")
+	}
+	if _, err := os.Stat(filepath.Join(tor.config.RootDirectory, "test.txt")); !os.IsNotExist(err) {
+		t.Error("File created without enough space")
+	}
+
+	freeSpace = func(path string) (int64, error) { return 1 << 40, nil }
+	if err = tor.SetFilePriority(0, PriorityNormal); err != nil {
+		t.Error("Wanting a file failed with enough space: ", err)
+	}
+}
+
+func TestMoveStorageChecksSpace(t *testing.T) {
+	defer func(original func(string) (int64, error)) { freeSpace = original }(freeSpace)
+
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-spacemovemov", false)
+	defer cleanup()
+	tor.Start()
+	oldRoot := tor.RootDirectory()
+
+	newRoot, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(newRoot)
+
+	// The file is created sparse, so only its growth is needed if renamed
+	growth := tor.meta.Files[0].Length
+	if stat, err := os.Stat(filepath.Join(oldRoot, "test.txt")); err == nil {
+		growth -= filestore.AllocatedSize(stat)
+	}
+	freeSpace = func(path string) (int64, error) { return growth, nil }
+	_, last := drainMove(tor.MoveStorage(newRoot, MoveFailIfExists))
+	if _, ok := last.Err.(*InsufficientSpaceError); ok {
+		if same, _ := filestore.SameFilesystem(oldRoot, newRoot); same {
+			t.Error("Renaming within a filesystem needed space")
+		}
+	} else if last.Err != nil {
+		t.Fatal("Move failed: ", last.Err)
+	}
+
+	// A wanted file not yet on disk needs its full size
+	os.Remove(filepath.Join(tor.RootDirectory(), "test.txt"))
+	freeSpace = func(path string) (int64, error) { return 0, nil }
+	current := tor.RootDirectory()
+	_, last = drainMove(tor.MoveStorage(filepath.Join(newRoot, "elsewhere"), MoveFailIfExists))
+	spaceErr, ok := last.Err.(*InsufficientSpaceError)
+	if !ok || spaceErr.Needed != tor.meta.Files[0].Length {
+		t.Fatal("Move did not fail for lack of space: ", last.Err)
+	}
+	if tor.RootDirectory() != current {
+		t.Error("Torrent moved without enough space")
+	}
+}
@@ -2,15 +2,21 @@ package libtorrent
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/op/go-logging"
 	"github.com/torrance/libtorrent/bitfield"
 	"github.com/torrance/libtorrent/filestore"
 	"github.com/torrance/libtorrent/metainfo"
+	"github.com/torrance/libtorrent/ratelimit"
 	"github.com/torrance/libtorrent/tracker"
+	"io"
 	"math/rand"
 	"net"
+	"net/url"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,46 +24,185 @@ const (
 	Stopped = iota
 	Leeching
 	Seeding
+	Finished // Every wanted file is complete, but some are skipped
+	Checking // Rechecking every piece, see ForceRecheck
 )
 
 var PeerId = []byte(fmt.Sprintf("libt-%15d", rand.Int63()))[0:20]
 var logger = logging.MustGetLogger("libtorrent")
 
 type Torrent struct {
-	meta             *metainfo.Metainfo
-	fileStore        *filestore.FileStore
-	config           *Config
-	bitf             *bitfield.Bitfield
-	swarm            []*peer
-	incomingPeer     chan *peer
-	incomingPeerAddr chan string
-	swarmTally       swarmTally
-	readChan         chan peerDouble
-	trackers         []*tracker.Tracker
-	state            int
-	stateLock        sync.Mutex
+	meta              *metainfo.Metainfo
+	peerId            []byte
+	key               int32 // Sent with every tracker announce, constant for the torrent's lifetime
+	fileStore         *filestore.FileStore
+	diskQueue         *filestore.DiskQueue
+	config            *Config
+	bitf              *bitfield.Bitfield
+	bitfLock          sync.RWMutex
+	swarm             []*peer
+	swarmLock         sync.RWMutex
+	maxConnections    int
+	dialing           int
+	candidates        *candidateList
+	connManager       *ConnectionManager
+	incomingPeerAddr  chan string
+	swarmTally        swarmTally
+	picker            *piecePicker
+	smartBan          *smartBan
+	bannedIPs         map[string]bool
+	readChan          chan peerDouble
+	trackers          []*tracker.Tracker
+	webSeeds          []*webSeed                // Guarded by swarmLock
+	storers           []filestore.TorrentStorer // Aligned with meta.Files, nil for padding and symlinks
+	lazyFiles         []*filestore.LazyFile     // Likewise, for files stored on disk
+	partFile          *filestore.PartFile       // Holds the parts of skipped files in pieces we want
+	fileErrors        []error                   // Why each file could not be opened, in read only mode
+	verified          *bitfield.Bitfield        // Pieces hashed since starting in seed mode, nil once all are
+	verifying         map[int][]pendingUpload   // Requests waiting on their piece being hashed in seed mode
+	filePriorities    []int
+	piecePriorityList []int
+	priorityLock      sync.RWMutex
+	state             int
+	stateLock         sync.Mutex
+	rootDirectory     string // Where files on disk are kept, guarded by stateLock
+	stats             transferStats
+	uploadedBefore    int64 // Transfer totals from earlier sessions, restored from resume data
+	downloadedBefore  int64
+	announceList      []string
+	checked           int64 // Progress of the current or last recheck
+	checkTotal        int64
+	upLimiter         *ratelimit.Limiter
+	downLimiter       *ratelimit.Limiter
+	peerUpRate        int64
+	peerDownRate      int64
 }
 
 func NewTorrent(m *metainfo.Metainfo, config *Config) (tor *Torrent, err error) {
+	return newTorrent(m, config, nil)
+}
+
+// NewTorrentFromResume creates a torrent using resume data saved by
+// WriteResumeData, which saves rechecking every piece. If the resume data
+// cannot be read, or the files have changed since it was saved, the torrent is
+// rechecked as by NewTorrent.
+func NewTorrentFromResume(m *metainfo.Metainfo, config *Config, resume io.Reader) (tor *Torrent, err error) {
+	rd, err := readResumeData(resume)
+	if err != nil {
+		logger.Info("Failed to read resume data for %s, rechecking: %s", m.Name, err)
+		rd, err = nil, nil
+	}
+	return newTorrent(m, config, rd)
+}
+
+func newTorrent(m *metainfo.Metainfo, config *Config, rd *resumeData) (tor *Torrent, err error) {
 	tor = &Torrent{
 		config:           config,
 		meta:             m,
-		incomingPeer:     make(chan *peer, 100),
 		incomingPeerAddr: make(chan string, 100),
 		readChan:         make(chan peerDouble, 50),
 		state:            Stopped,
+		upLimiter:        ratelimit.NewLimiter(0),
+		downLimiter:      ratelimit.NewLimiter(0),
+		maxConnections:   defaultMaxTorrentConnections,
+		candidates:       newCandidateList(),
+		connManager:      config.ConnectionManager,
+		peerId:           config.PeerId,
+		key:              rand.Int31(),
+		smartBan:         newSmartBan(),
+		bannedIPs:        make(map[string]bool),
+		announceList:     m.AnnounceList,
+		rootDirectory:    config.RootDirectory,
+	}
+	if tor.connManager == nil {
+		tor.connManager = defaultConnectionManager
+	}
+	if tor.peerId == nil {
+		tor.peerId = PeerId
+	} else if len(tor.peerId) != 20 {
+		err = errors.New(fmt.Sprintf("NewTorrent: peer id must be 20 bytes, got %d", len(tor.peerId)))
+		return
 	}
 
 	// Extract file information to create a slice of torrentStorers
-	tfiles := make([]filestore.TorrentStorer, 0)
-	var tfile filestore.TorrentStorer
-	for _, file := range tor.meta.Files {
-		if tfile, err = filestore.NewTorrentFile(tor.config.RootDirectory, file.Path, file.Length); err != nil {
-			logger.Error("Failed to create file %s: %s", file.Path, err)
+	// Part files and symlinks only make sense on disk
+	storage := tor.config.Storage
+	_, disk := storage.(*filestore.DiskStorage)
+	if storage == nil && tor.config.ReadOnly {
+		storage = &filestore.ReadOnlyStorage{RootDirectory: tor.config.RootDirectory, Pool: tor.config.FilePool}
+	} else if storage == nil {
+		storage = &filestore.DiskStorage{RootDirectory: tor.config.RootDirectory, Pool: tor.config.FilePool, Allocation: tor.config.Allocation}
+		disk = true
+	}
+	disk = disk && !tor.config.ReadOnly
+	partPieces := make(map[int]bool)
+	if disk {
+		partPath := filepath.Join(tor.rootDirectory, tor.partFileName())
+		if tor.partFile, err = filestore.NewPartFile(partPath, tor.meta.PieceLength, tor.meta.PieceCount); err != nil {
+			logger.Error("Failed to open part file: %s", err)
 			return
 		}
+		for _, index := range tor.partFile.Pieces() {
+			partPieces[index] = true
+		}
+	}
+
+	// Files are not created until Start, and then only if they are wanted
+	tfiles := make([]filestore.TorrentStorer, 0)
+	tor.storers = make([]filestore.TorrentStorer, len(tor.meta.Files))
+	tor.lazyFiles = make([]*filestore.LazyFile, len(tor.meta.Files))
+	tor.filePriorities = make([]int, len(tor.meta.Files))
+	tor.fileErrors = make([]error, len(tor.meta.Files))
+	for i, file := range tor.meta.Files {
+		tor.filePriorities[i] = PriorityNormal
+		if file.Pad {
+			tfiles = append(tfiles, filestore.NewPadFile(file.Length))
+			continue
+		}
+		// Symlinks have no data, so they take no part in the filestore
+		if file.SymlinkTarget != "" {
+			if !disk {
+				continue
+			}
+			if err = filestore.NewSymlink(tor.rootDirectory, file.LocalPath, file.SymlinkTarget); err != nil {
+				logger.Error("Failed to create symlink %s: %s", file.Path, err)
+				return
+			}
+			continue
+		}
+		var tfile filestore.TorrentStorer
+		if tfile, err = storage.OpenFile(file.LocalPath, file.Length); err != nil {
+			logger.Error("Failed to open file %s: %s", file.Path, err)
+			if !tor.config.ReadOnly {
+				return
+			}
+			// A read only torrent seeds whatever it can
+			tor.fileErrors[i] = err
+			tfile, err = filestore.NewUnavailableFile(file.Length, err), nil
+		}
+		tor.storers[i] = tfile
 		tfiles = append(tfiles, tfile)
+		lf, lazy := tfile.(*filestore.LazyFile)
+		if !lazy {
+			continue
+		}
+		if file.Executable {
+			if err = lf.SetExecutable(); err != nil {
+				logger.Error("Failed to make file %s executable: %s", file.Path, err)
+				return
+			}
+		}
+		// Data left in the part file by an earlier session is found there
+		// until the file is created
+		for _, index := range tor.filePieces(i) {
+			if partPieces[index] {
+				lf.SetPartFile(tor.partFile, tor.fileOffset(i))
+				break
+			}
+		}
+		tor.lazyFiles[i] = lf
 	}
+	tor.updatePiecePriorities()
 
 	// Now we can create our filestore.
 	if tor.fileStore, err = filestore.NewFileStore(tfiles, tor.meta.Pieces, tor.meta.PieceLength); err != nil {
@@ -65,28 +210,68 @@ func NewTorrent(m *metainfo.Metainfo, config *Config) (tor *Torrent, err error)
 		return
 	}
 
-	if tor.bitf, err = tor.fileStore.Validate(); err != nil {
-		logger.Error("Failed to run validation on new filestore: %s", err)
-		return
+	tor.diskQueue = tor.config.DiskQueue
+	if tor.diskQueue == nil {
+		tor.diskQueue = filestore.DefaultDiskQueue
+	}
+
+	tor.picker = newPiecePicker(tor.fileStore.PieceLength, tor.piecePriorities)
+	if rd != nil {
+		tor.bitf = tor.applyResumeData(rd)
+	}
+	if tor.bitf == nil && tor.config.SeedMode {
+		tor.bitf = tor.seedModeBitfield()
+	}
+	if tor.bitf == nil {
+		if tor.bitf, err = tor.fileStore.Validate(); err != nil {
+			logger.Error("Failed to run validation on new filestore: %s", err)
+			return
+		}
+	}
+
+	tor.swarmTally = make(swarmTally, tor.meta.PieceCount)
+	for i := range tor.swarmTally {
+		if tor.bitf.Get(i) {
+			tor.swarmTally[i] = -1
+		}
 	}
 
 	return
 }
 
-func (tor *Torrent) Start() {
+// partFileName is the name of the part file within the root directory.
+func (t *Torrent) partFileName() string {
+	return fmt.Sprintf(".%x.parts", t.meta.InfoHash)
+}
+
+// Start creates the wanted files and starts seeding or downloading. It fails
+// with an *InsufficientSpaceError, without creating anything, if the files
+// will not fit on disk.
+func (tor *Torrent) Start() (err error) {
 	logger.Info("Torrent starting: %s", tor.meta.Name)
 
+	if err = tor.checkSpace(); err != nil {
+		logger.Error("Cannot start %s: %s", tor.meta.Name, err)
+		return
+	}
+
+	for i, lf := range tor.lazyFiles {
+		if lf != nil && tor.FilePriority(i) != PrioritySkip {
+			if err := lf.Create(); err != nil {
+				logger.Error("Failed to create file %s: %s", tor.meta.Files[i].Path, err)
+			}
+		}
+	}
+	tor.freePartPieces()
+
 	// Set initial state
+	state := tor.completionState()
 	tor.stateLock.Lock()
-	if tor.bitf.SumTrue() == tor.bitf.Length() {
-		tor.state = Seeding
-	} else {
-		tor.state = Leeching
-	}
+	tor.state = state
 	tor.stateLock.Unlock()
 
 	// Create trackers
-	for _, tkr := range tor.meta.AnnounceList {
+	for _, tkr := range tor.announceList {
 		tkr, err := tracker.NewTracker(tkr, tor, tor.incomingPeerAddr)
 		if err != nil {
 			logger.Error("Failed to create tracker: %s", err)
@@ -96,45 +281,54 @@ func (tor *Torrent) Start() {
 		tkr.Start()
 	}
 
+	if !tor.config.ReadOnly {
+		tor.startWebSeeds()
+	}
+
 	// Tracker loop
 	go func() {
 		for {
 			peerAddr := <-tor.incomingPeerAddr
+			tor.addCandidate(peerAddr, SourceTracker)
+		}
+	}()
+
+	// Dial loop
+	go func() {
+		for {
+			<-time.After(time.Second)
 			// Only attempt to connect to other peers whilst leeching
-			if tor.state != Leeching {
+			if tor.State() != Leeching {
 				continue
 			}
-			go func() {
-				conn, err := net.Dial("tcp", peerAddr)
-				if err != nil {
-					logger.Debug("Failed to connect to tracker peer address %s: %s", peerAddr, err)
-					return
-				}
-				tor.AddPeer(conn, nil)
-			}()
+			tor.dialCandidates()
 		}
 	}()
 
 	// Peer loop
 	go func() {
 		for {
-			select {
-			case peer := <-tor.incomingPeer:
-				// Add to swarm slice
-				logger.Debug("Connected to new peer: %s", peer.name)
-				tor.swarm = append(tor.swarm, peer)
-			case <-time.After(time.Second * 5):
-				// Unchoke interested peers
-				// TODO: Implement maximum unchoked peers
-				// TODO: Implement optimistic unchoking algorithm
-				for _, peer := range tor.swarm {
-					if peer.GetPeerInterested() && peer.GetAmChoking() {
-						logger.Debug("Unchoking peer %s", peer.name)
-						peer.write <- &unchokeMessage{}
-						peer.SetAmChoking(false)
-					}
+			<-time.After(time.Second * 5)
+			// Unchoke interested peers
+			// TODO: Implement maximum unchoked peers
+			// TODO: Implement optimistic unchoking algorithm
+			// Drop peers blocked since the IP filter was last reloaded
+			for _, peer := range tor.peers() {
+				if tor.config.IPFilter.BlockedAddr(peer.addr) {
+					logger.Debug("Disconnecting peer %s blocked by IP filter", peer.name)
+					tor.removePeer(peer)
 				}
 			}
+
+			tor.swarmLock.RLock()
+			for _, peer := range tor.swarm {
+				if peer.GetPeerInterested() && peer.GetAmChoking() {
+					logger.Debug("Unchoking peer %s", peer.name)
+					peer.Send(&unchokeMessage{})
+					peer.SetAmChoking(false)
+				}
+			}
+			tor.swarmLock.RUnlock()
 		}
 	}()
 
@@ -146,26 +340,73 @@ func (tor *Torrent) Start() {
 			msg := peerDouble.msg
 
 			switch msg := msg.(type) {
+			case *partialPiecesRequest:
+				msg.reply <- tor.partialPieces()
+			case *recheckStart:
+				tor.beginRecheck()
+				close(msg.ready)
+			case *recheckDone:
+				tor.endRecheck(msg.bitf)
+			case *blockWritten:
+				tor.handleBlockWritten(msg)
+			case *pieceHashed:
+				tor.handlePieceHashed(msg)
+			case *pieceRead:
+				tor.handlePieceRead(msg)
+			case *pieceVerified:
+				tor.handlePieceVerified(msg)
+			case *storagePause:
+				if err := tor.diskQueue.Flush(tor.fileStore); err != nil {
+					logger.Error("Failed to write cached blocks: %s", err)
+				}
+				close(msg.ready)
+				<-msg.resume
+			case *priorityChanged:
+				for _, ws := range tor.webSeedList() {
+					tor.updateInterest(ws.peer)
+				}
+				for _, p := range tor.peers() {
+					tor.updateInterest(p)
+				}
+			case *peerClosed:
+				logger.Debug("Peer %s has disconnected", peer.name)
+				tor.removePeer(peer)
+				tor.picker.cancelPeer(peer)
+				tor.swarmTally.RemoveBitfield(peer.Bitfield())
+				for _, p := range tor.peers() {
+					tor.requestBlocks(p)
+				}
+				tor.requestWebSeeds()
 			case *chokeMessage:
 				logger.Debug("Peer %s has choked us", peer.name)
 				peer.SetPeerChoking(true)
+				tor.picker.cancelPeer(peer)
+				tor.requestWebSeeds()
 			case *unchokeMessage:
 				logger.Debug("Peer %s has unchoked us", peer.name)
 				peer.SetPeerChoking(false)
+				tor.requestBlocks(peer)
 			case *interestedMessage:
 				logger.Debug("Peer %s has said it is interested", peer.name)
 				peer.SetPeerInterested(true)
-			//case *uninterestedMessage:
-			//	logger.Debug("Peer %s has said it is uninterested", peer.name)
+			case *uninterestedMessage:
+				logger.Debug("Peer %s has said it is uninterested", peer.name)
+				peer.SetPeerInterested(false)
 			case *haveMessage:
 				pieceIndex := int(msg.pieceIndex)
 				logger.Debug("Peer %s has piece %d", peer.name, pieceIndex)
 				if pieceIndex >= tor.meta.PieceCount {
-					logger.Debug("Peer %s sent an out of range have message")
+					logger.Debug("Peer %s sent an out of range have message", peer.name)
 					// TODO: Shutdown client
+					break
+				}
+				if !peer.Has(pieceIndex) {
+					peer.HasPiece(pieceIndex)
+					if tor.swarmTally[pieceIndex] >= 0 {
+						tor.swarmTally[pieceIndex]++
+					}
 				}
-				peer.HasPiece(pieceIndex)
-				// TODO: Update swarmTally
+				tor.updateInterest(peer)
 			case *bitfieldMessage:
 				logger.Debug("Peer %s has sent us its bitfield", peer.name)
 				// Raw parsed bitfield has no actual length. Let's try to set it.
@@ -174,33 +415,35 @@ func (tor *Torrent) Start() {
 					// TODO: Shutdown client
 					break
 				}
+				tor.swarmTally.RemoveBitfield(peer.Bitfield())
 				peer.SetBitfield(msg.bitf)
 				tor.swarmTally.AddBitfield(msg.bitf)
+				tor.updateInterest(peer)
 			case *requestMessage:
-				if peer.GetAmChoking() || !tor.bitf.Get(int(msg.pieceIndex)) || msg.blockLength > 32768 {
+				if peer.GetAmChoking() || !tor.hasPiece(int(msg.pieceIndex)) || msg.blockLength > 32768 {
 					logger.Debug("Peer %s has asked for a block (%d, %d, %d), but we are rejecting them", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
 					// Add naughty points
 					break
 				}
 				logger.Debug("Peer %s has asked for a block (%d, %d, %d), going to fetch block", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
-				block, err := tor.fileStore.GetBlock(int(msg.pieceIndex), int64(msg.blockOffset), int64(msg.blockLength))
-				if err != nil {
-					logger.Error(err.Error())
-					break
-				}
-				logger.Debug("Peer %s has asked for a block (%d, %d, %d), sending it to them", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
-				peer.write <- &pieceMessage{
-					pieceIndex:  msg.pieceIndex,
-					blockOffset: msg.blockOffset,
-					data:        block,
-				}
-				// case *pieceMessage:
+				tor.uploadVerified(peer, msg)
+			case *pieceMessage:
+				tor.receiveBlock(peer, msg)
+				tor.requestBlocks(peer)
+			case *hashRequestMessage:
+				tor.handleHashRequest(peer, msg)
+			case *hashesMessage:
+				// We never request hashes, as the metainfo holds every piece layer
+				logger.Debug("Peer %s sent us unsolicited hashes", peer.name)
+			case *hashRejectMessage:
+				logger.Debug("Peer %s rejected a hash request we did not make", peer.name)
 				// case *cancelMessage:
 			default:
 				logger.Debug("Peer %s sent unknown message", peer.name)
 			}
 		}
 	}()
+	return
 }
 
 func (t *Torrent) String() string {
@@ -215,6 +458,26 @@ func (t *Torrent) InfoHash() []byte {
 	return t.meta.InfoHash
 }
 
+// InfoHashes returns every infohash peers may use for this torrent. Hybrid
+// torrents can be joined with either the v1 infohash or the truncated v2
+// infohash.
+func (t *Torrent) InfoHashes() (hashes [][]byte) {
+	hashes = append(hashes, t.meta.InfoHash)
+	if t.meta.Hybrid {
+		hashes = append(hashes, t.meta.InfoHashV2[:20])
+	}
+	return
+}
+
+func (t *Torrent) matchesInfoHash(infoHash []byte) bool {
+	for _, h := range t.InfoHashes() {
+		if bytes.Equal(h, infoHash) {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *Torrent) State() (state int) {
 	t.stateLock.Lock()
 	state = t.state
@@ -222,49 +485,625 @@ func (t *Torrent) State() (state int) {
 	return
 }
 
-func (t *Torrent) AddPeer(conn net.Conn, hs *handshake) {
+// peers returns a snapshot of the swarm, which can be iterated without holding swarmLock.
+func (t *Torrent) peers() (swarm []*peer) {
+	t.swarmLock.RLock()
+	swarm = append(swarm, t.swarm...)
+	t.swarmLock.RUnlock()
+	return
+}
+
+func (t *Torrent) hasPiece(index int) (b bool) {
+	t.bitfLock.RLock()
+	b = t.bitf.Get(index)
+	t.bitfLock.RUnlock()
+	return
+}
+
+// updateInterest tells peer whether we are interested in any of its pieces,
+// and starts requesting blocks if so. It must be called from the receive loop.
+func (t *Torrent) updateInterest(peer *peer) {
+	interested := false
+	bitf := peer.Bitfield()
+	priorities := t.piecePriorities()
+	// Read only torrents never download
+	for i, count := range t.swarmTally {
+		if count != -1 && priorities[i] != PrioritySkip && bitf.Get(i) && !t.config.ReadOnly {
+			interested = true
+			break
+		}
+	}
+
+	if interested != peer.GetAmInterested() {
+		peer.SetAmInterested(interested)
+		if interested {
+			peer.Send(&interestedMessage{})
+		} else {
+			peer.Send(&uninterestedMessage{})
+		}
+	}
+	t.requestBlocks(peer)
+}
+
+// requestBlocks tops up the outstanding block requests to peer. It must be
+// called from the receive loop.
+func (t *Torrent) requestBlocks(peer *peer) {
+	// Blocks picked for a closed peer would never be released
+	if peer.GetPeerChoking() || !peer.GetAmInterested() || peer.closed() || t.State() == Checking {
+		return
+	}
+	n := maxPeerRequests - t.picker.outstanding(peer)
+	for _, req := range t.picker.pick(peer, peer.Bitfield(), t.swarmTally, n) {
+		peer.Send(req)
+	}
+}
+
+// receiveBlock writes a block sent by peer to storage, verifying the piece
+// once all of its blocks have arrived. It must be called from the receive loop.
+func (t *Torrent) receiveBlock(peer *peer, msg *pieceMessage) {
+	index := int(msg.pieceIndex)
+	pd := t.picker.received(peer, peer.ip, index, int64(msg.blockOffset), len(msg.data))
+	if pd == nil {
+		logger.Debug("Peer %s sent an unrequested block (%d, %d)", peer.name, msg.pieceIndex, msg.blockOffset)
+		return
+	}
+
+	t.writeBlock(pd, msg)
+}
+
+// pieceComplete finishes a fully downloaded and written piece, once its hash
+// has been checked. Pieces that fail are downloaded again; once a previously
+// failed piece passes, the peers that sent corrupt blocks are banned. The blocks
+// compared for smart banning are read back on the disk queue. It must be called
+// from the receive loop.
+func (t *Torrent) pieceComplete(pd *pieceDownload, ok bool, err error) {
+	if err != nil || !ok {
+		if err != nil {
+			logger.Error("Failed to validate piece %d: %s", pd.index, err)
+		} else {
+			logger.Info("Piece %d failed hash check", pd.index)
+			t.recordHashFailure(pd.sources)
+			if t.smartBan.wants(pd) {
+				// Downloaded again once its blocks are recorded, so that they
+				// are not overwritten first
+				t.readPiece(pd, false)
+				return
+			}
+		}
+		t.picker.finished(pd.index)
+		t.requestWebSeeds()
+		return
+	}
+
+	t.picker.finished(pd.index)
+	defer t.requestWebSeeds()
+	if t.smartBan.tracking(pd.index) {
+		t.readPiece(pd, true)
+	}
+
+	t.bitfLock.Lock()
+	t.bitf.SetTrue(pd.index)
+	t.bitfLock.Unlock()
+	t.swarmTally[pd.index] = -1
+	if t.verified != nil {
+		t.verified.SetTrue(pd.index)
+	}
+
+	for _, p := range t.peers() {
+		p.Send(&haveMessage{pieceIndex: uint32(pd.index)})
+		t.updateInterest(p)
+	}
+
+	t.updateState()
+}
+
+// recordHashFailure increments the hash failure count of every connected peer
+// and web seed that contributed to a failed piece. A web seed that sent the
+// whole piece is banned outright, as nobody else can be to blame.
+func (t *Torrent) recordHashFailure(sources []string) {
+	ips := make(map[string]bool)
+	for _, ip := range sources {
+		ips[ip] = true
+	}
+
+	var banned string
+	t.swarmLock.RLock()
+	for _, p := range t.swarm {
+		if ips[p.ip] {
+			p.addHashFailure()
+		}
+	}
+	for _, ws := range t.webSeeds {
+		if ips[ws.url] {
+			ws.peer.addHashFailure()
+			if len(ips) == 1 {
+				banned = ws.url
+			}
+		}
+	}
+	t.swarmLock.RUnlock()
+
+	if banned != "" {
+		logger.Info("Banning web seed %s for sending a corrupt piece", banned)
+		t.banIP(banned)
+	}
+}
+
+// banIP disconnects all peers from ip and refuses any future connections from
+// it. Web seeds are identified by their URL in place of an IP address.
+func (t *Torrent) banIP(ip string) {
+	t.swarmLock.Lock()
+	t.bannedIPs[ip] = true
+	for i := 0; i < len(t.swarm); {
+		if p := t.swarm[i]; p.ip == ip {
+			t.removePeerLocked(p)
+		} else {
+			i++
+		}
+	}
+	for _, ws := range t.webSeeds {
+		if ws.url == ip {
+			ws.Close()
+		}
+	}
+	t.swarmLock.Unlock()
+}
+
+func (t *Torrent) isBannedIP(ip string) (banned bool) {
+	t.swarmLock.RLock()
+	banned = t.bannedIPs[ip]
+	t.swarmLock.RUnlock()
+	return
+}
+
+// hostOf returns the IP portion of a host:port address.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// addCandidate records a peer address learned from source. Every peer source
+// must add addresses through here so that the IP filter is applied.
+func (t *Torrent) addCandidate(addr string, source int) {
+	if !t.sourceAllowed(source) {
+		logger.Debug("Ignoring peer address %s for private torrent %s", addr, t.meta.Name)
+		return
+	}
+	if t.config.IPFilter.BlockedAddr(addr) {
+		logger.Debug("Peer address %s blocked by IP filter", addr)
+		return
+	}
+	t.candidates.add(addr, source)
+}
+
+// sourceAllowed reports whether peers from source may join the torrent.
+// Private torrents (BEP 27) must only use peers from their own trackers, or
+// the private swarm would leak.
+func (t *Torrent) sourceAllowed(source int) bool {
+	if !t.meta.Private {
+		return true
+	}
+	return source == SourceTracker || source == SourceIncoming
+}
+
+// Private reports whether the torrent is private. Private torrents only find
+// peers through their own trackers.
+func (t *Torrent) Private() bool {
+	return t.meta.Private
+}
+
+// startWebSeeds starts downloading from each HTTP web seed (BEP 19) and HTTP
+// seed (BEP 17) in the metainfo. Seeds on the same host share
+// maxWebSeedConnections.
+func (t *Torrent) startWebSeeds() {
+	slots := make(map[string]chan struct{})
+	t.swarmLock.Lock()
+	for i, urls := range [][]string{t.meta.URLList, t.meta.HTTPSeeds} {
+		for _, u := range urls {
+			parsed, err := url.Parse(u)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				logger.Info("Ignoring unsupported web seed %s", u)
+				continue
+			}
+			if t.bannedIPs[u] {
+				continue
+			}
+			if slots[parsed.Host] == nil {
+				slots[parsed.Host] = make(chan struct{}, maxWebSeedConnections)
+			}
+			ws := newWebSeed(t, u, i == 1, slots[parsed.Host])
+			t.webSeeds = append(t.webSeeds, ws)
+			go ws.start()
+		}
+	}
+	t.swarmLock.Unlock()
+}
+
+// requestWebSeeds tops up the requests to every web seed. Web seeds are not
+// part of the swarm, so they must be asked separately whenever blocks may have
+// become free. It must be called from the receive loop.
+func (t *Torrent) requestWebSeeds() {
+	for _, ws := range t.webSeedList() {
+		t.requestBlocks(ws.peer)
+	}
+}
+
+// webSeedList returns a snapshot of the web seeds.
+func (t *Torrent) webSeedList() (webSeeds []*webSeed) {
+	t.swarmLock.RLock()
+	webSeeds = append(webSeeds, t.webSeeds...)
+	t.swarmLock.RUnlock()
+	return
+}
+
+// dialCandidates connects to as many candidate peers as the torrent and global
+// connection limits allow.
+func (t *Torrent) dialCandidates() {
+	t.swarmLock.Lock()
+	n := t.maxConnections - len(t.swarm) - t.dialing
+	t.swarmLock.Unlock()
+	if m := t.connManager.freeSlots(); m < n {
+		n = m
+	}
+	if n <= 0 {
+		return
+	}
+
+	addrs := t.candidates.next(time.Now(), n)
+	for i, addr := range addrs {
+		if t.isBannedIP(hostOf(addr)) {
+			t.candidates.ban(addr)
+			continue
+		}
+		// The filter may have been reloaded since the candidate was added
+		if t.config.IPFilter.BlockedAddr(addr) {
+			t.candidates.failed(addr)
+			continue
+		}
+		if !t.connManager.acquireHalfOpen() {
+			// Another torrent took the slots since we counted them. The
+			// candidates we have not dialed are free to be tried next time.
+			for _, addr := range addrs[i:] {
+				t.candidates.cancel(addr)
+			}
+			return
+		}
+		t.swarmLock.Lock()
+		t.dialing++
+		t.swarmLock.Unlock()
+
+		go func(addr string) {
+			conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+			t.connManager.releaseHalfOpen()
+			t.swarmLock.Lock()
+			t.dialing--
+			t.swarmLock.Unlock()
+
+			if err != nil {
+				logger.Debug("Failed to connect to peer address %s: %s", addr, err)
+				t.candidates.failed(addr)
+				return
+			}
+			if !t.addPeer(conn, nil, addr) {
+				t.candidates.failed(addr)
+			}
+		}(addr)
+	}
+}
+
+// reserveConnection claims a connection slot for a new peer, evicting the least
+// valuable existing peer if the torrent is full. It must be called with swarmLock held.
+func (t *Torrent) reserveConnection() bool {
+	if len(t.swarm) >= t.maxConnections {
+		if !t.evictPeer() {
+			return false
+		}
+	}
+	if !t.connManager.acquireConnection() {
+		// Make space under the global limit by giving up one of our own peers
+		if !t.evictPeer() || !t.connManager.acquireConnection() {
+			return false
+		}
+	}
+	return true
+}
+
+// evictPeer disconnects the peer that has sent us the least data, ignoring any
+// peers still within their grace period. It must be called with swarmLock held.
+func (t *Torrent) evictPeer() bool {
+	var victim *peer
+	var victimDownloaded int64
+	for _, p := range t.swarm {
+		if time.Since(p.connectedAt) < evictionGracePeriod {
+			continue
+		}
+		downloaded := p.Stats().Downloaded
+		if victim == nil || downloaded < victimDownloaded {
+			victim, victimDownloaded = p, downloaded
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	logger.Debug("Evicting peer %s to make room for new connection", victim.name)
+	t.removePeerLocked(victim)
+	return true
+}
+
+func (t *Torrent) removePeer(p *peer) {
+	t.swarmLock.Lock()
+	t.removePeerLocked(p)
+	t.swarmLock.Unlock()
+}
+
+// removePeerLocked closes p and releases its connection slot. Removing a peer
+// that has already been removed does nothing. It must be called with swarmLock held.
+func (t *Torrent) removePeerLocked(p *peer) {
+	p.Close()
+	for i, q := range t.swarm {
+		if q == p {
+			t.swarm = append(t.swarm[:i], t.swarm[i+1:]...)
+			t.connManager.releaseConnection()
+			if p.candidateAddr != "" {
+				t.candidates.setConnected(p.candidateAddr, false)
+			}
+			return
+		}
+	}
+}
+
+// SetMaxConnections sets the maximum number of peers this torrent will connect to.
+func (t *Torrent) SetMaxConnections(n int) {
+	t.swarmLock.Lock()
+	t.maxConnections = n
+	t.swarmLock.Unlock()
+}
+
+func (t *Torrent) Connections() (n int) {
+	t.swarmLock.RLock()
+	n = len(t.swarm)
+	t.swarmLock.RUnlock()
+	return
+}
+
+// findPeerLocked returns the connected peer with the given peer id, or nil.
+// It must be called with swarmLock held.
+func (t *Torrent) findPeerLocked(peerId []byte) *peer {
+	for _, p := range t.swarm {
+		if p.name == string(peerId) {
+			return p
+		}
+	}
+	return nil
+}
+
+// replaceDuplicate reports whether a new connection to a peer we are already
+// connected to should replace the existing one. Both ends keep the connection
+// initiated by whichever peer has the lower peer id, so they always agree on
+// which connection survives.
+func (t *Torrent) replaceDuplicate(newOutgoing, existingOutgoing bool, remotePeerId []byte) bool {
+	if newOutgoing == existingOutgoing {
+		return false
+	}
+	weAreLower := bytes.Compare(t.peerId, remotePeerId) < 0
+	return newOutgoing == weAreLower
+}
+
+// AddPeer completes the handshake on conn and adds it to the swarm. If hs is nil
+// the connection is outgoing and we wait for the remote handshake. It reports
+// whether we are connected to the peer once it returns, which may be through an
+// existing connection if this one was a duplicate.
+func (t *Torrent) AddPeer(conn net.Conn, hs *handshake) bool {
+	return t.addPeer(conn, hs, "")
+}
+
+// addPeer is AddPeer for connections dialed from the candidate list entry candidateAddr.
+func (t *Torrent) addPeer(conn net.Conn, hs *handshake, candidateAddr string) bool {
+	if t.isBannedIP(hostOf(conn.RemoteAddr().String())) {
+		logger.Debug("%s Rejecting connection from banned address", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+	if t.config.IPFilter.BlockedAddr(conn.RemoteAddr().String()) {
+		logger.Debug("%s Rejecting connection blocked by IP filter", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+
+	if hs != nil && !t.matchesInfoHash(hs.infoHash) {
+		logger.Debug("%s Infohash did not match for connection", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+
 	// Set 60 second limit to connection attempt
 	conn.SetDeadline(time.Now().Add(time.Minute))
 
-	// Send handshake
-	if err := newHandshake(t.InfoHash()).BinaryDump(conn); err != nil {
+	// Send handshake. Incoming peers of hybrid torrents may have used either
+	// infohash, and we answer with the one they chose.
+	infoHash := t.InfoHash()
+	if hs != nil {
+		infoHash = hs.infoHash
+	}
+	ourHs := newHandshake(infoHash, t.peerId)
+	if t.meta.MetaVersion == 2 {
+		ourHs.reserved[7] |= reservedV2
+	}
+	if err := ourHs.BinaryDump(conn); err != nil {
 		logger.Debug("%s Failed to send handshake to connection: %s", conn.RemoteAddr(), err)
-		return
+		conn.Close()
+		return false
 	}
 
 	// If hs is nil, this means we've attempted to establish the connection and need to wait
 	// for their handshake in response
 	var err error
-	if hs == nil {
+	outgoing := hs == nil
+	if outgoing {
 		if hs, err = parseHandshake(conn); err != nil {
 			logger.Debug("%s Failed to parse incoming handshake: %s", conn.RemoteAddr(), err)
-			return
-		} else if !bytes.Equal(hs.infoHash, t.InfoHash()) {
+			conn.Close()
+			return false
+		} else if !t.matchesInfoHash(hs.infoHash) {
 			logger.Debug("%s Infohash did not match for connection", conn.RemoteAddr())
-			return
+			conn.Close()
+			return false
+		}
+	}
+
+	// Connections to ourselves happen when we announce to the same tracker we
+	// connect from. Ban the address so we don't dial it again.
+	if bytes.Equal(hs.peerId, t.peerId) {
+		logger.Debug("%s Connected to ourselves, closing connection", conn.RemoteAddr())
+		if candidateAddr != "" {
+			t.candidates.ban(candidateAddr)
 		}
+		conn.Close()
+		return false
 	}
 
-	peer := newPeer(string(hs.peerId), conn, t.readChan)
-	peer.write <- &bitfieldMessage{bitf: t.bitf}
-	t.incomingPeer <- peer
+	t.swarmLock.Lock()
+	defer t.swarmLock.Unlock()
+
+	if existing := t.findPeerLocked(hs.peerId); existing != nil {
+		if !t.replaceDuplicate(outgoing, existing.outgoing, hs.peerId) {
+			logger.Debug("%s Already connected to peer %s, closing duplicate connection", conn.RemoteAddr(), existing.name)
+			if candidateAddr != "" {
+				if existing.candidateAddr == "" {
+					existing.candidateAddr = candidateAddr
+					t.candidates.setConnected(candidateAddr, true)
+				} else if candidateAddr != existing.candidateAddr {
+					t.candidates.setConnected(candidateAddr, false)
+				}
+			}
+			conn.Close()
+			return true
+		}
+		logger.Debug("%s Replacing duplicate connection to peer %s", conn.RemoteAddr(), existing.name)
+		// Keep the existing connection's candidate address if this one has
+		// none, otherwise removing it releases its address.
+		if candidateAddr == "" {
+			candidateAddr = existing.candidateAddr
+			existing.candidateAddr = ""
+		} else if candidateAddr == existing.candidateAddr {
+			existing.candidateAddr = ""
+		}
+		t.removePeerLocked(existing)
+	}
+
+	if !t.reserveConnection() {
+		logger.Debug("%s Rejecting peer, connection limit reached", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
 
 	conn.SetDeadline(time.Time{})
+	peer := newPeer(string(hs.peerId), conn, t.readChan, &t.stats,
+		[]*ratelimit.Limiter{t.upLimiter, t.config.UploadLimiter},
+		[]*ratelimit.Limiter{t.downLimiter, t.config.DownloadLimiter})
+	peer.addr = conn.RemoteAddr().String()
+	peer.ip = hostOf(peer.addr)
+	peer.SetBitfield(bitfield.NewBitfield(t.meta.PieceCount))
+	peer.outgoing = outgoing
+	peer.candidateAddr = candidateAddr
+	peer.SetUploadLimit(t.peerUpRate)
+	peer.SetDownloadLimit(t.peerDownRate)
+	if candidateAddr != "" {
+		t.candidates.setConnected(candidateAddr, true)
+	}
+	logger.Debug("Connected to new peer: %s", peer.name)
+	t.swarm = append(t.swarm, peer)
+	peer.start()
+
+	t.bitfLock.RLock()
+	peer.Send(&bitfieldMessage{bitf: t.bitf.Copy()})
+	t.bitfLock.RUnlock()
+	return true
 }
 
 func (t *Torrent) Downloaded() int64 {
-	// TODO:
-	return 0
+	return atomic.LoadInt64(&t.stats.downloaded)
 }
 
 func (t *Torrent) Uploaded() int64 {
-	// TODO:
-	return 0
+	return atomic.LoadInt64(&t.stats.uploaded)
+}
+
+// TotalDownloaded includes the bytes downloaded in earlier sessions, as
+// recorded in resume data. Downloaded counts this session only.
+func (t *Torrent) TotalDownloaded() int64 {
+	return atomic.LoadInt64(&t.downloadedBefore) + t.Downloaded()
 }
 
-func (t *Torrent) Left() int64 {
-	// TODO:
-	return 0
+func (t *Torrent) TotalUploaded() int64 {
+	return atomic.LoadInt64(&t.uploadedBefore) + t.Uploaded()
+}
+
+// ProtocolOverhead returns the number of bytes sent and received that were not piece data.
+func (t *Torrent) ProtocolOverhead() (up int64, down int64) {
+	up = atomic.LoadInt64(&t.stats.uploadedTotal) - t.Uploaded()
+	down = atomic.LoadInt64(&t.stats.downloadedTotal) - t.Downloaded()
+	return
+}
+
+func (t *Torrent) PeerStats() (stats []PeerStats) {
+	t.swarmLock.RLock()
+	for _, peer := range t.swarm {
+		stats = append(stats, peer.Stats())
+	}
+	for _, ws := range t.webSeeds {
+		stats = append(stats, ws.peer.Stats())
+	}
+	t.swarmLock.RUnlock()
+	return
+}
+
+// SetUploadLimit sets the upload rate for this torrent in bytes per second. 0 is unlimited.
+func (t *Torrent) SetUploadLimit(rate int64) {
+	t.upLimiter.SetRate(rate)
+}
+
+// SetDownloadLimit sets the download rate for this torrent in bytes per second. 0 is unlimited.
+func (t *Torrent) SetDownloadLimit(rate int64) {
+	t.downLimiter.SetRate(rate)
+}
+
+// SetPeerUploadLimit sets the upload rate applied to each individual peer, both
+// those already connected and any that connect in future.
+func (t *Torrent) SetPeerUploadLimit(rate int64) {
+	t.swarmLock.Lock()
+	t.peerUpRate = rate
+	for _, peer := range t.swarm {
+		peer.SetUploadLimit(rate)
+	}
+	t.swarmLock.Unlock()
+}
+
+// SetPeerDownloadLimit sets the download rate applied to each individual peer.
+func (t *Torrent) SetPeerDownloadLimit(rate int64) {
+	t.swarmLock.Lock()
+	t.peerDownRate = rate
+	for _, peer := range t.swarm {
+		peer.SetDownloadLimit(rate)
+	}
+	t.swarmLock.Unlock()
+}
+
+// Left is the number of bytes still to download, not counting pieces that
+// belong only to skipped files.
+func (t *Torrent) Left() (left int64) {
+	priorities := t.piecePriorities()
+	t.bitfLock.RLock()
+	for i := 0; i < t.bitf.Length(); i++ {
+		if !t.bitf.Get(i) && priorities[i] != PrioritySkip {
+			left += t.fileStore.PieceLength(i)
+		}
+	}
+	t.bitfLock.RUnlock()
+	return
 }
 
 func (t *Torrent) Port() uint16 {
@@ -272,5 +1111,11 @@ func (t *Torrent) Port() uint16 {
 }
 
 func (t *Torrent) PeerId() []byte {
-	return PeerId
+	return t.peerId
+}
+
+// Key identifies us to trackers across changes of IP address. Like the peer
+// id it never changes, which private trackers rely on.
+func (t *Torrent) Key() int32 {
+	return t.key
 }
@@ -1,5 +1,193 @@
 package libtorrent
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/torrance/libtorrent/ipfilter"
+	"github.com/torrance/libtorrent/metainfo"
+	"github.com/torrance/libtorrent/tracker"
+	"github.com/zeebo/bencode"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Keep tests off the network
+	tracker.UDPDialer = func(network, address string) (net.Conn, error) {
+		return nil, errors.New("tracker disabled during tests")
+	}
+}
+
+// newTestTorrent creates a torrent for testData/test.txt, listening on a random
+// local port. If seed is set, the test data is copied in first.
+func newTestTorrent(t *testing.T, peerId string, seed bool) (tor *Torrent, l *Listener, cleanup func()) {
+	f, err := os.Open(filepath.Join("testData", "test.txt.torrent"))
+	if err != nil {
+		t.Fatal("Could not open torrent file: ", err)
+	}
+	defer f.Close()
+	m, err := metainfo.ParseMetainfo(f)
+	if err != nil {
+		t.Fatal("Could not parse torrent file: ", err)
+	}
+
+	var files map[string][]byte
+	if seed {
+		original, err := ioutil.ReadFile(filepath.Join("testData", "test.txt"))
+		if err != nil {
+			t.Fatal("Could not read test data: ", err)
+		}
+		files = map[string][]byte{"test.txt": original}
+	}
+	return newTestTorrentFromMeta(t, m, peerId, files)
+}
+
+// newTestTorrentFromMeta creates a torrent for m, listening on a random local
+// port. Files are written into the download directory first, keyed by path.
+func newTestTorrentFromMeta(t *testing.T, m *metainfo.Metainfo, peerId string, files map[string][]byte) (tor *Torrent, l *Listener, cleanup func()) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+
+	for path, data := range files {
+		path = filepath.Join(tmpDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal("Could not create directory: ", err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal("Could not write test data: ", err)
+		}
+	}
+
+	config := &Config{RootDirectory: tmpDir, PeerId: []byte(peerId)}
+	if tor, err = NewTorrent(m, config); err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+
+	l = NewListener(0)
+	l.AddTorrent(tor)
+	if err = l.Listen(); err != nil {
+		t.Fatal("Could not start listener: ", err)
+	}
+
+	cleanup = func() {
+		l.Close()
+		tor.swarmLock.Lock()
+		for len(tor.swarm) > 0 {
+			tor.removePeerLocked(tor.swarm[0])
+		}
+		for _, ws := range tor.webSeeds {
+			ws.Close()
+		}
+		tor.swarmLock.Unlock()
+		os.RemoveAll(tmpDir)
+	}
+	return
+}
+
+// waitFor polls cond until it is true or the timeout expires.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return cond()
+}
+
+func TestDownloadFromPeer(t *testing.T) {
+	seeder, l, cleanupSeeder := newTestTorrent(t, "-LT0000-seederseeder", true)
+	defer cleanupSeeder()
+	leecher, _, cleanupLeecher := newTestTorrent(t, "-LT0000-leecherleech", false)
+	defer cleanupLeecher()
+
+	if leecher.Left() != 36880 {
+		t.Errorf("Incorrect bytes left before download, got: %d", leecher.Left())
+	}
+
+	seeder.Start()
+	leecher.Start()
+	leecher.candidates.add(l.Addr().String(), SourceTracker)
+
+	if !waitFor(time.Second*10, func() bool { return leecher.State() == Seeding }) {
+		t.Fatalf("Download did not complete, %d bytes left", leecher.Left())
+	}
+
+	if leecher.Left() != 0 {
+		t.Errorf("Incorrect bytes left after download, got: %d", leecher.Left())
+	}
+	if leecher.Downloaded() != 36880 || seeder.Uploaded() != 36880 {
+		t.Errorf("Incorrect transfer stats, downloaded: %d uploaded: %d", leecher.Downloaded(), seeder.Uploaded())
+	}
+
+	original, _ := ioutil.ReadFile(filepath.Join("testData", "test.txt"))
+	downloaded, _ := ioutil.ReadFile(filepath.Join(leecher.config.RootDirectory, "test.txt"))
+	if !bytes.Equal(original, downloaded) {
+		t.Error("Downloaded file does not match original")
+	}
+}
+
+func TestSelfConnectionIsBanned(t *testing.T) {
+	tor, l, cleanup := newTestTorrent(t, "-LT0000-selfselfself", true)
+	defer cleanup()
+
+	addr := l.Addr().String()
+	tor.candidates.add(addr, SourceTracker)
+	tor.dialCandidates()
+
+	if !waitFor(time.Second*5, func() bool { return tor.candidates.isBanned(addr) }) {
+		t.Fatal("Connection to ourselves was not banned")
+	}
+	if n := tor.Connections(); n != 0 {
+		t.Errorf("Expected no connections after connecting to ourselves, got: %d", n)
+	}
+
+	// A banned address must not be dialed again
+	if addrs := tor.candidates.next(time.Now().Add(time.Hour), 10); len(addrs) != 0 {
+		t.Errorf("Banned candidate returned for dialing: %v", addrs)
+	}
+}
+
+func TestDuplicateConnectionsResolved(t *testing.T) {
+	torA, lA, cleanupA := newTestTorrent(t, "-LT0000-aaaaaaaaaaaa", true)
+	defer cleanupA()
+	torB, lB, cleanupB := newTestTorrent(t, "-LT0000-bbbbbbbbbbbb", false)
+	defer cleanupB()
+
+	// Dial each other simultaneously
+	torA.candidates.add(lB.Addr().String(), SourceTracker)
+	torB.candidates.add(lA.Addr().String(), SourceTracker)
+	go torA.dialCandidates()
+	go torB.dialCandidates()
+
+	// Both ends should settle on the single connection initiated by A, which has the lower peer id
+	settled := func() bool {
+		torA.swarmLock.RLock()
+		defer torA.swarmLock.RUnlock()
+		torB.swarmLock.RLock()
+		defer torB.swarmLock.RUnlock()
+		return len(torA.swarm) == 1 && torA.swarm[0].outgoing &&
+			len(torB.swarm) == 1 && !torB.swarm[0].outgoing
+	}
+	if !waitFor(time.Second*5, settled) {
+		t.Fatalf("Duplicate connections not resolved, A has %d peers, B has %d peers", torA.Connections(), torB.Connections())
+	}
+
+	// Redialing an already connected peer must not create a second connection
+	if addrs := torA.candidates.next(time.Now().Add(time.Hour), 10); len(addrs) != 0 {
+		t.Errorf("Connected candidate returned for dialing: %v", addrs)
+	}
+}
+
 // import (
 // 	//"bytes"
 // 	//"fmt"
@@ -69,3 +257,145 @@ package libtorrent
 //	fmt.Println("Starting torrent...")
 //	tor.start()
 //}
+
+func TestIPFilterBlocksPeers(t *testing.T) {
+	tor, _, cleanup := newTestTorrent(t, "-LT0000-filterfilter", true)
+	defer cleanup()
+
+	filter := ipfilter.NewFilter()
+	filter.Load(strings.NewReader("127.0.0.0/8\n::1/128\n"))
+	tor.config.IPFilter = filter
+
+	// The listener sees the filter through the config of the torrents added to it
+	l := NewListener(0)
+	l.AddTorrent(tor)
+	if err := l.Listen(); err != nil {
+		t.Fatal("Could not start listener: ", err)
+	}
+	defer l.Close()
+
+	tor.addCandidate("127.0.0.1:6881", SourceTracker)
+	if tor.candidates.Len() != 0 {
+		t.Error("Blocked address added to candidate list")
+	}
+
+	// Incoming connections are dropped before the handshake
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect to listener: ", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	newHandshake(tor.InfoHash(), []byte("-LT0000-outsideroutsi")[:20]).BinaryDump(conn)
+	if _, err := parseHandshake(conn); err == nil {
+		t.Error("Received handshake from listener despite being blocked")
+	}
+	if tor.Connections() != 0 {
+		t.Errorf("Blocked peer was added to swarm")
+	}
+
+	// Reloading the config's filter lets the listener accept the address
+	filter.Load(strings.NewReader(""))
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to connect to listener: ", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	newHandshake(tor.InfoHash(), []byte("-LT0000-outsideroutsi")[:20]).BinaryDump(conn)
+	if _, err := parseHandshake(conn); err != nil {
+		t.Error("No handshake from listener after the filter was reloaded: ", err)
+	}
+}
+
+func TestNewTorrentFileAttributes(t *testing.T) {
+	info := map[string]interface{}{
+		"name":         "attrs",
+		"piece length": 16384,
+		"pieces":       strings.Repeat("a", 2*20),
+		"files": []map[string]interface{}{
+			{"length": 100, "path": []string{"bin", "run"}, "attr": "x"},
+			{"length": 16284, "path": []string{".pad", "16284"}, "attr": "p"},
+			{"length": 10, "path": []string{"data"}},
+			{"length": 0, "path": []string{"link"}, "attr": "l", "symlink path": []string{"bin", "run"}},
+		},
+	}
+	data, err := bencode.EncodeBytes(map[string]interface{}{"info": info})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := metainfo.ParseMetainfo(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Failed to parse torrent: ", err)
+	}
+	tor, _, cleanup := newTestTorrentFromMeta(t, m, "-LT0000-attributesat", nil)
+	defer cleanup()
+	root := filepath.Join(tor.config.RootDirectory, "attrs")
+
+	// Files are created when the torrent starts
+	if _, err := os.Stat(filepath.Join(root, "data")); !os.IsNotExist(err) {
+		t.Error("File created before the torrent started: ", err)
+	}
+	tor.Start()
+
+	if stat, err := os.Stat(filepath.Join(root, "bin", "run")); err != nil || stat.Mode()&0111 == 0 {
+		t.Error("Executable file was not created executable: ", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".pad")); !os.IsNotExist(err) {
+		t.Error("Padding was written to disk")
+	}
+	if target, err := os.Readlink(filepath.Join(root, "link")); err != nil || target != filepath.Join("bin", "run") {
+		t.Errorf("Incorrect symlink: %s %v", target, err)
+	}
+	if tor.fileStore.TotalLength() != 16384+10 {
+		t.Error("Incorrect filestore length: ", tor.fileStore.TotalLength())
+	}
+}
+
+func TestPrivateTorrentPeerSources(t *testing.T) {
+	for _, private := range []bool{true, false} {
+		info := map[string]interface{}{
+			"name":         "private.txt",
+			"piece length": 16384,
+			"pieces":       strings.Repeat("a", 20),
+			"length":       100,
+		}
+		if private {
+			info["private"] = 1
+		}
+		data, err := bencode.EncodeBytes(map[string]interface{}{"info": info})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := metainfo.ParseMetainfo(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal("Failed to parse torrent: ", err)
+		}
+		tor, _, cleanup := newTestTorrentFromMeta(t, m, "-LT0000-privateprivt", nil)
+		if tor.Private() != private {
+			t.Error("Incorrect private flag: ", tor.Private())
+		}
+
+		key := tor.Key()
+		for i, source := range []int{SourceTracker, SourceIncoming, SourceDHT, SourcePEX, SourceLSD} {
+			tor.addCandidate(fmt.Sprintf("10.0.0.%d:6881", i+1), source)
+		}
+		expected := 5
+		if private {
+			// Only the tracker and incoming peers may join a private swarm
+			expected = 2
+			for _, addr := range []string{"10.0.0.3:6881", "10.0.0.4:6881", "10.0.0.5:6881"} {
+				if _, ok := tor.candidates.candidates[addr]; ok {
+					t.Error("Private torrent accepted peer from another source: ", addr)
+				}
+			}
+		}
+		if tor.candidates.Len() != expected {
+			t.Errorf("Private %v: expected %d candidates, got %d", private, expected, tor.candidates.Len())
+		}
+		if tor.Key() != key {
+			t.Error("Tracker key changed")
+		}
+		cleanup()
+	}
+}
@@ -23,7 +23,8 @@ const (
 var logger = logging.MustGetLogger("libtorrent")
 
 // The udpDailer is used to create a udp connection.
-// During testing, the udp dialer can be swapped out for a stub.
+// During testing, the udp dialer can be swapped out for a stub. Each tracker
+// uses the dialer set when it was created.
 var UDPDialer func(network, address string) (net.Conn, error) = net.Dial
 
 type TorrentStatter interface {
@@ -32,7 +33,9 @@ type TorrentStatter interface {
 	Uploaded() int64
 	Left() int64
 	Port() uint16
+	// PeerId and Key must not change between announces
 	PeerId() []byte
+	Key() int32
 }
 
 type Tracker struct {
@@ -43,6 +46,7 @@ type Tracker struct {
 	stop         chan struct{}
 	peerChan     chan string
 	announce     chan struct{} // Used to force an announce
+	dial         func(network, address string) (net.Conn, error)
 }
 
 type connectRequest struct {
@@ -66,6 +70,8 @@ func NewTracker(address string, stat TorrentStatter, peerChan chan string) (trk
 		stat:     stat,
 		peerChan: peerChan,
 		stop:     make(chan struct{}),
+		announce: make(chan struct{}),
+		dial:     UDPDialer,
 	}
 	return
 }
@@ -90,6 +96,7 @@ func (tkr *Tracker) Start() {
 				transactionId: rand.Int31(),
 				infoHash:      tkr.stat.InfoHash(),
 				peerId:        tkr.stat.PeerId(),
+				key:           tkr.stat.Key(),
 				downloaded:    tkr.stat.Downloaded(),
 				left:          tkr.stat.Left(),
 				uploaded:      tkr.stat.Uploaded(),
@@ -120,6 +127,7 @@ func (tkr *Tracker) Start() {
 			transactionId: rand.Int31(),
 			infoHash:      tkr.stat.InfoHash(),
 			peerId:        tkr.stat.PeerId(),
+			key:           tkr.stat.Key(),
 			downloaded:    tkr.stat.Downloaded(),
 			left:          tkr.stat.Left(),
 			uploaded:      tkr.stat.Uploaded(),
@@ -141,7 +149,7 @@ func (tkr *Tracker) Announce() {
 }
 
 func (tkr *Tracker) udpAnnounce(annReq *announceRequest) (annRes *announceResponse, err error) {
-	conn, err := UDPDialer(tkr.url.Scheme, tkr.url.Host)
+	conn, err := tkr.dial(tkr.url.Scheme, tkr.url.Host)
 	if err != nil {
 		return
 	}
@@ -172,7 +180,7 @@ func (tkr *Tracker) udpAnnounce(annReq *announceRequest) (annRes *announceRespon
 	if annRes, err = parseAnnounceResponse(conn); err != nil {
 		return
 	} else if annRes.transactionId != annReq.transactionId {
-		errors.New("updAnnounce: received transactionId did not match")
+		err = errors.New("udpAnnounce: received transactionId did not match")
 		return
 	} else if annRes.action != 1 {
 		err = errors.New(fmt.Sprintf("udpAnnounce: action is not set to announce (1), instead got %d", annRes.action))
@@ -2,8 +2,10 @@ package tracker
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -41,6 +43,7 @@ func TestTrackerPure(t *testing.T) {
 	conn := testConn{
 		readBuf:  readBuf,
 		writeBuf: writeBuf,
+		mutex:    new(sync.Mutex),
 	}
 	var udpdialer = func(network, address string) (net.Conn, error) {
 		return conn, nil
@@ -60,17 +63,21 @@ func TestTrackerPure(t *testing.T) {
 	tkr, _ := NewTracker("udp://tracker.openbittorrent.com:80", stat, peerChan)
 	tkr.Start()
 	time.Sleep(1000)
+	conn.mutex.Lock()
 	fmt.Println(writeBuf.Bytes())
 	fmt.Println(readBuf.Bytes())
+	conn.mutex.Unlock()
 
 }
 
 type testTorrentStatter struct {
 	infoHash   []byte
+	peerId     []byte
+	key        int32
 	downloaded int64
 	uploaded   int64
 	left       int64
-	port       int16
+	port       uint16
 }
 
 func (stat *testTorrentStatter) InfoHash() []byte {
@@ -89,21 +96,122 @@ func (stat *testTorrentStatter) Left() int64 {
 	return stat.left
 }
 
-func (stat *testTorrentStatter) Port() int16 {
+func (stat *testTorrentStatter) Port() uint16 {
 	return stat.port
 }
 
+func (stat *testTorrentStatter) PeerId() []byte {
+	return stat.peerId
+}
+
+func (stat *testTorrentStatter) Key() int32 {
+	return stat.key
+}
+
+// TestTrackerConstantIdentity checks that every announce, including the final
+// stopped announce, carries the same peer id and key. Private trackers ban
+// clients whose identity changes.
+func TestTrackerConstantIdentity(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	type announce struct {
+		peerId []byte
+		key    int32
+		event  int32
+	}
+	announces := make(chan announce, 10)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			res := new(bytes.Buffer)
+			switch n {
+			case 16: // Connect
+				binary.Write(res, binary.BigEndian, int32(0))
+				res.Write(b[12:16])
+				binary.Write(res, binary.BigEndian, int64(1))
+			case 98: // Announce
+				announces <- announce{
+					peerId: append([]byte{}, b[36:56]...),
+					key:    int32(binary.BigEndian.Uint32(b[88:92])),
+					event:  int32(binary.BigEndian.Uint32(b[80:84])),
+				}
+				binary.Write(res, binary.BigEndian, int32(1))
+				res.Write(b[12:16])
+				binary.Write(res, binary.BigEndian, []int32{3600, 0, 0})
+			default:
+				continue
+			}
+			pc.WriteTo(res.Bytes(), addr)
+		}
+	}()
+
+	dialer := UDPDialer
+	UDPDialer = net.Dial
+	defer func() { UDPDialer = dialer }()
+
+	stat := &testTorrentStatter{
+		infoHash: bytes.Repeat([]byte{1}, 20),
+		peerId:   []byte("-LT0000-privateprivt"),
+		key:      12345,
+		left:     100,
+		port:     6881,
+	}
+	tkr, err := NewTracker("udp://"+pc.LocalAddr().String(), stat, make(chan string, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkr.Start()
+
+	var received []announce
+	timeout := time.After(time.Second * 5)
+	for len(received) < 3 {
+		select {
+		case a := <-announces:
+			received = append(received, a)
+			if len(received) == 1 {
+				tkr.Announce()
+			} else if len(received) == 2 {
+				tkr.Stop()
+			}
+		case <-timeout:
+			t.Fatalf("Only received %d announces", len(received))
+		}
+	}
+
+	for _, a := range received {
+		if !bytes.Equal(a.peerId, stat.peerId) || a.key != stat.key {
+			t.Errorf("Announce changed identity: peer id %s, key %d", a.peerId, a.key)
+		}
+	}
+	if received[0].event != STARTED || received[2].event != STOPPED {
+		t.Error("Incorrect announce events: ", received[0].event, received[2].event)
+	}
+}
+
 type testConn struct {
 	writeBuf *bytes.Buffer
 	readBuf  *bytes.Buffer
+	mutex    *sync.Mutex // The tracker reads and writes from its own goroutine
 }
 
 func (conn testConn) Read(b []byte) (n int, err error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
 	n, err = conn.readBuf.Read(b)
 	return
 }
 
 func (conn testConn) Write(b []byte) (n int, err error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
 	fmt.Println("Trying to write: ", b)
 	n, err = conn.writeBuf.Write(b)
 	fmt.Println(conn.writeBuf.Bytes())
@@ -0,0 +1,362 @@
+package libtorrent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/torrance/libtorrent/bitfield"
+	"github.com/torrance/libtorrent/metainfo"
+	"github.com/torrance/libtorrent/ratelimit"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The most requests we make at once to a single web seed server
+	maxWebSeedConnections = 4
+	// Failed fetches are attempted this many times before the web seed is
+	// rested for webSeedBackoff
+	maxWebSeedRetries = 3
+	webSeedTimeout    = time.Second * 60
+)
+
+// Delays between retries and after repeated failures. These are variables so
+// that tests can shorten them.
+var (
+	webSeedRetryDelay = time.Second
+	webSeedBackoff    = time.Second * 30
+)
+
+// webSeed downloads from an HTTP mirror of the torrent's files (BEP 19).
+//
+// Each web seed is driven by the receive loop through a stand in peer that
+// has every piece. The receive loop's block requests are read from the peer's
+// write queue, fetched with HTTP range requests, and delivered back as piece
+// messages, so web seeds share the piece picker, hash checks and smart banning
+// with ordinary peers. Blocks from a web seed are attributed to its URL.
+type webSeed struct {
+	url       string
+	httpSeed  bool // A BEP 17 seed script rather than a BEP 19 mirror
+	t         *Torrent
+	peer      *peer
+	client    *http.Client
+	slots     chan struct{} // Shared by every web seed on the same host
+	retry     time.Duration
+	backoff   time.Duration
+	mutex     sync.Mutex
+	resting   bool
+	closeOnce sync.Once
+}
+
+// webSeedConn stands in for the network connection of a web seed's peer.
+type webSeedConn struct{}
+
+func (webSeedConn) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (webSeedConn) Write(b []byte) (int, error) { return len(b), nil }
+func (webSeedConn) Close() error                { return nil }
+
+func newWebSeed(t *Torrent, url string, httpSeed bool, slots chan struct{}) (ws *webSeed) {
+	ws = &webSeed{
+		url:      url,
+		httpSeed: httpSeed,
+		t:        t,
+		client:   &http.Client{Timeout: webSeedTimeout},
+		slots:    slots,
+		retry:    webSeedRetryDelay,
+		backoff:  webSeedBackoff,
+	}
+	ws.peer = newPeer(url, webSeedConn{}, t.readChan, &t.stats, nil, nil)
+	// Requests are consumed by several workers, so allow for a little more
+	// than the outstanding request limit to be queued
+	ws.peer.write = make(chan binaryDumper, 2*maxPeerRequests)
+	ws.peer.addr = url
+	ws.peer.ip = url
+	ws.peer.SetBitfield(bitfield.NewBitfield(t.meta.PieceCount))
+	return
+}
+
+// start introduces the web seed to the receive loop as a peer that has every
+// piece and is not choking us.
+func (ws *webSeed) start() {
+	for i := 0; i < cap(ws.slots); i++ {
+		go ws.work()
+	}
+
+	bitf := bitfield.NewBitfield(ws.t.meta.PieceCount)
+	for i := 0; i < bitf.Length(); i++ {
+		bitf.SetTrue(i)
+	}
+	ws.deliver(&bitfieldMessage{bitf: bitf})
+	ws.deliver(&unchokeMessage{})
+}
+
+// Close stops the web seed. The receive loop is told, so that its outstanding
+// requests are released to other peers.
+func (ws *webSeed) Close() {
+	ws.closeOnce.Do(func() {
+		ws.peer.Close()
+		go func() { ws.t.readChan <- peerDouble{msg: &peerClosed{}, peer: ws.peer} }()
+	})
+}
+
+func (ws *webSeed) deliver(msg interface{}) {
+	select {
+	case ws.t.readChan <- peerDouble{msg: msg, peer: ws.peer}:
+	case <-ws.peer.done:
+	}
+}
+
+// work serves block requests until the web seed is closed. Requests for
+// consecutive blocks of a piece are fetched together.
+func (ws *webSeed) work() {
+	var next *requestMessage
+	for {
+		req := next
+		next = nil
+		for req == nil {
+			select {
+			case msg := <-ws.peer.write:
+				// Everything but requests is meaningless to a web seed
+				req, _ = msg.(*requestMessage)
+			case <-ws.peer.done:
+				return
+			}
+		}
+
+		reqs := []*requestMessage{req}
+	coalesce:
+		for {
+			select {
+			case msg := <-ws.peer.write:
+				r, ok := msg.(*requestMessage)
+				if !ok {
+					continue
+				}
+				last := reqs[len(reqs)-1]
+				if r.pieceIndex != last.pieceIndex || r.blockOffset != last.blockOffset+last.blockLength {
+					next = r
+					break coalesce
+				}
+				reqs = append(reqs, r)
+			default:
+				break coalesce
+			}
+		}
+
+		// Requests made before the web seed started resting have been released
+		ws.mutex.Lock()
+		resting := ws.resting
+		ws.mutex.Unlock()
+		if !resting {
+			ws.fetchBlocks(reqs)
+		}
+	}
+}
+
+func (ws *webSeed) fetchBlocks(reqs []*requestMessage) {
+	index := int(reqs[0].pieceIndex)
+	begin := int64(reqs[0].blockOffset)
+	var length int64
+	for _, req := range reqs {
+		length += int64(req.blockLength)
+	}
+
+	data, err := ws.fetch(index, begin, length)
+	if busy, ok := err.(busyError); ok {
+		logger.Debug("Web seed %s is busy, waiting %s", ws.url, busy.wait)
+		ws.rest(busy.wait)
+		return
+	} else if err != nil {
+		if !ws.peer.closed() {
+			logger.Info("Web seed %s failed: %s", ws.url, err)
+			ws.rest(ws.backoff)
+		}
+		return
+	}
+
+	for _, req := range reqs {
+		block := data[:req.blockLength]
+		data = data[req.blockLength:]
+		ws.peer.addDownloaded(int64(len(block)))
+		ws.deliver(&pieceMessage{pieceIndex: req.pieceIndex, blockOffset: req.blockOffset, data: block})
+	}
+}
+
+// fetch reads length bytes of piece index starting at begin, retrying with an
+// increasing delay on failure. A busy server is not retried.
+func (ws *webSeed) fetch(index int, begin, length int64) (data []byte, err error) {
+	for attempt := 0; attempt < maxWebSeedRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(ws.retry << uint(attempt-1)):
+			case <-ws.peer.done:
+				return nil, errors.New("web seed closed")
+			}
+		}
+		if ws.httpSeed {
+			data, err = ws.fetchPiece(index, begin, length)
+		} else {
+			data, err = ws.fetchRange(int64(index)*ws.t.meta.PieceLength+begin, length)
+		}
+		if _, busy := err.(busyError); err == nil || busy {
+			return
+		}
+		logger.Debug("Web seed %s fetch attempt %d failed: %s", ws.url, attempt+1, err)
+	}
+	return
+}
+
+func (ws *webSeed) fetchRange(start, length int64) (data []byte, err error) {
+	data = make([]byte, length)
+	for _, seg := range fileSegments(ws.t.meta.Files, start, length) {
+		// Padding is all zeros and never served
+		if seg.file.Pad {
+			continue
+		}
+		buf := data[seg.start-start : seg.start-start+seg.length]
+		if err = ws.get(webSeedFileURL(ws.url, seg.file), seg.offset, buf); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// get reads len(buf) bytes from offset in the file at u. Redirects are followed
+// by the HTTP client.
+func (ws *webSeed) get(u string, offset int64, buf []byte) (err error) {
+	if !ws.acquireSlot() {
+		return errors.New("web seed closed")
+	}
+	defer ws.releaseSlot()
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1))
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	body := io.Reader(&countingReader{r: resp.Body, p: ws.peer})
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server has ignored the range and is sending the whole file
+		if _, err = io.CopyN(ioutil.Discard, body, offset); err != nil {
+			return
+		}
+	default:
+		return errors.New(fmt.Sprintf("%s: %s", u, resp.Status))
+	}
+	_, err = io.ReadFull(ratelimit.NewReader(body, ws.peer.downLimiter, ws.t.downLimiter, ws.t.config.DownloadLimiter), buf)
+	return
+}
+
+// acquireSlot waits for one of the connections allowed to the web seed's
+// server. It returns false if the web seed is closed first.
+func (ws *webSeed) acquireSlot() bool {
+	select {
+	case ws.slots <- struct{}{}:
+		return true
+	case <-ws.peer.done:
+		return false
+	}
+}
+
+func (ws *webSeed) releaseSlot() {
+	<-ws.slots
+}
+
+// rest takes the web seed out of the picker for wait, after its retries are
+// exhausted or the server says it is busy. Its outstanding requests are
+// released to others.
+func (ws *webSeed) rest(wait time.Duration) {
+	ws.mutex.Lock()
+	if ws.resting {
+		ws.mutex.Unlock()
+		return
+	}
+	ws.resting = true
+	ws.mutex.Unlock()
+
+	ws.deliver(&chokeMessage{})
+	go func() {
+		select {
+		case <-time.After(wait):
+		case <-ws.peer.done:
+			return
+		}
+		// Anything still queued was released by the choke
+	drain:
+		for {
+			select {
+			case <-ws.peer.write:
+			default:
+				break drain
+			}
+		}
+		ws.mutex.Lock()
+		ws.resting = false
+		ws.mutex.Unlock()
+		ws.deliver(&unchokeMessage{})
+	}()
+}
+
+// fileSegment is the part of a file covered by a range of the torrent.
+type fileSegment struct {
+	file   metainfo.File
+	start  int64 // Offset of the segment within the torrent
+	offset int64 // Offset of the segment within the file
+	length int64
+}
+
+// fileSegments splits length bytes of the torrent starting at start into the
+// files they cover.
+func fileSegments(files []metainfo.File, start, length int64) (segs []fileSegment) {
+	end := start + length
+	var fileStart int64
+	for _, f := range files {
+		fileEnd := fileStart + f.Length
+		if f.Length > 0 && fileEnd > start && fileStart < end {
+			segStart, segEnd := fileStart, fileEnd
+			if start > segStart {
+				segStart = start
+			}
+			if end < segEnd {
+				segEnd = end
+			}
+			segs = append(segs, fileSegment{
+				file:   f,
+				start:  segStart,
+				offset: segStart - fileStart,
+				length: segEnd - segStart,
+			})
+		}
+		fileStart = fileEnd
+	}
+	return
+}
+
+// webSeedFileURL maps a file to its URL on a web seed. A URL ending in a slash
+// is a directory holding the torrent, so the file's path is added to it. Single
+// file torrents may also give the URL of the file itself.
+func webSeedFileURL(base string, f metainfo.File) string {
+	if len(f.RawPath) == 1 && !strings.HasSuffix(base, "/") {
+		return base
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	escaped := make([]string, len(f.RawPath))
+	for i, name := range f.RawPath {
+		escaped[i] = url.PathEscape(name)
+	}
+	return base + strings.Join(escaped, "/")
+}
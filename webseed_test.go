@@ -0,0 +1,210 @@
+package libtorrent
+
+import (
+	"bytes"
+	"github.com/torrance/libtorrent/filestore"
+	"github.com/torrance/libtorrent/metainfo"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newWebSeedMetainfo builds a torrent of testData/multitest in 16KiB pieces
+// with the given web seeds.
+func newWebSeedMetainfo(t *testing.T, webSeeds ...string) *metainfo.Metainfo {
+	b := metainfo.NewBuilder(filepath.Join("testData", "multitest"))
+	b.PieceLength = 16384
+	b.WebSeeds = webSeeds
+	buf := new(bytes.Buffer)
+	if _, err := b.WriteTo(buf); err != nil {
+		t.Fatal("Failed to build torrent: ", err)
+	}
+	m, err := metainfo.ParseMetainfo(buf)
+	if err != nil {
+		t.Fatal("Failed to parse torrent: ", err)
+	}
+	return m
+}
+
+func checkMultitest(t *testing.T, tor *Torrent) {
+	for _, name := range []string{"test1.txt", "test2.txt", "test3.txt"} {
+		original, _ := ioutil.ReadFile(filepath.Join("testData", "multitest", name))
+		downloaded, _ := ioutil.ReadFile(filepath.Join(tor.config.RootDirectory, "multitest", name))
+		if !bytes.Equal(original, downloaded) {
+			t.Errorf("Downloaded file %s does not match original", name)
+		}
+	}
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	webSeedRetryDelay = time.Millisecond
+
+	// The mirror redirects to the files, fails the first request for each
+	// file, and counts how many requests are made at once.
+	var mutex sync.Mutex
+	failed := make(map[string]bool)
+	active, maxActive := 0, 0
+	files := http.StripPrefix("/files/", http.FileServer(http.Dir("testData")))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mirror/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/files/"+strings.TrimPrefix(r.URL.Path, "/mirror/"), http.StatusFound)
+	})
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		first := !failed[r.URL.Path]
+		failed[r.URL.Path] = true
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			active--
+			mutex.Unlock()
+		}()
+
+		if r.Header.Get("Range") == "" {
+			t.Error("Web seed request without a range")
+		}
+		if first {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	m := newWebSeedMetainfo(t, server.URL+"/mirror/")
+	tor, _, cleanup := newTestTorrentFromMeta(t, m, "-LT0000-webseedwebse", nil)
+	defer cleanup()
+	tor.Start()
+
+	if !waitFor(time.Second*10, func() bool { return tor.State() == Seeding }) {
+		t.Fatalf("Download did not complete, %d bytes left", tor.Left())
+	}
+	checkMultitest(t, tor)
+
+	mutex.Lock()
+	if maxActive > maxWebSeedConnections {
+		t.Errorf("%d requests at once, limit is %d", maxActive, maxWebSeedConnections)
+	}
+	mutex.Unlock()
+
+	stats := tor.PeerStats()
+	if len(stats) != 1 || stats[0].Downloaded != 24893+34113+36880 {
+		t.Errorf("Incorrect web seed stats: %+v", stats)
+	}
+}
+
+func TestWebSeedBansBadMirror(t *testing.T) {
+	webSeedRetryDelay = time.Millisecond
+	webSeedBackoff = time.Millisecond * 10
+
+	// The good mirror refuses to serve until the bad one is banned, so that
+	// the bad mirror is sure to be asked for pieces
+	var tor *Torrent
+	var badURL string
+	files := http.FileServer(http.Dir("testData"))
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tor.isBannedIP(badURL) {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Serve the right amount of the wrong data
+		rec := httptest.NewRecorder()
+		files.ServeHTTP(rec, r)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(bytes.Repeat([]byte{'x'}, rec.Body.Len()))
+	}))
+	defer bad.Close()
+
+	badURL = bad.URL + "/"
+	m := newWebSeedMetainfo(t, badURL, good.URL+"/")
+	tor, _, cleanup := newTestTorrentFromMeta(t, m, "-LT0000-badmirrorbad", nil)
+	defer cleanup()
+	tor.Start()
+
+	if !waitFor(time.Second*10, func() bool { return tor.State() == Seeding }) {
+		t.Fatalf("Download did not complete, %d bytes left", tor.Left())
+	}
+	checkMultitest(t, tor)
+
+	if tor.isBannedIP(good.URL + "/") {
+		t.Error("Good mirror was banned")
+	}
+}
+
+func TestWebSeedFileURL(t *testing.T) {
+	tests := []struct {
+		base     string
+		path     []string
+		expected string
+	}{
+		{"http://example.com/file.iso", []string{"file.iso"}, "http://example.com/file.iso"},
+		{"http://example.com/pub/", []string{"file.iso"}, "http://example.com/pub/file.iso"},
+		{"http://example.com/pub", []string{"dir", "a b.txt"}, "http://example.com/pub/dir/a%20b.txt"},
+		{"http://example.com/", []string{"dir", "sub", "c#.txt"}, "http://example.com/dir/sub/c%23.txt"},
+	}
+	for _, test := range tests {
+		if u := webSeedFileURL(test.base, metainfo.File{RawPath: test.path}); u != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, u)
+		}
+	}
+}
+
+func TestFileSegments(t *testing.T) {
+	files := []metainfo.File{{Length: 10}, {Length: 0}, {Length: 5}, {Length: 20}}
+	segs := fileSegments(files, 8, 10)
+	if len(segs) != 3 {
+		t.Fatalf("Incorrect segments: %+v", segs)
+	}
+	expected := []struct{ start, offset, length int64 }{{8, 8, 2}, {10, 0, 5}, {15, 0, 3}}
+	for i, e := range expected {
+		if segs[i].start != e.start || segs[i].offset != e.offset || segs[i].length != e.length {
+			t.Errorf("Segment %d: expected %+v, got %+v", i, e, segs[i])
+		}
+	}
+}
+
+func TestWebSeedDownloadToMemory(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testData")))
+	defer server.Close()
+
+	storage := filestore.NewMemoryStorage()
+	m := newWebSeedMetainfo(t, server.URL+"/")
+	tor, err := NewTorrent(m, &Config{PeerId: []byte("-LT0000-memorymemory"), Storage: storage})
+	if err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+	defer func() {
+		for _, ws := range tor.webSeedList() {
+			ws.Close()
+		}
+	}()
+	tor.Start()
+
+	if !waitFor(time.Second*10, func() bool { return tor.State() == Seeding }) {
+		t.Fatalf("Download did not complete, %d bytes left", tor.Left())
+	}
+	for _, name := range []string{"test1.txt", "test2.txt", "test3.txt"} {
+		original, _ := ioutil.ReadFile(filepath.Join("testData", "multitest", name))
+		tfile, _ := storage.OpenFile(filepath.Join("multitest", name), int64(len(original)))
+		if !bytes.Equal(original, tfile.(*filestore.MemoryFile).Bytes()) {
+			t.Errorf("Downloaded file %s does not match original", name)
+		}
+	}
+}